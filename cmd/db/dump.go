@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/sifes/architecture-practice-5/datastore"
+)
+
+// dumpContentType is the media type of JSON Lines exports.
+const dumpContentType = "application/jsonl"
+
+func handleDump(db datastore.Engine, rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", dumpContentType)
+	if _, err := db.Dump(rw); err != nil {
+		// The status line is already sent; the client sees a truncated body
+		log.Printf("Dump failed: %v", err)
+	}
+}
+
+func handleLoad(db datastore.Engine, rw http.ResponseWriter, r *http.Request) {
+	n, err := db.LoadContext(r.Context(), r.Body)
+	if err != nil {
+		if writeUnavailable(rw, fmt.Errorf("loaded %d records before failing: %w", n, err)) {
+			return
+		}
+		status, ok := invalidWriteStatus(err)
+		if !ok && errors.Is(err, datastore.ErrInvalidDump) {
+			status, ok = http.StatusBadRequest, true
+		}
+		if !ok {
+			log.Printf("Load failed after %d records: %v", n, err)
+			http.Error(rw, fmt.Sprintf("Loaded %d records before failing to store the rest", n), http.StatusInternalServerError)
+			return
+		}
+		http.Error(rw, fmt.Sprintf("Loaded %d records before failing: %v", n, err), status)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintf(rw, "Loaded %d records", n)
+}
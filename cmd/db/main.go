@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sifes/architecture-practice-5/datastore"
 	"github.com/sifes/architecture-practice-5/httptools"
@@ -15,6 +19,27 @@ import (
 
 var port = flag.Int("port", 8070, "database server port")
 var dir = flag.String("dir", "/opt/practice-4/data", "database directory")
+var root = flag.String("root", "", "serve one database per subdirectory of this directory instead of -dir")
+var maxOpen = flag.Int("max-open", 16, "number of databases kept open at once with -root")
+var engine = flag.String("engine", datastore.EngineHash, "storage engine: hash or lsm")
+var admission = flag.String("admission", "block", "what writes do while the write queue is full: block, fail or timeout")
+var admissionTimeout = flag.Duration("admission-timeout", time.Second, "how long writes wait for room in the write queue with -admission=timeout")
+var writeQueue = flag.Int("write-queue", 100, "number of writes queued before the admission policy applies")
+var retryAfter = flag.Int("retry-after", 1, "seconds clients are asked to wait before retrying refused writes")
+var objectStore = flag.String("object-store", "", "directory standing in for an object store that cold segments are offloaded to, one subdirectory per database with -root")
+var localSegments = flag.Int("local-segments", 2, "number of most recent sealed segments kept on local disk with -object-store")
+var indexOnDisk = flag.Bool("index-on-disk", false, "keep the index in files next to the segments instead of memory")
+var indexCache = flag.Int("index-cache", 100000, "number of index entries cached in memory with -index-on-disk")
+var compactIndex = flag.Bool("compact-index", false, "keep the in-memory index in a compact form using less memory per key")
+
+var indexes indexFlag
+
+func init() {
+	flag.Var(&indexes, "index", "secondary index over a JSON field as name=[bucket/]field, may be repeated")
+}
+
+// seqHeader carries the sequence number assigned to a stored record.
+const seqHeader = "X-Db-Seq"
 
 type keyValueResponse struct {
 	Key   string      `json:"key"`
@@ -25,21 +50,137 @@ type valueRequest struct {
 	Value interface{} `json:"value"`
 }
 
+type versionResponse struct {
+	Seq       uint64      `json:"seq"`
+	Timestamp *time.Time  `json:"timestamp,omitempty"`
+	Type      string      `json:"type"`
+	Value     interface{} `json:"value"`
+}
+
+type keyVersionResponse struct {
+	Key string `json:"key"`
+	versionResponse
+}
+
+type historyResponse struct {
+	Key      string            `json:"key"`
+	Versions []versionResponse `json:"versions"`
+}
+
+type indexLookupResponse struct {
+	Index string   `json:"index"`
+	Value string   `json:"value"`
+	Keys  []string `json:"keys"`
+}
+
+type bucketKeysResponse struct {
+	Bucket string   `json:"bucket"`
+	Keys   []string `json:"keys"`
+}
+
+// keySpace is the default key space of the database or one of its buckets.
+type keySpace interface {
+	GetContext(ctx context.Context, key string) (string, error)
+	GetInt64Context(ctx context.Context, key string) (int64, error)
+	PutContext(ctx context.Context, key, value string) (uint64, error)
+	PutInt64Context(ctx context.Context, key string, value int64) (uint64, error)
+}
+
+// versionedKeySpace is a key space that keeps older versions of its keys.
+// Only the hash engine provides one.
+type versionedKeySpace interface {
+	keySpace
+	GetAt(key string, seq uint64) (datastore.Version, error)
+	GetAtTime(key string, t time.Time) (datastore.Version, error)
+	History(key string) ([]datastore.Version, error)
+}
+
 func main() {
 	flag.Parse()
 
-	// Open database
-	db, err := datastore.Open(*dir)
-	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
+	opts := datastore.Options{
+		Indexes:          indexes,
+		WriteQueueSize:   *writeQueue,
+		AdmissionTimeout: *admissionTimeout,
+		LocalSegments:    *localSegments,
+		IndexOnDisk:      *indexOnDisk,
+		IndexCacheSize:   *indexCache,
+		CompactIndex:     *compactIndex,
+	}
+	if *engine != datastore.EngineHash && *engine != datastore.EngineLSM {
+		log.Fatalf("Unknown storage engine %q", *engine)
+	}
+	switch *admission {
+	case "block":
+		opts.Admission = datastore.AdmitBlock
+	case "fail":
+		opts.Admission = datastore.AdmitFailFast
+	case "timeout":
+		opts.Admission = datastore.AdmitTimeout
+	default:
+		log.Fatalf("Unknown admission policy %q", *admission)
 	}
-	defer db.Close()
 
+	var h http.Handler
+	var source dbSource
+	if *root != "" {
+		// Serve every database found under the root directory
+		reg, err := newRegistry(*root, *objectStore, *maxOpen, *engine, opts)
+		if err != nil {
+			log.Fatalf("Failed to open database root: %v", err)
+		}
+		defer reg.Close()
+		h = reg.Handler()
+		source = reg.forEachOpen
+	} else {
+		if *objectStore != "" {
+			store, err := datastore.NewDirObjectStore(*objectStore)
+			if err != nil {
+				log.Fatalf("Failed to open object store: %v", err)
+			}
+			opts.ObjectStore = store
+		}
+
+		// Open database
+		db, err := datastore.OpenEngine(*engine, *dir, opts)
+		if err != nil {
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		defer db.Close()
+		h = newDbHandler(db)
+		source = func(fn func(name string, db datastore.Engine)) { fn("", db) }
+	}
+
+	// Count every request and expose the counts with the storage statistics
+	m := newMetrics()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler(source))
+	mux.Handle("/", m.instrument(h))
+
+	log.Printf("Starting database server on port %d...", *port)
+	server := httptools.CreateServer(*port, mux)
+	server.Start()
+	signal.WaitForTerminationSignal()
+}
+
+// newDbHandler serves the routes of a single database under /db/ and its
+// statistics at /admin/stats. Routes for features only the hash engine has
+// answer 501 Not Implemented on other engines.
+func newDbHandler(db datastore.Engine) http.Handler {
 	h := new(http.ServeMux)
+	full, _ := db.(*datastore.Db)
 
-	// GET /db/<key>
+	// GET /db/<key>, GET /db/<bucket>/<key>
 	h.HandleFunc("/db/", func(rw http.ResponseWriter, r *http.Request) {
 		key := strings.TrimPrefix(r.URL.Path, "/db/")
+		if name, bucketKey, ok := strings.Cut(key, "/"); ok {
+			if full == nil {
+				notSupported(rw)
+				return
+			}
+			handleBucket(full, name, bucketKey, rw, r)
+			return
+		}
 		
 		if r.Method == http.MethodGet {
 			handleGet(db, key, rw, r)
@@ -50,18 +191,92 @@ func main() {
 		}
 	})
 
-	log.Printf("Starting database server on port %d...", *port)
-	server := httptools.CreateServer(*port, h)
-	server.Start()
-	signal.WaitForTerminationSignal()
+	// POST /db/_tx
+	h.HandleFunc("/db/_tx", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if full == nil {
+			notSupported(rw)
+			return
+		}
+		handleTx(full, rw, r)
+	})
+
+	// GET /db/_dump, POST /db/_load
+	h.HandleFunc("/db/_dump", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleDump(db, rw)
+	})
+	h.HandleFunc("/db/_load", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleLoad(db, rw, r)
+	})
+
+	// GET /db/_index/<name>?value=<value>
+	h.HandleFunc("/db/_index/", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if full == nil {
+			notSupported(rw)
+			return
+		}
+		handleIndexLookup(full, strings.TrimPrefix(r.URL.Path, "/db/_index/"), rw, r)
+	})
+
+	// GET /db/_buckets
+	h.HandleFunc("/db/_buckets", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if full == nil {
+			notSupported(rw)
+			return
+		}
+		handleBuckets(full, rw)
+	})
+
+	// GET /admin/stats
+	h.HandleFunc("/admin/stats", func(rw http.ResponseWriter, r *http.Request) {
+		handleStats(db, rw, r)
+	})
+
+	return h
 }
 
-func handleGet(db *datastore.Db, key string, rw http.ResponseWriter, r *http.Request) {
+func handleGet(db keySpace, key string, rw http.ResponseWriter, r *http.Request) {
 	if key == "" {
 		http.Error(rw, "Key is required", http.StatusBadRequest)
 		return
 	}
 
+	// Point-in-time reads
+	history := r.URL.Query().Get("history") == "true"
+	version := r.URL.Query().Get("version")
+	if history || version != "" {
+		versioned, ok := db.(versionedKeySpace)
+		if !ok {
+			notSupported(rw)
+			return
+		}
+		if history {
+			handleHistory(versioned, key, rw)
+		} else {
+			handleVersion(versioned, key, version, rw)
+		}
+		return
+	}
+
 	// Check for type parameter (for variant 4)
 	valueType := r.URL.Query().Get("type")
 	if valueType == "" {
@@ -73,15 +288,18 @@ func handleGet(db *datastore.Db, key string, rw http.ResponseWriter, r *http.Req
 
 	switch valueType {
 	case "int64":
-		value, err = db.GetInt64(key)
+		value, err = db.GetInt64Context(r.Context(), key)
 	case "string":
-		value, err = db.Get(key)
+		value, err = db.GetContext(r.Context(), key)
 	default:
 		http.Error(rw, "Invalid type parameter", http.StatusBadRequest)
 		return
 	}
 
 	if err != nil {
+		if writeUnavailable(rw, err) {
+			return
+		}
 		if err == datastore.ErrNotFound {
 			http.Error(rw, "Not found", http.StatusNotFound)
 			return
@@ -100,7 +318,75 @@ func handleGet(db *datastore.Db, key string, rw http.ResponseWriter, r *http.Req
 	json.NewEncoder(rw).Encode(response)
 }
 
-func handlePost(db *datastore.Db, key string, rw http.ResponseWriter, r *http.Request) {
+// handleVersion serves GET /db/<key>?version=<seq or RFC 3339 time>.
+func handleVersion(db versionedKeySpace, key, version string, rw http.ResponseWriter) {
+	var v datastore.Version
+	var err error
+
+	if seq, parseErr := strconv.ParseUint(version, 10, 64); parseErr == nil {
+		v, err = db.GetAt(key, seq)
+	} else if t, parseErr := time.Parse(time.RFC3339Nano, version); parseErr == nil {
+		v, err = db.GetAtTime(key, t)
+	} else {
+		http.Error(rw, "Invalid version parameter", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		}
+		http.Error(rw, "Failed to read value", http.StatusInternalServerError)
+		return
+	}
+
+	response := keyVersionResponse{
+		Key:             key,
+		versionResponse: newVersionResponse(v),
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(response)
+}
+
+// handleHistory serves GET /db/<key>?history=true.
+func handleHistory(db versionedKeySpace, key string, rw http.ResponseWriter) {
+	versions, err := db.History(key)
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		}
+		http.Error(rw, "Failed to read history", http.StatusInternalServerError)
+		return
+	}
+
+	response := historyResponse{
+		Key:      key,
+		Versions: make([]versionResponse, 0, len(versions)),
+	}
+	for _, v := range versions {
+		response.Versions = append(response.Versions, newVersionResponse(v))
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(response)
+}
+
+func newVersionResponse(v datastore.Version) versionResponse {
+	response := versionResponse{
+		Seq:   v.Seq,
+		Type:  datastore.TypeName(v.Type),
+		Value: v.Value,
+	}
+	if !v.Timestamp.IsZero() {
+		response.Timestamp = &v.Timestamp
+	}
+	return response
+}
+
+func handlePost(db keySpace, key string, rw http.ResponseWriter, r *http.Request) {
 	if key == "" {
 		http.Error(rw, "Key is required", http.StatusBadRequest)
 		return
@@ -112,25 +398,180 @@ func handlePost(db *datastore.Db, key string, rw http.ResponseWriter, r *http.Re
 		return
 	}
 
+	var seq uint64
 	var err error
 	
 	// Determine value type and call appropriate Put method
 	switch v := req.Value.(type) {
 	case string:
-		err = db.Put(key, v)
+		seq, err = db.PutContext(r.Context(), key, v)
 	case float64:
 		// JSON numbers are decoded as float64, convert to int64
-		err = db.PutInt64(key, int64(v))
+		seq, err = db.PutInt64Context(r.Context(), key, int64(v))
 	default:
 		// Try to convert to string
-		err = db.Put(key, fmt.Sprintf("%v", v))
+		seq, err = db.PutContext(r.Context(), key, fmt.Sprintf("%v", v))
 	}
 
 	if err != nil {
+		if writeUnavailable(rw, err) {
+			return
+		}
+		if status, ok := invalidWriteStatus(err); ok {
+			http.Error(rw, err.Error(), status)
+			return
+		}
 		http.Error(rw, "Failed to store value", http.StatusInternalServerError)
 		return
 	}
 
+	// Let clients order their writes against later reads
+	rw.Header().Set(seqHeader, strconv.FormatUint(seq, 10))
 	rw.WriteHeader(http.StatusOK)
 	fmt.Fprint(rw, "OK")
-}
\ No newline at end of file
+}
+
+// notSupported answers requests for features the storage engine lacks.
+func notSupported(rw http.ResponseWriter) {
+	http.Error(rw, "Not supported by the storage engine", http.StatusNotImplemented)
+}
+
+// writeUnavailable answers with 503 Service Unavailable if the operation
+// failed because the database is overloaded or being closed, or because the
+// request was canceled or timed out, and reports whether it did. Overload
+// tells clients when to retry so that callers can shed load; a canceled
+// client never sees the response.
+func writeUnavailable(rw http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, datastore.ErrBusy):
+		rw.Header().Set("Retry-After", strconv.Itoa(*retryAfter))
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, datastore.ErrClosed):
+	default:
+		return false
+	}
+	http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+	return true
+}
+
+// invalidWriteStatus maps errors caused by the written key or value to a
+// client error status.
+func invalidWriteStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, datastore.ErrKeyTooLarge), errors.Is(err, datastore.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge, true
+	case errors.Is(err, datastore.ErrEmptyKey), errors.Is(err, datastore.ErrInvalidKey):
+		return http.StatusBadRequest, true
+	}
+	return 0, false
+}
+
+// handleBuckets serves GET /db/_buckets.
+func handleBuckets(db *datastore.Db, rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(db.Buckets())
+}
+
+// handleBucket serves the routes of a named bucket: GET and POST
+// /db/<bucket>/<key>, GET /db/<bucket>/ to list its keys and DELETE
+// /db/<bucket>/ to drop it.
+func handleBucket(db *datastore.Db, name, key string, rw http.ResponseWriter, r *http.Request) {
+	bucket, err := db.Bucket(name)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if key == "" {
+		switch r.Method {
+		case http.MethodGet:
+			response := bucketKeysResponse{
+				Bucket: name,
+				Keys:   bucket.Keys(),
+			}
+			if response.Keys == nil {
+				response.Keys = []string{}
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(response)
+		case http.MethodDelete:
+			if err := db.DropBucketContext(r.Context(), name); err != nil {
+				if writeUnavailable(rw, err) {
+					return
+				}
+				http.Error(rw, "Failed to drop bucket", http.StatusInternalServerError)
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+			fmt.Fprint(rw, "OK")
+		default:
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		handleGet(bucket, key, rw, r)
+	case http.MethodPost:
+		handlePost(bucket, key, rw, r)
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleIndexLookup(db *datastore.Db, name string, rw http.ResponseWriter, r *http.Request) {
+	if !r.URL.Query().Has("value") {
+		http.Error(rw, "Value parameter is required", http.StatusBadRequest)
+		return
+	}
+	value := r.URL.Query().Get("value")
+
+	keys, err := db.Lookup(name, value)
+	if err != nil {
+		if err == datastore.ErrNoSuchIndex {
+			http.Error(rw, "Index not found", http.StatusNotFound)
+			return
+		}
+		http.Error(rw, "Failed to query index", http.StatusInternalServerError)
+		return
+	}
+
+	response := indexLookupResponse{
+		Index: name,
+		Value: value,
+		Keys:  keys,
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(response)
+}
+
+// indexFlag collects -index flags of the form name=[bucket/]field.
+type indexFlag []datastore.IndexSpec
+
+func (f *indexFlag) String() string {
+	var specs []string
+	for _, spec := range *f {
+		field := spec.Field
+		if spec.Bucket != "" {
+			field = spec.Bucket + "/" + field
+		}
+		specs = append(specs, spec.Name+"="+field)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *indexFlag) Set(value string) error {
+	name, field, ok := strings.Cut(value, "=")
+	if !ok || name == "" || field == "" {
+		return fmt.Errorf("expected name=[bucket/]field, got %q", value)
+	}
+
+	spec := datastore.IndexSpec{Name: name, Field: field}
+	if bucket, bucketField, ok := strings.Cut(field, "/"); ok {
+		spec.Bucket, spec.Field = bucket, bucketField
+	}
+	*f = append(*f, spec)
+	return nil
+}
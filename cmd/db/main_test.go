@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sifes/architecture-practice-5/datastore"
+)
+
+func TestHandleGet_Versions(t *testing.T) {
+	db, err := datastore.OpenWithOptions(t.TempDir(), datastore.Options{MaxVersions: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var seqs []uint64
+	for _, value := range []string{"v1", "v2", "v3"} {
+		rec := httptest.NewRecorder()
+		handlePost(db, "key", rec, httptest.NewRequest(http.MethodPost, "/db/key", strings.NewReader(`{"value":"`+value+`"}`)))
+		seq, err := strconv.ParseUint(rec.Header().Get(seqHeader), 10, 64)
+		if rec.Code != http.StatusOK || err != nil {
+			t.Fatalf("POST %s: %d %q", value, rec.Code, rec.Header().Get(seqHeader))
+		}
+		seqs = append(seqs, seq)
+	}
+
+	for _, tc := range []struct {
+		version string
+		status  int
+		value   string
+	}{
+		{strconv.FormatUint(seqs[0], 10), http.StatusOK, "v1"},
+		{strconv.FormatUint(seqs[1], 10), http.StatusOK, "v2"},
+		{time.Now().Add(time.Hour).Format(time.RFC3339Nano), http.StatusOK, "v3"},
+		{"2000-01-01T00:00:00Z", http.StatusNotFound, ""},
+		{"0", http.StatusNotFound, ""},
+		{"yesterday", http.StatusBadRequest, ""},
+	} {
+		rec := httptest.NewRecorder()
+		handleGet(db, "key", rec, httptest.NewRequest(http.MethodGet, "/db/key?version="+tc.version, nil))
+		if rec.Code != tc.status {
+			t.Errorf("Version %s: expected %d, got %d %s", tc.version, tc.status, rec.Code, rec.Body)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		var response keyVersionResponse
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Key != "key" || response.Value != tc.value || response.Type != "string" || response.Timestamp == nil {
+			t.Errorf("Version %s: unexpected response %+v", tc.version, response)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleGet(db, "key", rec, httptest.NewRequest(http.MethodGet, "/db/key?history=true", nil))
+	var history historyResponse
+	if err := json.NewDecoder(rec.Body).Decode(&history); err != nil {
+		t.Fatalf("History: %d %v", rec.Code, err)
+	}
+	if history.Key != "key" || len(history.Versions) != 3 {
+		t.Fatalf("Expected 3 versions, got %+v", history)
+	}
+	for i, v := range history.Versions {
+		if v.Seq != seqs[i] || v.Value != "v"+strconv.Itoa(i+1) {
+			t.Errorf("Version %d: %+v", i, v)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	handleGet(db, "missing", rec, httptest.NewRequest(http.MethodGet, "/db/missing?history=true", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("History of a missing key: expected 404, got %d", rec.Code)
+	}
+}
+
+func TestHandleBucket(t *testing.T) {
+	db, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// bucket serves a request the way the /db/ route does for path
+	// /db/<name>/<key>
+	bucket := func(method, name, key, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleBucket(db, name, key, rec, httptest.NewRequest(method, "/db/"+name+"/"+key, strings.NewReader(body)))
+		return rec
+	}
+
+	for _, k := range [][2]string{{"users", "alice"}, {"users", "bob"}, {"orders", "1"}} {
+		if rec := bucket(http.MethodPost, k[0], k[1], `{"value":"`+k[0]+"/"+k[1]+`"}`); rec.Code != http.StatusOK {
+			t.Fatalf("POST %v: %d %s", k, rec.Code, rec.Body)
+		}
+	}
+	if _, err := db.Put("alice", "default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Buckets and the default key space hold their keys apart
+	rec := bucket(http.MethodGet, "users", "alice", "")
+	var response keyValueResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("GET: %d %v", rec.Code, err)
+	}
+	if response.Key != "alice" || response.Value != "users/alice" {
+		t.Errorf("Unexpected response %+v", response)
+	}
+	if rec := bucket(http.MethodGet, "orders", "alice", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Key of another bucket: expected 404, got %d", rec.Code)
+	}
+
+	checkBuckets := func(expected string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleBuckets(db, rec)
+		if got := strings.TrimSpace(rec.Body.String()); got != expected {
+			t.Errorf("Buckets: expected %s, got %s", expected, got)
+		}
+	}
+	checkKeys := func(name, expected string) {
+		t.Helper()
+		rec := bucket(http.MethodGet, name, "", "")
+		if got := strings.TrimSpace(rec.Body.String()); rec.Code != http.StatusOK || got != expected {
+			t.Errorf("Keys of %s: expected %s, got %d %s", name, expected, rec.Code, got)
+		}
+	}
+	checkBuckets(`["orders","users"]`)
+	checkKeys("users", `{"bucket":"users","keys":["alice","bob"]}`)
+
+	if rec := bucket(http.MethodDelete, "users", "", ""); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE: %d %s", rec.Code, rec.Body)
+	}
+	checkBuckets(`["orders"]`)
+	checkKeys("users", `{"bucket":"users","keys":[]}`)
+	if rec := bucket(http.MethodGet, "users", "alice", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Key of a dropped bucket: expected 404, got %d", rec.Code)
+	}
+	if value, err := db.Get("alice"); err != nil || value != "default" {
+		t.Errorf("Dropping a bucket took a key of the default key space: %q, %v", value, err)
+	}
+	if rec := bucket(http.MethodPut, "users", "", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT on a bucket: expected 405, got %d", rec.Code)
+	}
+}
+
+func TestDbHandler_IndexLookup(t *testing.T) {
+	db, err := datastore.OpenWithOptions(t.TempDir(), datastore.Options{
+		Indexes: []datastore.IndexSpec{{Name: "by_author", Field: "author"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, doc := range map[string]string{
+		"book1": `{"author":"ann"}`,
+		"book2": `{"author":"bob"}`,
+		"book3": `{"author":"ann","title":"Second"}`,
+	} {
+		if _, err := db.Put(key, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := newDbHandler(db)
+	for _, tc := range []struct {
+		path     string
+		status   int
+		expected string
+	}{
+		{"/db/_index/by_author?value=ann", http.StatusOK, `{"index":"by_author","value":"ann","keys":["book1","book3"]}`},
+		{"/db/_index/by_author?value=carl", http.StatusOK, `{"index":"by_author","value":"carl","keys":[]}`},
+		{"/db/_index/by_author", http.StatusBadRequest, ""},
+		{"/db/_index/by_title?value=Second", http.StatusNotFound, ""},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d %s", tc.path, tc.status, rec.Code, rec.Body)
+			continue
+		}
+		if got := strings.TrimSpace(rec.Body.String()); tc.expected != "" && got != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.path, tc.expected, got)
+		}
+	}
+}
+
+func TestDbHandler_WriteLimits(t *testing.T) {
+	db, err := datastore.OpenWithOptions(t.TempDir(), datastore.Options{MaxKeySize: 8, MaxValueSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := newDbHandler(db)
+
+	long := strings.Repeat("v", 17)
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPost, "/db/", `{"value":"v"}`, http.StatusBadRequest},
+		{http.MethodGet, "/db/", "", http.StatusBadRequest},
+		{http.MethodPost, "/db/key%00", `{"value":"v"}`, http.StatusBadRequest},
+		{http.MethodPost, "/db/longerkey", `{"value":"v"}`, http.StatusRequestEntityTooLarge},
+		{http.MethodPost, "/db/key", `{"value":"` + long + `"}`, http.StatusRequestEntityTooLarge},
+		{http.MethodPost, "/db/key", `{"value":"` + long[1:] + `"}`, http.StatusOK},
+		{http.MethodPost, "/db/empty", `{"value":""}`, http.StatusOK},
+
+		// Buckets and transactions check the same limits
+		{http.MethodPost, "/db/users/longerkey", `{"value":"v"}`, http.StatusRequestEntityTooLarge},
+		{http.MethodPost, "/db/users/key", `{"value":"` + long + `"}`, http.StatusRequestEntityTooLarge},
+		{http.MethodPost, "/db/_tx", `{"writes":[{"key":"longerkey","value":"v"}]}`, http.StatusRequestEntityTooLarge},
+		{http.MethodPost, "/db/_tx", `{"writes":[{"key":"key","value":"` + long + `"}]}`, http.StatusRequestEntityTooLarge},
+		{http.MethodPost, "/db/_tx", `{"writes":[{"key":"key\u0000","value":"v"}]}`, http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		if rec.Code != tc.status {
+			t.Errorf("%s %s %s: expected %d, got %d %s", tc.method, tc.path, tc.body, tc.status, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestDbHandler_LSM(t *testing.T) {
+	db, err := datastore.OpenLSM(t.TempDir(), datastore.Options{MaxKeySize: 8, MaxValueSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := newDbHandler(db)
+
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPost, "/db/key", `{"value":"v"}`, http.StatusOK},
+		{http.MethodGet, "/db/key", "", http.StatusOK},
+		{http.MethodPost, "/db/longerkey", `{"value":"v"}`, http.StatusRequestEntityTooLarge},
+		{http.MethodPost, "/db/key", `{"value":"` + strings.Repeat("v", 17) + `"}`, http.StatusRequestEntityTooLarge},
+		{http.MethodPost, "/db/", `{"value":"v"}`, http.StatusBadRequest},
+
+		// Only the hash engine has versions, buckets, transactions and
+		// secondary indexes
+		{http.MethodGet, "/db/key?history=true", "", http.StatusNotImplemented},
+		{http.MethodGet, "/db/key?version=1", "", http.StatusNotImplemented},
+		{http.MethodGet, "/db/users/key", "", http.StatusNotImplemented},
+		{http.MethodGet, "/db/_buckets", "", http.StatusNotImplemented},
+		{http.MethodGet, "/db/_index/by_author?value=ann", "", http.StatusNotImplemented},
+		{http.MethodPost, "/db/_tx", `{"writes":[{"key":"key","value":"v"}]}`, http.StatusNotImplemented},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		if rec.Code != tc.status {
+			t.Errorf("%s %s: expected %d, got %d %s", tc.method, tc.path, tc.status, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestDbHandler_CanceledRequest(t *testing.T) {
+	db, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := newDbHandler(db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/db/key", strings.NewReader(`{"value":"a"}`)),
+		httptest.NewRequest(http.MethodGet, "/db/key", nil),
+		httptest.NewRequest(http.MethodPost, "/db/_tx", strings.NewReader(`{"writes":[{"key":"key","value":"a"}]}`)),
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req.WithContext(ctx))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s: expected 503, got %d %s", req.Method, req.URL.Path, rec.Code, rec.Body)
+		}
+	}
+	if _, err := db.Get("key"); err != datastore.ErrNotFound {
+		t.Errorf("A canceled request stored its write: %v", err)
+	}
+}
+
+func TestWriteUnavailable(t *testing.T) {
+	for _, tc := range []struct {
+		err        error
+		handled    bool
+		retryAfter string
+	}{
+		{fmt.Errorf("loaded 3 records before failing: %w", datastore.ErrBusy), true, "1"},
+		{datastore.ErrClosed, true, ""},
+		{context.DeadlineExceeded, true, ""},
+		{datastore.ErrNotFound, false, ""},
+	} {
+		rec := httptest.NewRecorder()
+		if handled := writeUnavailable(rec, tc.err); handled != tc.handled {
+			t.Errorf("%v: handled = %v", tc.err, handled)
+			continue
+		}
+		if tc.handled && rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%v: expected 503, got %d", tc.err, rec.Code)
+		}
+		if got := rec.Header().Get("Retry-After"); got != tc.retryAfter {
+			t.Errorf("%v: Retry-After = %q, expected %q", tc.err, got, tc.retryAfter)
+		}
+	}
+}
+
+func TestHandleLoad_Status(t *testing.T) {
+	dir := t.TempDir()
+	db, err := datastore.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	readOnly, err := datastore.OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnly.Close()
+
+	for _, tc := range []struct {
+		db     datastore.Engine
+		body   string
+		status int
+	}{
+		{db, `{"key":"a","type":"string","value":"1"}` + "\n", http.StatusOK},
+		{db, "{not json\n", http.StatusBadRequest},
+		{db, `{"key":"a","type":"float","value":1}` + "\n", http.StatusBadRequest},
+		{db, `{"key":"","type":"string","value":"1"}` + "\n", http.StatusBadRequest},
+		{db, `{"key":"` + strings.Repeat("k", 5000) + `","type":"string","value":"1"}` + "\n", http.StatusRequestEntityTooLarge},
+		// Failing to store valid records is not the client's fault
+		{readOnly, `{"key":"a","type":"string","value":"1"}` + "\n", http.StatusInternalServerError},
+	} {
+		rec := httptest.NewRecorder()
+		handleLoad(tc.db, rec, httptest.NewRequest(http.MethodPost, "/db/_load", strings.NewReader(tc.body)))
+		if rec.Code != tc.status {
+			t.Errorf("%.40q: expected %d, got %d %s", tc.body, tc.status, rec.Code, rec.Body)
+		}
+	}
+}
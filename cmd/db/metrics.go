@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sifes/architecture-practice-5/datastore"
+)
+
+// metricsContentType is the media type of the Prometheus text exposition
+// format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// latencyBuckets are the upper bounds of the request latency histogram in
+// seconds, the Prometheus client defaults.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestLabels struct {
+	op   string
+	code int
+}
+
+// histogram counts observations per bucket; counts are not cumulative
+// until written out.
+type histogram struct {
+	counts []uint64 // per bucket of latencyBuckets, then +Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// metrics records the requests served and exposes them together with the
+// statistics of the open databases.
+type metrics struct {
+	mu       sync.Mutex
+	requests map[requestLabels]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{requests: make(map[requestLabels]*histogram)}
+}
+
+func (m *metrics) observe(op string, code int, elapsed time.Duration) {
+	labels := requestLabels{op: op, code: code}
+	m.mu.Lock()
+	h, ok := m.requests[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.requests[labels] = h
+	}
+	h.observe(elapsed.Seconds())
+	m.mu.Unlock()
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument counts the requests next serves and their latency by
+// operation and status code.
+func (m *metrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: rw}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		m.observe(operationOf(r), rec.status, time.Since(start))
+	})
+}
+
+// operationOf names the operation a request asks for. Keys and database
+// names are left out to keep the number of series bounded.
+func operationOf(r *http.Request) string {
+	path := r.URL.Path
+	if rest, ok := strings.CutPrefix(path, "/dbs/"); ok {
+		// /dbs/<name>/<route> serves /db/<route>
+		_, route, _ := strings.Cut(rest, "/")
+		path = "/db/" + route
+	}
+
+	switch {
+	case path == "/admin/databases" || strings.HasPrefix(path, "/admin/databases/"):
+		switch r.Method {
+		case http.MethodPut:
+			return "create_database"
+		case http.MethodDelete:
+			return "drop_database"
+		}
+		return "list_databases"
+	case path == "/admin/stats" || strings.HasPrefix(path, "/admin/stats/"):
+		return "stats"
+	case path == "/db/_tx":
+		return "tx"
+	case path == "/db/_dump":
+		return "dump"
+	case path == "/db/_load":
+		return "load"
+	case path == "/db/_buckets":
+		return "buckets"
+	case strings.HasPrefix(path, "/db/_index/"):
+		return "index_lookup"
+	case strings.HasPrefix(path, "/db/"):
+		prefix := ""
+		if strings.Contains(strings.TrimPrefix(path, "/db/"), "/") {
+			prefix = "bucket_"
+		}
+		switch r.Method {
+		case http.MethodGet:
+			return prefix + "get"
+		case http.MethodPost:
+			return prefix + "put"
+		case http.MethodDelete:
+			return prefix + "drop"
+		}
+	}
+	return "other"
+}
+
+// dbSource calls fn for every open database. name is empty in single
+// database mode.
+type dbSource func(fn func(name string, db datastore.Engine))
+
+type namedCounters struct {
+	name     string
+	counters datastore.Counters
+}
+
+// Handler serves GET /metrics in the Prometheus text exposition format.
+// Storage metrics cover the databases that are open.
+func (m *metrics) Handler(source dbSource) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var dbs []namedCounters
+		source(func(name string, db datastore.Engine) {
+			if counters, err := db.Counters(); err == nil {
+				dbs = append(dbs, namedCounters{name: name, counters: counters})
+			}
+		})
+		sort.Slice(dbs, func(i, j int) bool { return dbs[i].name < dbs[j].name })
+
+		rw.Header().Set("Content-Type", metricsContentType)
+		w := bufio.NewWriter(rw)
+		m.writeRequests(w)
+		writeStorage(w, dbs)
+		w.Flush()
+	})
+}
+
+func (m *metrics) writeRequests(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := make([]requestLabels, 0, len(m.requests))
+	for l := range m.requests {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].op != labels[j].op {
+			return labels[i].op < labels[j].op
+		}
+		return labels[i].code < labels[j].code
+	})
+
+	writeHeader(w, "kvdb_http_requests_total", "counter", "HTTP requests served by operation and status code.")
+	for _, l := range labels {
+		fmt.Fprintf(w, "kvdb_http_requests_total{op=%q,code=\"%d\"} %d\n", l.op, l.code, m.requests[l].count)
+	}
+
+	writeHeader(w, "kvdb_http_request_duration_seconds", "histogram", "HTTP request latency by operation and status code.")
+	for _, l := range labels {
+		h := m.requests[l]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "kvdb_http_request_duration_seconds_bucket{op=%q,code=\"%d\",le=\"%s\"} %d\n",
+				l.op, l.code, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "kvdb_http_request_duration_seconds_bucket{op=%q,code=\"%d\",le=\"+Inf\"} %d\n", l.op, l.code, h.count)
+		fmt.Fprintf(w, "kvdb_http_request_duration_seconds_sum{op=%q,code=\"%d\"} %s\n", l.op, l.code, formatFloat(h.sum))
+		fmt.Fprintf(w, "kvdb_http_request_duration_seconds_count{op=%q,code=\"%d\"} %d\n", l.op, l.code, h.count)
+	}
+}
+
+// storageMetrics are the per database metrics taken from
+// datastore.Counters, which unlike datastore.Stats do not walk the index.
+var storageMetrics = []struct {
+	name, kind, help string
+	value            func(c datastore.Counters) float64
+}{
+	{"kvdb_keys", "gauge", "Keys in the index.", func(c datastore.Counters) float64 {
+		return float64(c.Keys)
+	}},
+	{"kvdb_segments", "gauge", "Segment files, the active one included.", func(c datastore.Counters) float64 {
+		return float64(c.Segments)
+	}},
+	{"kvdb_disk_bytes", "gauge", "Bytes of the segment files on local disk.", func(c datastore.Counters) float64 {
+		return float64(c.DiskBytes)
+	}},
+	{"kvdb_remote_bytes", "gauge", "Bytes of the segments offloaded to the object store.", func(c datastore.Counters) float64 {
+		return float64(c.RemoteBytes)
+	}},
+	{"kvdb_live_bytes", "gauge", "Bytes of records holding the latest value of a key.", func(c datastore.Counters) float64 {
+		return float64(c.LiveBytes)
+	}},
+	{"kvdb_dead_bytes", "gauge", "Bytes of overwritten and dropped records.", func(c datastore.Counters) float64 {
+		return float64(c.DeadBytes)
+	}},
+	{"kvdb_write_queue_depth", "gauge", "Write requests waiting for the writer.", func(c datastore.Counters) float64 {
+		return float64(c.QueueDepth)
+	}},
+	{"kvdb_write_queue_capacity", "gauge", "Write requests the queue holds.", func(c datastore.Counters) float64 {
+		return float64(c.QueueCapacity)
+	}},
+	{"kvdb_write_stalls_total", "counter", "Writes that found the write queue full.", func(c datastore.Counters) float64 {
+		return float64(c.WriteStalls)
+	}},
+	{"kvdb_writes_rejected_total", "counter", "Writes refused because the write queue was full.", func(c datastore.Counters) float64 {
+		return float64(c.WritesRejected)
+	}},
+	{"kvdb_index_bytes", "gauge", "Estimated memory held by the index.", func(c datastore.Counters) float64 {
+		return float64(c.IndexBytes)
+	}},
+	{"kvdb_index_disk_bytes", "gauge", "Bytes of the index files kept on disk.", func(c datastore.Counters) float64 {
+		return float64(c.IndexDiskBytes)
+	}},
+	{"kvdb_last_merge_duration_seconds", "gauge", "Duration of the last merge.", func(c datastore.Counters) float64 {
+		return c.LastMergeDuration.Seconds()
+	}},
+	{"kvdb_last_merge_failed", "gauge", "Whether the last merge failed.", func(c datastore.Counters) float64 {
+		if c.LastMergeError != nil {
+			return 1
+		}
+		return 0
+	}},
+}
+
+func writeStorage(w *bufio.Writer, dbs []namedCounters) {
+	for _, metric := range storageMetrics {
+		writeHeader(w, metric.name, metric.kind, metric.help)
+		for _, db := range dbs {
+			fmt.Fprintf(w, "%s%s %s\n", metric.name, dbLabel(db.name), formatFloat(metric.value(db.counters)))
+		}
+	}
+
+	// Merges since open as a summary without quantiles
+	writeHeader(w, "kvdb_merge_duration_seconds", "summary", "Time spent merging segments.")
+	for _, db := range dbs {
+		fmt.Fprintf(w, "kvdb_merge_duration_seconds_sum%s %s\n", dbLabel(db.name), formatFloat(db.counters.TotalMergeTime.Seconds()))
+		fmt.Fprintf(w, "kvdb_merge_duration_seconds_count%s %d\n", dbLabel(db.name), db.counters.Merges)
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// dbLabel returns the label set naming a database, empty in single
+// database mode.
+func dbLabel(name string) string {
+	if name == "" {
+		return ""
+	}
+	return fmt.Sprintf("{db=%q}", name)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
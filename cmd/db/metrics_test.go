@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sifes/architecture-practice-5/datastore"
+)
+
+func TestMetrics_SingleDatabase(t *testing.T) {
+	db, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	m := newMetrics()
+	h := m.instrument(newDbHandler(db))
+	do := func(method, path, body string) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, path, strings.NewReader(body)))
+	}
+	do(http.MethodPost, "/db/alpha", `{"value":"a"}`)
+	do(http.MethodPost, "/db/beta", `{"value":"b"}`)
+	do(http.MethodGet, "/db/alpha", "")
+	do(http.MethodGet, "/db/missing", "")
+	do(http.MethodGet, "/db/bucket/key", "")
+
+	rec := httptest.NewRecorder()
+	m.Handler(func(fn func(string, datastore.Engine)) { fn("", db) }).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+
+	body := rec.Body.String()
+	for _, line := range []string{
+		`kvdb_http_requests_total{op="put",code="200"} 2`,
+		`kvdb_http_requests_total{op="get",code="200"} 1`,
+		`kvdb_http_requests_total{op="get",code="404"} 1`,
+		`kvdb_http_requests_total{op="bucket_get",code="404"} 1`,
+		`kvdb_http_request_duration_seconds_bucket{op="put",code="200",le="+Inf"} 2`,
+		`kvdb_http_request_duration_seconds_count{op="put",code="200"} 2`,
+		"# TYPE kvdb_http_request_duration_seconds histogram",
+		"kvdb_keys 2",
+		"kvdb_segments 1",
+		"kvdb_write_queue_depth 0",
+		"kvdb_merge_duration_seconds_count 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Missing %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetrics_LSM(t *testing.T) {
+	db, err := datastore.OpenLSM(t.TempDir(), datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Put("alpha", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	newMetrics().Handler(func(fn func(string, datastore.Engine)) { fn("", db) }).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{"kvdb_keys 1", "kvdb_segments 1"} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Missing %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetrics_Registry(t *testing.T) {
+	reg, err := newRegistry(t.TempDir(), "", 4, datastore.EngineHash, datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	m := newMetrics()
+	h := m.instrument(reg.Handler())
+	do := func(method, path, body string) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, path, strings.NewReader(body)))
+	}
+	do(http.MethodPut, "/admin/databases/team-a", "")
+	do(http.MethodPut, "/admin/databases/team-b", "")
+	do(http.MethodPost, "/dbs/team-a/key", `{"value":"a"}`)
+
+	rec := httptest.NewRecorder()
+	m.Handler(reg.forEachOpen).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		`kvdb_http_requests_total{op="create_database",code="201"} 2`,
+		`kvdb_http_requests_total{op="put",code="200"} 1`,
+		`kvdb_keys{db="team-a"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Missing %q in:\n%s", line, body)
+		}
+	}
+	// Databases that are not open are not opened for metrics
+	if strings.Contains(body, `db="team-b"`) {
+		t.Errorf("Metrics opened team-b:\n%s", body)
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sifes/architecture-practice-5/datastore"
+)
+
+var (
+	errInvalidName      = errors.New("database names may only contain letters, digits, '-' and '_'")
+	errDatabaseNotFound = errors.New("database does not exist")
+	errDatabaseExists   = errors.New("database already exists")
+)
+
+var databaseName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// registry hosts one database per subdirectory of a root directory. Databases
+// are opened on first use and the least recently used idle ones are closed
+// once more than maxOpen are open, bounding the number of file descriptors.
+// Databases in use are never closed, so the limit may be exceeded while
+// requests are in flight.
+type registry struct {
+	root    string
+	maxOpen int
+	engine  string
+	opts    datastore.Options
+
+	// Databases offload cold segments to a subdirectory of objectRoot
+	// named after them, if set
+	objectRoot string
+
+	mu   sync.Mutex
+	open map[string]*openDb
+	lru  *list.List // of *openDb, most recently used first
+}
+
+type openDb struct {
+	name    string
+	db      datastore.Engine
+	handler http.Handler
+	err     error
+	opened  chan struct{} // closed once db or err is set
+	closed  chan struct{} // closed once db is closed, if closing
+
+	// Guarded by registry.mu
+	refs     int
+	closing  bool       // being closed; a new instance must wait for closed
+	dropping bool       // being dropped; requests see it as gone
+	idle     *sync.Cond // signalled when refs drops to zero
+	elem     *list.Element
+}
+
+func newRegistry(root, objectRoot string, maxOpen int, engine string, opts datastore.Options) (*registry, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	if maxOpen < 1 {
+		maxOpen = 1
+	}
+	return &registry{
+		root:       root,
+		maxOpen:    maxOpen,
+		engine:     engine,
+		opts:       opts,
+		objectRoot: objectRoot,
+		open:       make(map[string]*openDb),
+		lru:        list.New(),
+	}, nil
+}
+
+// List returns the names of all databases, sorted.
+func (reg *registry) List() ([]string, error) {
+	entries, err := os.ReadDir(reg.root)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && databaseName.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Create makes a new empty database.
+func (reg *registry) Create(name string) error {
+	if !databaseName.MatchString(name) {
+		return errInvalidName
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	// A database being dropped still owns its directory
+	if od, ok := reg.open[name]; ok && od.dropping {
+		return errDatabaseExists
+	}
+
+	err := os.Mkdir(filepath.Join(reg.root, name), 0755)
+	if os.IsExist(err) {
+		return errDatabaseExists
+	}
+	return err
+}
+
+// Drop waits for in-flight requests to the database to finish, closes it
+// and deletes its data.
+func (reg *registry) Drop(name string) error {
+	if !databaseName.MatchString(name) {
+		return errInvalidName
+	}
+
+	reg.mu.Lock()
+	od, err := reg.lookup(name)
+	if err != nil {
+		reg.mu.Unlock()
+		return err
+	}
+	if od == nil {
+		// Not open: keep a placeholder so nobody opens it meanwhile
+		od = reg.newOpenDb(name)
+		close(od.opened)
+		od.refs = 0
+		reg.open[name] = od
+	}
+	// New requests see the database as gone from now on
+	od.dropping = true
+	for od.refs > 0 {
+		od.idle.Wait()
+	}
+	reg.evict(od)
+	reg.mu.Unlock()
+
+	if od.db != nil {
+		if err := od.db.Close(); err != nil {
+			log.Printf("Failed to close database %s: %v", name, err)
+		}
+	}
+
+	dir := filepath.Join(reg.root, name)
+	if _, err = os.Stat(dir); err == nil {
+		err = os.RemoveAll(dir)
+	} else if os.IsNotExist(err) {
+		err = errDatabaseNotFound
+	}
+	if err == nil && reg.objectRoot != "" {
+		err = os.RemoveAll(filepath.Join(reg.objectRoot, name))
+	}
+
+	reg.mu.Lock()
+	delete(reg.open, name)
+	reg.mu.Unlock()
+	return err
+}
+
+// Acquire returns the open database with the given name, opening it if
+// needed. The caller must call Release when done with it.
+func (reg *registry) Acquire(name string) (*openDb, error) {
+	if !databaseName.MatchString(name) {
+		return nil, errInvalidName
+	}
+
+	reg.mu.Lock()
+	od, err := reg.lookup(name)
+	if err != nil {
+		reg.mu.Unlock()
+		return nil, err
+	}
+	if od != nil {
+		od.refs++
+		reg.touch(od)
+		reg.mu.Unlock()
+
+		<-od.opened
+		if od.err != nil {
+			reg.Release(od)
+			return nil, od.err
+		}
+		return od, nil
+	}
+
+	dir := filepath.Join(reg.root, name)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		reg.mu.Unlock()
+		return nil, errDatabaseNotFound
+	}
+
+	// Open outside the lock: rebuilding the index of a large database must
+	// not hold up requests to the others
+	od = reg.newOpenDb(name)
+	reg.open[name] = od
+	reg.touch(od)
+	reg.mu.Unlock()
+
+	opts := reg.opts
+	if reg.objectRoot != "" {
+		opts.ObjectStore, od.err = datastore.NewDirObjectStore(filepath.Join(reg.objectRoot, name))
+	}
+	if od.err == nil {
+		od.db, od.err = datastore.OpenEngine(reg.engine, dir, opts)
+	}
+	if od.err == nil {
+		od.handler = newDbHandler(od.db)
+	}
+	close(od.opened)
+
+	if od.err != nil {
+		reg.mu.Lock()
+		reg.evict(od)
+		if reg.open[name] == od {
+			delete(reg.open, name)
+		}
+		reg.mu.Unlock()
+		reg.Release(od)
+		return nil, od.err
+	}
+
+	reg.closeIdle()
+	return od, nil
+}
+
+// lookup returns the usable open instance of a database, or nil if it has
+// to be opened. It waits for an instance being closed to finish so that two
+// instances never share a directory. The caller must hold mu.
+func (reg *registry) lookup(name string) (*openDb, error) {
+	for {
+		od, ok := reg.open[name]
+		switch {
+		case !ok:
+			return nil, nil
+		case od.dropping:
+			return nil, errDatabaseNotFound
+		case od.closing:
+			reg.mu.Unlock()
+			<-od.closed
+			reg.mu.Lock()
+		default:
+			return od, nil
+		}
+	}
+}
+
+func (reg *registry) newOpenDb(name string) *openDb {
+	return &openDb{
+		name:   name,
+		opened: make(chan struct{}),
+		closed: make(chan struct{}),
+		refs:   1,
+		idle:   sync.NewCond(&reg.mu),
+	}
+}
+
+// Release hands back a database returned by Acquire.
+func (reg *registry) Release(od *openDb) {
+	reg.mu.Lock()
+	od.refs--
+	if od.refs == 0 {
+		od.idle.Broadcast()
+	}
+	reg.mu.Unlock()
+
+	reg.closeIdle()
+}
+
+// touch marks od as the most recently used database. The caller must hold mu.
+func (reg *registry) touch(od *openDb) {
+	if od.elem != nil {
+		reg.lru.MoveToFront(od.elem)
+		return
+	}
+	od.elem = reg.lru.PushFront(od)
+}
+
+// evict takes od out of the LRU list. The caller must hold mu.
+func (reg *registry) evict(od *openDb) {
+	if od.elem != nil {
+		reg.lru.Remove(od.elem)
+		od.elem = nil
+	}
+}
+
+// closeIdle closes the least recently used idle databases while more than
+// maxOpen are open.
+func (reg *registry) closeIdle() {
+	var victims []*openDb
+
+	reg.mu.Lock()
+	for e := reg.lru.Back(); e != nil && reg.lru.Len() > reg.maxOpen; {
+		od := e.Value.(*openDb)
+		e = e.Prev()
+		if od.refs > 0 || od.dropping {
+			continue
+		}
+		reg.evict(od)
+		od.closing = true
+		victims = append(victims, od)
+	}
+	reg.mu.Unlock()
+
+	for _, od := range victims {
+		if err := od.db.Close(); err != nil {
+			log.Printf("Failed to close database %s: %v", od.name, err)
+		}
+
+		reg.mu.Lock()
+		if reg.open[od.name] == od {
+			delete(reg.open, od.name)
+		}
+		reg.mu.Unlock()
+		close(od.closed)
+	}
+}
+
+// forEachOpen calls fn for every database that is open, without opening
+// any or changing which are closed first. The databases stay open until fn
+// returns.
+func (reg *registry) forEachOpen(fn func(name string, db datastore.Engine)) {
+	reg.mu.Lock()
+	var held []*openDb
+	for _, od := range reg.open {
+		if od.closing || od.dropping {
+			continue
+		}
+		select {
+		case <-od.opened:
+			if od.db != nil {
+				od.refs++
+				held = append(held, od)
+			}
+		default:
+			// Still opening
+		}
+	}
+	reg.mu.Unlock()
+
+	for _, od := range held {
+		fn(od.name, od.db)
+		reg.Release(od)
+	}
+}
+
+// Close closes every open database. It must not be called while requests
+// are being served.
+func (reg *registry) Close() error {
+	reg.mu.Lock()
+	var dbs []*openDb
+	for _, od := range reg.open {
+		// Databases being closed or dropped are closed by their owner
+		if !od.closing && !od.dropping {
+			dbs = append(dbs, od)
+		}
+	}
+	reg.open = make(map[string]*openDb)
+	reg.lru.Init()
+	reg.mu.Unlock()
+
+	var firstErr error
+	for _, od := range dbs {
+		<-od.opened
+		if od.db == nil {
+			continue
+		}
+		if err := od.db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Handler serves the admin API under /admin/databases, the statistics of
+// each database at /admin/stats/<name> and the routes of each database under
+// /dbs/<name>/, which map to the /db/ routes of single database mode.
+func (reg *registry) Handler() http.Handler {
+	h := new(http.ServeMux)
+
+	// GET /admin/databases
+	h.HandleFunc("/admin/databases", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		names, err := reg.List()
+		if err != nil {
+			http.Error(rw, "Failed to list databases", http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(names)
+	})
+
+	// PUT /admin/databases/<name>, DELETE /admin/databases/<name>
+	h.HandleFunc("/admin/databases/", func(rw http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/admin/databases/")
+
+		var err error
+		switch r.Method {
+		case http.MethodPut:
+			err = reg.Create(name)
+		case http.MethodDelete:
+			err = reg.Drop(name)
+		default:
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			writeRegistryError(rw, err)
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			rw.WriteHeader(http.StatusCreated)
+		}
+		fmt.Fprint(rw, "OK")
+	})
+
+	// GET /admin/stats/<name>
+	h.HandleFunc("/admin/stats/", func(rw http.ResponseWriter, r *http.Request) {
+		od, err := reg.Acquire(strings.TrimPrefix(r.URL.Path, "/admin/stats/"))
+		if err != nil {
+			writeRegistryError(rw, err)
+			return
+		}
+		defer reg.Release(od)
+		handleStats(od.db, rw, r)
+	})
+
+	// /dbs/<name>/<key> and the other /db/ routes
+	h.HandleFunc("/dbs/", func(rw http.ResponseWriter, r *http.Request) {
+		name, rest, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/dbs/"), "/")
+		if !ok {
+			http.NotFound(rw, r)
+			return
+		}
+
+		od, err := reg.Acquire(name)
+		if err != nil {
+			writeRegistryError(rw, err)
+			return
+		}
+		defer reg.Release(od)
+
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = "/db/" + rest
+		r2.URL.RawPath = ""
+		od.handler.ServeHTTP(rw, r2)
+	})
+
+	return h
+}
+
+func writeRegistryError(rw http.ResponseWriter, err error) {
+	switch err {
+	case errInvalidName:
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	case errDatabaseNotFound:
+		http.Error(rw, "Database not found", http.StatusNotFound)
+	case errDatabaseExists:
+		http.Error(rw, "Database already exists", http.StatusConflict)
+	default:
+		http.Error(rw, "Database unavailable", http.StatusInternalServerError)
+	}
+}
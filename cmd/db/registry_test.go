@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sifes/architecture-practice-5/datastore"
+)
+
+func TestRegistry_LazyOpenAndLimit(t *testing.T) {
+	reg, err := newRegistry(t.TempDir(), "", 2, datastore.EngineHash, datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	for _, name := range []string{"alpha", "beta", "gamma"} {
+		if err := reg.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reg.Create("alpha"); err != errDatabaseExists {
+		t.Errorf("Expected errDatabaseExists, got %v", err)
+	}
+	if err := reg.Create("../escape"); err != errInvalidName {
+		t.Errorf("Expected errInvalidName, got %v", err)
+	}
+	if names, _ := reg.List(); !reflect.DeepEqual(names, []string{"alpha", "beta", "gamma"}) {
+		t.Errorf("List() = %v", names)
+	}
+	if len(reg.open) != 0 {
+		t.Errorf("Databases opened before use: %d", len(reg.open))
+	}
+
+	// Each database keeps its own data
+	for _, name := range []string{"alpha", "beta", "gamma"} {
+		od, err := reg.Acquire(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := od.db.Put("owner", name); err != nil {
+			t.Fatal(err)
+		}
+		reg.Release(od)
+	}
+
+	// Idle databases beyond the limit are closed, least recently used first
+	if _, ok := reg.open["alpha"]; ok || len(reg.open) != 2 {
+		t.Errorf("Expected beta and gamma to stay open, got %d open", len(reg.open))
+	}
+
+	// Databases in use are not closed even past the limit
+	held := make([]*openDb, 0, 3)
+	for _, name := range []string{"alpha", "beta", "gamma"} {
+		od, err := reg.Acquire(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, od)
+		if owner, _ := od.db.Get("owner"); owner != name {
+			t.Errorf("Database %s holds data of %q", name, owner)
+		}
+	}
+	if len(reg.open) != 3 {
+		t.Errorf("Expected all 3 databases open while in use, got %d", len(reg.open))
+	}
+	for _, od := range held {
+		reg.Release(od)
+	}
+	if len(reg.open) != 2 {
+		t.Errorf("Expected 2 databases open after release, got %d", len(reg.open))
+	}
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	reg, err := newRegistry(t.TempDir(), "", 4, datastore.EngineHash, datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	h := reg.Handler()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := do(http.MethodPut, "/admin/databases/team-a", ""); rec.Code != http.StatusCreated {
+		t.Fatalf("Create: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPost, "/dbs/team-a/key", `{"value":"a"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Put: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodGet, "/dbs/team-a/key", ""); !strings.Contains(rec.Body.String(), `"value":"a"`) {
+		t.Errorf("Get: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodGet, "/dbs/team-b/key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing database, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/admin/stats/team-a", ""); !strings.Contains(rec.Body.String(), `"keys":1,`) {
+		t.Errorf("Stats: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodGet, "/admin/stats/team-b", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for the stats of a missing database, got %d", rec.Code)
+	}
+
+	if rec := do(http.MethodDelete, "/admin/databases/team-a", ""); rec.Code != http.StatusOK {
+		t.Fatalf("Drop: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodGet, "/dbs/team-a/key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after drop, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/admin/databases/team-a", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 when dropping twice, got %d", rec.Code)
+	}
+
+	// A dropped database can be created again, empty
+	do(http.MethodPut, "/admin/databases/team-a", "")
+	if rec := do(http.MethodGet, "/dbs/team-a/key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Recreated database is not empty: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRegistry_LSMEngine(t *testing.T) {
+	reg, err := newRegistry(t.TempDir(), "", 4, datastore.EngineLSM, datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	h := reg.Handler()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	do(http.MethodPut, "/admin/databases/lsm", "")
+	if rec := do(http.MethodPost, "/dbs/lsm/key", `{"value":7}`); rec.Code != http.StatusOK {
+		t.Fatalf("Put: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodGet, "/dbs/lsm/key?type=int64", ""); !strings.Contains(rec.Body.String(), `"value":7`) {
+		t.Errorf("Get: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodGet, "/dbs/lsm/_dump", ""); !strings.Contains(rec.Body.String(), `"key":"key"`) {
+		t.Errorf("Dump: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodGet, "/admin/stats/lsm", ""); !strings.Contains(rec.Body.String(), `"keys":1`) {
+		t.Errorf("Stats: %d %s", rec.Code, rec.Body)
+	}
+
+	// Features of the hash engine only
+	for _, path := range []string{"/dbs/lsm/key?history=true", "/dbs/lsm/bucket/key", "/dbs/lsm/_buckets"} {
+		if rec := do(http.MethodGet, path, ""); rec.Code != http.StatusNotImplemented {
+			t.Errorf("GET %s: expected 501, got %d", path, rec.Code)
+		}
+	}
+	if rec := do(http.MethodPost, "/dbs/lsm/_tx", `{"writes":[]}`); rec.Code != http.StatusNotImplemented {
+		t.Errorf("Tx: expected 501, got %d", rec.Code)
+	}
+}
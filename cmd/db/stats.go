@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/sifes/architecture-practice-5/datastore"
+)
+
+// statsResponse is the JSON form of datastore.Stats. Durations are in
+// milliseconds.
+type statsResponse struct {
+	Keys         int                    `json:"keys"`
+	Segments     []segmentStatsResponse `json:"segments"`
+	ActiveOffset int64                  `json:"active_offset"`
+
+	Merges              int     `json:"merges"`
+	LastMergeDurationMs float64 `json:"last_merge_duration_ms"`
+	TotalMergeTimeMs    float64 `json:"total_merge_time_ms"`
+	LastMergeError      string  `json:"last_merge_error,omitempty"`
+
+	Offloads         int    `json:"offloads"`
+	LastOffloadError string `json:"last_offload_error,omitempty"`
+
+	QueueDepth     int   `json:"queue_depth"`
+	QueueCapacity  int   `json:"queue_capacity"`
+	WriteStalls    int64 `json:"write_stalls"`
+	WritesRejected int64 `json:"writes_rejected"`
+
+	IndexBytes     int64 `json:"index_bytes"`
+	IndexDiskBytes int64 `json:"index_disk_bytes"`
+}
+
+type segmentStatsResponse struct {
+	ID        int   `json:"id"`
+	Active    bool  `json:"active"`
+	Remote    bool  `json:"remote"`
+	Size      int64 `json:"size"`
+	LiveBytes int64 `json:"live_bytes"`
+	DeadBytes int64 `json:"dead_bytes"`
+}
+
+func newStatsResponse(stats datastore.Stats) statsResponse {
+	resp := statsResponse{
+		Keys:                stats.Keys,
+		Segments:            make([]segmentStatsResponse, len(stats.Segments)),
+		ActiveOffset:        stats.ActiveOffset,
+		Merges:              stats.Merges,
+		LastMergeDurationMs: float64(stats.LastMergeDuration.Microseconds()) / 1000,
+		TotalMergeTimeMs:    float64(stats.TotalMergeTime.Microseconds()) / 1000,
+		Offloads:            stats.Offloads,
+		QueueDepth:          stats.QueueDepth,
+		QueueCapacity:       stats.QueueCapacity,
+		WriteStalls:         stats.WriteStalls,
+		WritesRejected:      stats.WritesRejected,
+		IndexBytes:          stats.IndexBytes,
+		IndexDiskBytes:      stats.IndexDiskBytes,
+	}
+	if stats.LastMergeError != nil {
+		resp.LastMergeError = stats.LastMergeError.Error()
+	}
+	if stats.LastOffloadError != nil {
+		resp.LastOffloadError = stats.LastOffloadError.Error()
+	}
+	for i, segment := range stats.Segments {
+		resp.Segments[i] = segmentStatsResponse(segment)
+	}
+	return resp
+}
+
+// handleStats serves GET /admin/stats.
+func handleStats(db datastore.Engine, rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := db.Stats()
+	if err != nil {
+		log.Printf("Failed to collect statistics: %v", err)
+		http.Error(rw, "Failed to collect statistics", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(newStatsResponse(stats))
+}
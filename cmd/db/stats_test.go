@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/sifes/architecture-practice-5/datastore"
+)
+
+func TestHandleStats(t *testing.T) {
+	// A few records fill a segment, and the segments are too few for a
+	// merge to change the statistics under the test
+	db, err := datastore.OpenWithOptions(t.TempDir(), datastore.Options{MaxSegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"k1", "k2", "k1", "k3", "k2"} {
+		if _, err := db.Put(key, "value of "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleStats(db, rec, httptest.NewRequest(http.MethodGet, "/admin/stats", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Stats: %d %q %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	var response statsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := newStatsResponse(stats); !reflect.DeepEqual(response, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, response)
+	}
+	last := len(response.Segments) - 1
+	if response.Keys != 3 || last < 1 {
+		t.Fatalf("Expected 3 keys in several segments, got %+v", response)
+	}
+	for i, segment := range response.Segments {
+		if segment.Active != (i == last) || segment.LiveBytes == 0 {
+			t.Errorf("Segment %d: %+v", i, segment)
+		}
+	}
+	if response.ActiveOffset != response.Segments[last].Size || response.Segments[0].DeadBytes == 0 {
+		t.Errorf("Unexpected sizes: %+v", response)
+	}
+
+	rec = httptest.NewRecorder()
+	handleStats(db, rec, httptest.NewRequest(http.MethodPost, "/admin/stats", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: expected 405, got %d", rec.Code)
+	}
+
+	lsm, err := datastore.OpenLSM(t.TempDir(), datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	if _, err := lsm.Put("k1", "value"); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	handleStats(lsm, rec, httptest.NewRequest(http.MethodGet, "/admin/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("LSM: expected 200, got %d %s", rec.Code, rec.Body)
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Keys != 1 || len(response.Segments) != 1 || !response.Segments[0].Active {
+		t.Errorf("LSM: unexpected statistics %+v", response)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/sifes/architecture-practice-5/datastore"
+)
+
+// txRequest is a transactional batch: the writes are applied atomically if
+// every condition holds.
+type txRequest struct {
+	Conditions []txCondition `json:"conditions"`
+	Writes     []txWrite     `json:"writes"`
+}
+
+// txCondition requires a key to hold the given value, or to be missing
+// when Absent is set.
+type txCondition struct {
+	Key    string      `json:"key"`
+	Value  interface{} `json:"value"`
+	Absent bool        `json:"absent"`
+}
+
+type txWrite struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+var errPreconditionFailed = errors.New("precondition failed")
+
+// updater runs transactions, as datastore.Db does.
+type updater interface {
+	UpdateContext(ctx context.Context, fn func(tx *datastore.Tx) error) error
+}
+
+func handleTx(db updater, rw http.ResponseWriter, r *http.Request) {
+	var req txRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	for _, w := range req.Writes {
+		if w.Key == "" {
+			http.Error(rw, "Key is required", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var committed *datastore.Tx
+	err := db.UpdateContext(r.Context(), func(tx *datastore.Tx) error {
+		committed = tx
+		for _, c := range req.Conditions {
+			if err := checkCondition(tx, c); err != nil {
+				return err
+			}
+		}
+		for _, w := range req.Writes {
+			switch v := w.Value.(type) {
+			case string:
+				tx.Put(w.Key, v)
+			case float64:
+				// JSON numbers are decoded as float64, convert to int64
+				tx.PutInt64(w.Key, int64(v))
+			default:
+				tx.Put(w.Key, fmt.Sprintf("%v", v))
+			}
+		}
+		return nil
+	})
+
+	switch {
+	case err == nil:
+		rw.Header().Set(seqHeader, strconv.FormatUint(committed.Seq(), 10))
+		rw.WriteHeader(http.StatusOK)
+		fmt.Fprint(rw, "OK")
+	case errors.Is(err, errPreconditionFailed):
+		http.Error(rw, err.Error(), http.StatusPreconditionFailed)
+	case errors.Is(err, datastore.ErrConflict):
+		http.Error(rw, "Transaction conflict", http.StatusConflict)
+	default:
+		if writeUnavailable(rw, err) {
+			return
+		}
+		if status, ok := invalidWriteStatus(err); ok {
+			http.Error(rw, err.Error(), status)
+			return
+		}
+		http.Error(rw, "Failed to commit transaction", http.StatusInternalServerError)
+	}
+}
+
+func checkCondition(tx *datastore.Tx, c txCondition) error {
+	var matches bool
+	var err error
+
+	switch v := c.Value.(type) {
+	case nil:
+		_, err = tx.Get(c.Key)
+		if err == datastore.ErrTypeMismatch {
+			err = nil
+		}
+		matches = c.Absent == (err == datastore.ErrNotFound)
+	case float64:
+		var current int64
+		current, err = tx.GetInt64(c.Key)
+		matches = err == nil && current == int64(v) && !c.Absent
+	default:
+		var current string
+		current, err = tx.Get(c.Key)
+		matches = err == nil && current == fmt.Sprintf("%v", v) && !c.Absent
+	}
+
+	if err != nil && err != datastore.ErrNotFound && err != datastore.ErrTypeMismatch {
+		return err
+	}
+	if !matches {
+		return fmt.Errorf("%w: %s", errPreconditionFailed, c.Key)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sifes/architecture-practice-5/datastore"
+)
+
+func TestHandleTx(t *testing.T) {
+	db, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"conditions":[{"key":"a","absent":true}],"writes":[{"key":"a","value":"1"},{"key":"n","value":5}]}`, http.StatusOK},
+		{`{"conditions":[{"key":"a","absent":true}],"writes":[{"key":"a","value":"2"}]}`, http.StatusPreconditionFailed},
+		{`{"conditions":[{"key":"a","value":"1"},{"key":"n","value":5}],"writes":[{"key":"a","value":"3"}]}`, http.StatusOK},
+		{`{"conditions":[{"key":"n","value":6}],"writes":[{"key":"a","value":"4"}]}`, http.StatusPreconditionFailed},
+		{`{"conditions":[{"key":"n"}],"writes":[{"key":"","value":"5"}]}`, http.StatusBadRequest},
+		{`{"writes":`, http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		handleTx(db, rec, httptest.NewRequest(http.MethodPost, "/db/_tx", strings.NewReader(tc.body)))
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d %s", tc.body, tc.status, rec.Code, rec.Body)
+		}
+		if tc.status == http.StatusOK && rec.Header().Get(seqHeader) == "" {
+			t.Errorf("%s: expected a %s header", tc.body, seqHeader)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleTx(db, rec, httptest.NewRequest(http.MethodPost, "/db/_tx", strings.NewReader(`{"writes":[{"key":"a","value":"3"}]}`)))
+	history, err := db.History("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq := rec.Header().Get(seqHeader); seq != strconv.FormatUint(history[len(history)-1].Seq, 10) {
+		t.Errorf("Expected the commit's sequence number, got %q", seq)
+	}
+
+	if value, err := db.Get("a"); err != nil || value != "3" {
+		t.Errorf("Expected a = 3, got %q, %v", value, err)
+	}
+	if value, err := db.GetInt64("n"); err != nil || value != 5 {
+		t.Errorf("Expected n = 5, got %d, %v", value, err)
+	}
+}
+
+// conflictingDb fails every transaction the way a database does once its
+// keys kept being written under the transaction.
+type conflictingDb struct{}
+
+func (conflictingDb) UpdateContext(ctx context.Context, fn func(tx *datastore.Tx) error) error {
+	return datastore.ErrConflict
+}
+
+func TestHandleTx_Conflict(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleTx(conflictingDb{}, rec, httptest.NewRequest(http.MethodPost, "/db/_tx", strings.NewReader(`{"writes":[{"key":"a","value":"1"}]}`)))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409, got %d %s", rec.Code, rec.Body)
+	}
+}
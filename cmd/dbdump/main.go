@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sifes/architecture-practice-5/datastore"
+)
+
+var (
+	dir        = flag.String("dir", "", "database directory to read from or load into")
+	addr       = flag.String("addr", "", "address of a running database server, e.g. http://localhost:8070")
+	out        = flag.String("out", "", "export destination file (default: stdout)")
+	importFile = flag.String("import", "", "JSON Lines file to load instead of exporting")
+
+	engine      = flag.String("engine", datastore.EngineHash, "storage engine of the -dir database: hash or lsm")
+	objectStore = flag.String("object-store", "", "directory standing in for the object store the -dir database offloads segments to, as given to the server")
+)
+
+const dumpContentType = "application/jsonl"
+
+var client = http.Client{
+	Timeout: 10 * time.Minute,
+}
+
+func main() {
+	flag.Parse()
+
+	if (*dir == "") == (*addr == "") {
+		log.Fatal("Exactly one of -dir and -addr is required")
+	}
+
+	var n int
+	var err error
+	if *importFile != "" {
+		n, err = runImport()
+		if err != nil {
+			log.Fatalf("Import failed after %d records: %v", n, err)
+		}
+		log.Printf("Imported %d records", n)
+		return
+	}
+
+	n, err = runExport()
+	if err != nil {
+		log.Fatalf("Export failed after %d records: %v", n, err)
+	}
+	log.Printf("Exported %d records", n)
+}
+
+func runExport() (int, error) {
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *dir != "" {
+		db, err := openDir(true)
+		if err != nil {
+			return 0, err
+		}
+		defer db.Close()
+		return db.Dump(w)
+	}
+
+	resp, err := client.Get(strings.TrimSuffix(*addr, "/") + "/db/_dump")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+
+	counter := &lineCounter{w: w}
+	_, err = io.Copy(counter, resp.Body)
+	return counter.lines, err
+}
+
+func runImport() (int, error) {
+	f, err := os.Open(*importFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if *dir != "" {
+		db, err := openDir(false)
+		if err != nil {
+			return 0, err
+		}
+		defer db.Close()
+		return db.Load(f)
+	}
+
+	resp, err := client.Post(strings.TrimSuffix(*addr, "/")+"/db/_load", dumpContentType, f)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("server returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var n int
+	fmt.Sscanf(string(body), "Loaded %d records", &n)
+	return n, nil
+}
+
+// openDir opens the -dir database with the -engine storage engine. Exports
+// of the hash engine open it read-only, so they can run next to the server;
+// the LSM engine has no read-only mode.
+func openDir(readOnly bool) (datastore.Engine, error) {
+	var opts datastore.Options
+	if *objectStore != "" {
+		store, err := datastore.NewDirObjectStore(*objectStore)
+		if err != nil {
+			return nil, err
+		}
+		opts.ObjectStore = store
+	}
+
+	if readOnly && (*engine == datastore.EngineHash || *engine == "") {
+		return datastore.OpenReadOnlyWithOptions(*dir, opts)
+	}
+	return datastore.OpenEngine(*engine, *dir, opts)
+}
+
+// lineCounter passes data through while counting exported records.
+type lineCounter struct {
+	w     io.Writer
+	lines int
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\n' {
+			c.lines++
+		}
+	}
+	return c.w.Write(p)
+}
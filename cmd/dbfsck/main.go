@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sifes/architecture-practice-5/datastore"
+)
+
+var (
+	dir     = flag.String("dir", "/opt/practice-4/data", "database directory to check")
+	salvage = flag.String("salvage", "", "copy all readable records into this new directory")
+)
+
+func main() {
+	flag.Parse()
+
+	report, err := datastore.Check(*dir)
+	if err != nil {
+		log.Fatalf("Failed to check %s: %v", *dir, err)
+	}
+	printReport(report)
+
+	if *salvage != "" {
+		n, err := datastore.Salvage(*dir, *salvage)
+		if err != nil {
+			log.Fatalf("Salvage failed after %d records: %v", n, err)
+		}
+		fmt.Printf("\nSalvaged %d records into %s\n", n, *salvage)
+	}
+
+	if report.Corrupted() {
+		os.Exit(1)
+	}
+}
+
+func printReport(report *datastore.CheckReport) {
+	fmt.Printf("%-16s %8s %10s %9s %10s %10s  %s\n", "SEGMENT", "VERSION", "SIZE", "RECORDS", "DEAD", "TYPES", "STATUS")
+	for _, seg := range report.Segments {
+		status := "ok"
+		if seg.CorruptOffset >= 0 {
+			status = fmt.Sprintf("CORRUPTED at offset %d: %v", seg.CorruptOffset, seg.Err)
+		} else if seg.Pending > 0 {
+			status = fmt.Sprintf("ok, %d bytes being written", seg.Pending)
+		}
+		fmt.Printf("%-16s %8d %10d %9d %10d %10s  %s\n",
+			seg.Name, seg.Version, seg.Size, seg.Records, seg.DeadBytes, formatTypes(seg.Types), status)
+	}
+
+	fmt.Printf("\nKeys:       %d\n", report.Keys)
+	fmt.Printf("Records:    %d\n", report.Records)
+	fmt.Printf("Duplicates: %d\n", report.Duplicates)
+	fmt.Printf("Dropped:    %d\n", report.Dropped)
+	fmt.Printf("Dead bytes: %d\n", report.DeadBytes)
+	fmt.Printf("Live types: %s\n", formatTypes(report.Types))
+	for _, name := range report.Stray {
+		fmt.Printf("Stray file: %s\n", name)
+	}
+}
+
+func formatTypes(types map[uint8]int) string {
+	if len(types) == 0 {
+		return "-"
+	}
+	valueTypes := make([]int, 0, len(types))
+	for t := range types {
+		valueTypes = append(valueTypes, int(t))
+	}
+	sort.Ints(valueTypes)
+
+	parts := make([]string, 0, len(valueTypes))
+	for _, t := range valueTypes {
+		parts = append(parts, fmt.Sprintf("%s=%d", datastore.TypeName(uint8(t)), types[uint8(t)]))
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/sifes/architecture-practice-5/datastore"
+)
+
+var dir = flag.String("dir", "/opt/practice-4/data", "database directory to migrate")
+
+func main() {
+	flag.Parse()
+
+	// The database server must be stopped while its directory is migrated
+	migrated, err := datastore.Migrate(*dir)
+	for _, seg := range migrated {
+		log.Printf("Migrated %s from format version %d (%d records)", seg.Name, seg.FromVersion, seg.Records)
+	}
+	if err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+
+	if len(migrated) == 0 {
+		log.Printf("%s is already in the current format", *dir)
+		return
+	}
+	log.Printf("Migrated %d segment files in %s", len(migrated), *dir)
+}
@@ -85,6 +85,15 @@ func main() {
 			return
 		}
 
+		// Pass overload on, so the load balancer and clients can back off
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+				rw.Header().Set("Retry-After", retryAfter)
+			}
+			http.Error(rw, "Database unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
 		if resp.StatusCode != http.StatusOK {
 			log.Printf("Database returned status %d", resp.StatusCode)
 			http.Error(rw, "Database error", http.StatusInternalServerError)
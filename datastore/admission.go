@@ -0,0 +1,56 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ErrBusy is returned for writes refused because the write queue is full.
+var ErrBusy = fmt.Errorf("database is busy: the write queue is full")
+
+// AdmissionPolicy decides what a write does when the write queue is full,
+// that is when writes arrive faster than the writer can store them.
+type AdmissionPolicy int
+
+const (
+	// AdmitBlock waits for room in the queue.
+	AdmitBlock AdmissionPolicy = iota
+	// AdmitFailFast fails with ErrBusy at once.
+	AdmitFailFast
+	// AdmitTimeout waits up to Options.AdmissionTimeout, then fails with
+	// ErrBusy.
+	AdmitTimeout
+)
+
+const (
+	defaultWriteQueueSize   = 100
+	defaultAdmissionTimeout = time.Second
+)
+
+// admit queues a request once the write queue was found full, as the
+// admission policy says. The caller holds closeMu for reading.
+func (db *Db) admit(ctx context.Context, req putRequest) error {
+	db.writeStalls.Add(1)
+
+	var timeout <-chan time.Time
+	switch db.admission {
+	case AdmitFailFast:
+		db.writesRejected.Add(1)
+		return ErrBusy
+	case AdmitTimeout:
+		timer := time.NewTimer(db.admissionTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case db.putChan <- req:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeout:
+		db.writesRejected.Add(1)
+		return ErrBusy
+	}
+}
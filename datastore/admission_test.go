@@ -0,0 +1,111 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// stallWriter holds the writer up on the index locks and fills the write
+// queue behind it. It returns the futures of the queued writes and a
+// function letting the writer go on.
+func stallWriter(t *testing.T, db *Db) ([]*PutFuture, func()) {
+	t.Helper()
+	batch := db.index.lockAll()
+	futures := []*PutFuture{db.PutAsync("stalled", "value")}
+	for len(db.putChan) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < cap(db.putChan); i++ {
+		futures = append(futures, db.PutAsync(fmt.Sprintf("queued%d", i), "value"))
+	}
+	return futures, batch.unlock
+}
+
+func TestAdmission_Policies(t *testing.T) {
+	t.Run("fail fast", func(t *testing.T) {
+		db, err := OpenWithOptions(t.TempDir(), Options{WriteQueueSize: 2, Admission: AdmitFailFast})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		futures, release := stallWriter(t, db)
+		if _, err := db.Put("refused", "value"); err != ErrBusy {
+			t.Errorf("Expected ErrBusy, got %v", err)
+		}
+		release()
+		for _, f := range futures {
+			if _, err := f.Wait(); err != nil {
+				t.Errorf("A queued write failed: %v", err)
+			}
+		}
+
+		stats, _ := db.Stats()
+		if stats.WriteStalls != 1 || stats.WritesRejected != 1 || stats.QueueCapacity != 2 {
+			t.Errorf("Unexpected stall statistics: %+v", stats)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		timeout := 50 * time.Millisecond
+		db, err := OpenWithOptions(t.TempDir(), Options{WriteQueueSize: 2, Admission: AdmitTimeout, AdmissionTimeout: timeout})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		futures, release := stallWriter(t, db)
+		start := time.Now()
+		if _, err := db.PutInt64Async("refused", 1).Wait(); err != ErrBusy {
+			t.Errorf("Expected ErrBusy, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < timeout {
+			t.Errorf("Gave up after %v, before the %v timeout", elapsed, timeout)
+		}
+
+		// A write admitted within the timeout succeeds
+		admitted := make(chan error)
+		go func() {
+			_, err := db.Put("admitted", "value")
+			admitted <- err
+		}()
+		release()
+		if err := <-admitted; err != nil {
+			t.Errorf("Expected the write to be admitted, got %v", err)
+		}
+		for _, f := range futures {
+			f.Wait()
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		db, err := OpenWithOptions(t.TempDir(), Options{WriteQueueSize: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		futures, release := stallWriter(t, db)
+		blocked := make(chan error)
+		go func() {
+			_, err := db.Put("blocked", "value")
+			blocked <- err
+		}()
+		select {
+		case err := <-blocked:
+			t.Fatalf("Write was not held back by the full queue: %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+		release()
+		if err := <-blocked; err != nil {
+			t.Error(err)
+		}
+		for _, f := range futures {
+			f.Wait()
+		}
+		if stats, _ := db.Stats(); stats.WriteStalls != 1 || stats.WritesRejected != 0 {
+			t.Errorf("Unexpected stall statistics: %+v", stats)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package datastore
+
+import (
+	"context"
+	"sync"
+)
+
+// PutFuture is the pending result of a write started by PutAsync or
+// PutInt64Async.
+type PutFuture struct {
+	result chan putResult
+	once   sync.Once
+	res    putResult
+}
+
+func completedFuture(err error) *PutFuture {
+	f := &PutFuture{result: make(chan putResult, 1)}
+	f.result <- putResult{err: err}
+	return f
+}
+
+// Wait blocks until the write is done and returns the sequence number
+// assigned to it. It may be called any number of times.
+func (f *PutFuture) Wait() (uint64, error) {
+	f.once.Do(func() {
+		f.res = <-f.result
+	})
+	return f.res.seq, f.res.err
+}
+
+// PutAsync queues a string value for writing and returns without waiting
+// for the write, so that many writes can be in flight at once. It only
+// blocks while the write queue is full.
+//
+// Writes are applied one at a time in the order they were queued, the
+// writes of Put included. Writes queued by one goroutine therefore get
+// increasing sequence numbers in call order and the last one wins for a
+// key, whether or not their futures are waited for; writes queued by
+// different goroutines are ordered by when PutAsync returned. A Get started
+// after Wait returns sees the write.
+func (db *Db) PutAsync(key, value string) *PutFuture {
+	if err := db.checkWrite(key, &entry{valueType: TypeString, stringValue: value}); err != nil {
+		return completedFuture(err)
+	}
+	return db.putAsync(putRequest{
+		key:       key,
+		value:     value,
+		valueType: TypeString,
+	})
+}
+
+// PutInt64Async queues an int64 value for writing, like PutAsync.
+func (db *Db) PutInt64Async(key string, value int64) *PutFuture {
+	if err := db.checkWrite(key, &entry{valueType: TypeInt64}); err != nil {
+		return completedFuture(err)
+	}
+	return db.putAsync(putRequest{
+		key:        key,
+		int64Value: value,
+		valueType:  TypeInt64,
+	})
+}
+
+func (db *Db) putAsync(req putRequest) *PutFuture {
+	req.result = make(chan putResult, 1)
+	if err := db.enqueue(context.Background(), req); err != nil {
+		return completedFuture(err)
+	}
+	return &PutFuture{result: req.result}
+}
@@ -0,0 +1,139 @@
+package datastore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestPutAsync_Ordering(t *testing.T) {
+	db, err := OpenWithMaxSegmentSize(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Queue far more writes than the queue holds without waiting
+	const writes = 2000
+	futures := make([]*PutFuture, writes)
+	for i := range futures {
+		if i%2 == 0 {
+			futures[i] = db.PutAsync("shared", fmt.Sprintf("value%d", i))
+		} else {
+			futures[i] = db.PutInt64Async(fmt.Sprintf("key%d", i), int64(i))
+		}
+	}
+
+	var lastSeq uint64
+	for i, f := range futures {
+		seq, err := f.Wait()
+		if err != nil {
+			t.Fatalf("Write %d: %v", i, err)
+		}
+		if seq <= lastSeq {
+			t.Fatalf("Write %d got seq %d after %d", i, seq, lastSeq)
+		}
+		lastSeq = seq
+	}
+	if again, _ := futures[0].Wait(); again == 0 {
+		t.Error("A second Wait lost the result")
+	}
+
+	if value, err := db.Get("shared"); err != nil || value != fmt.Sprintf("value%d", writes-2) {
+		t.Errorf("Expected the last queued write to win, got %q, %v", value, err)
+	}
+	if value, err := db.GetInt64("key1001"); err != nil || value != 1001 {
+		t.Errorf("GetInt64(key1001) = %d, %v", value, err)
+	}
+}
+
+func TestPutAsync_ConcurrentWriters(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Each writer's own writes keep their order among everyone else's
+	const writers, perWriter = 8, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			futures := make([]*PutFuture, perWriter)
+			for i := range futures {
+				futures[i] = db.PutInt64Async(fmt.Sprintf("writer%d", w), int64(i))
+			}
+			var lastSeq uint64
+			for _, f := range futures {
+				seq, err := f.Wait()
+				if err != nil || seq <= lastSeq {
+					t.Errorf("Writer %d: seq %d after %d, %v", w, seq, lastSeq, err)
+					return
+				}
+				lastSeq = seq
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for w := 0; w < writers; w++ {
+		if value, err := db.GetInt64(fmt.Sprintf("writer%d", w)); err != nil || value != perWriter-1 {
+			t.Errorf("writer%d = %d, %v", w, value, err)
+		}
+	}
+}
+
+func TestPutAsync_Errors(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{MaxValueSize: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.PutAsync("", "value").Wait(); err != ErrEmptyKey {
+		t.Errorf("Expected ErrEmptyKey, got %v", err)
+	}
+	if _, err := db.PutAsync("key", "far too long").Wait(); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+
+	pending := db.PutAsync("key", "value")
+	db.Close()
+	if _, err := pending.Wait(); err != nil {
+		t.Errorf("A write queued before Close failed: %v", err)
+	}
+	if _, err := db.PutInt64Async("key", 1).Wait(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func BenchmarkSegmentedDb_PutAsync(b *testing.B) {
+	db, err := OpenWithMaxSegmentSize(b.TempDir(), 10*1024*1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	b.Run("sync", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Put(fmt.Sprintf("bench_key_%d", i%1000), "bench_value"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("async", func(b *testing.B) {
+		futures := make([]*PutFuture, 0, 1000)
+		for i := 0; i < b.N; i++ {
+			futures = append(futures, db.PutAsync(fmt.Sprintf("bench_key_%d", i%1000), "bench_value"))
+			if len(futures) == cap(futures) || i == b.N-1 {
+				for _, f := range futures {
+					if _, err := f.Wait(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				futures = futures[:0]
+			}
+		}
+	})
+}
@@ -0,0 +1,328 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Keys of a bucket are stored as the bucket name, a NUL byte and the key.
+// Keys of the default key space never contain NUL, so the two cannot collide.
+const bucketSeparator = "\x00"
+
+var (
+	ErrInvalidKey    = fmt.Errorf("key must not contain NUL bytes")
+	ErrInvalidBucket = fmt.Errorf("bucket name must be non-empty, must not contain NUL bytes or start with an underscore, and must leave room for keys")
+)
+
+// reservedBucketPrefix starts the names the HTTP API uses for its own routes
+// next to buckets, such as _tx and _buckets.
+const reservedBucketPrefix = "_"
+
+// Bucket is a named key space within a database. Buckets are created
+// implicitly by writing to them and share the segments, sequence numbers and
+// merges of the database.
+type Bucket struct {
+	db     *Db
+	name   string
+	prefix string
+}
+
+// Bucket returns the bucket with the given name. The name counts towards
+// the key size limit of every key in the bucket.
+func (db *Db) Bucket(name string) (*Bucket, error) {
+	prefix, err := db.bucketPrefix(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{
+		db:     db,
+		name:   name,
+		prefix: prefix,
+	}, nil
+}
+
+// Buckets returns the names of all buckets holding at least one key, sorted.
+func (db *Db) Buckets() []string {
+	seen := make(map[string]bool)
+	bucketKeys := db.index.keys(func(key string) bool {
+		return !validKey(key)
+	})
+	for _, key := range bucketKeys {
+		if name, _, ok := splitBucketKey(key); ok {
+			seen[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DropBucket deletes every key of a bucket. The keys disappear immediately
+// for reads of the latest values. Like overwriting them, dropping is
+// versioned: point-in-time reads and snapshots from before the drop still
+// see the keys, and merges reclaim their records as they do older versions.
+func (db *Db) DropBucket(name string) error {
+	return db.DropBucketContext(context.Background(), name)
+}
+
+func (db *Db) DropBucketContext(ctx context.Context, name string) error {
+	prefix, err := db.bucketPrefix(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.putBatch(ctx, []entry{{
+		key:       prefix,
+		valueType: typeDropBucket,
+	}})
+	return err
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+func (b *Bucket) Get(key string) (string, error) {
+	return b.GetContext(context.Background(), key)
+}
+
+func (b *Bucket) GetContext(ctx context.Context, key string) (string, error) {
+	record, err := b.read(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if record.valueType != TypeString {
+		return "", ErrTypeMismatch
+	}
+	return record.stringValue, nil
+}
+
+func (b *Bucket) GetInt64(key string) (int64, error) {
+	return b.GetInt64Context(context.Background(), key)
+}
+
+func (b *Bucket) GetInt64Context(ctx context.Context, key string) (int64, error) {
+	record, err := b.read(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if record.valueType != TypeInt64 {
+		return 0, ErrTypeMismatch
+	}
+	return record.int64Value, nil
+}
+
+func (b *Bucket) Put(key, value string) (uint64, error) {
+	return b.PutContext(context.Background(), key, value)
+}
+
+func (b *Bucket) PutContext(ctx context.Context, key, value string) (uint64, error) {
+	return b.write(ctx, entry{
+		key:         key,
+		valueType:   TypeString,
+		stringValue: value,
+	})
+}
+
+func (b *Bucket) PutInt64(key string, value int64) (uint64, error) {
+	return b.PutInt64Context(context.Background(), key, value)
+}
+
+func (b *Bucket) PutInt64Context(ctx context.Context, key string, value int64) (uint64, error) {
+	return b.write(ctx, entry{
+		key:        key,
+		valueType:  TypeInt64,
+		int64Value: value,
+	})
+}
+
+func (b *Bucket) GetAt(key string, seq uint64) (Version, error) {
+	if !validBucketKey(key) {
+		return Version{}, ErrNotFound
+	}
+	return b.db.GetAt(b.prefix+key, seq)
+}
+
+func (b *Bucket) GetAtTime(key string, t time.Time) (Version, error) {
+	if !validBucketKey(key) {
+		return Version{}, ErrNotFound
+	}
+	return b.db.GetAtTime(b.prefix+key, t)
+}
+
+func (b *Bucket) History(key string) ([]Version, error) {
+	if !validBucketKey(key) {
+		return nil, ErrNotFound
+	}
+	return b.db.History(b.prefix + key)
+}
+
+// Keys returns the keys stored in the bucket in sorted order.
+func (b *Bucket) Keys() []string {
+	keys := b.db.index.keys(func(key string) bool {
+		return strings.HasPrefix(key, b.prefix)
+	})
+	for i, key := range keys {
+		keys[i] = key[len(b.prefix):]
+	}
+	return keys
+}
+
+func (b *Bucket) read(ctx context.Context, key string) (*entry, error) {
+	if !validBucketKey(key) {
+		return nil, ErrNotFound
+	}
+	return b.db.readLatest(ctx, b.prefix+key)
+}
+
+func (b *Bucket) write(ctx context.Context, e entry) (uint64, error) {
+	if err := b.db.checkWrite(e.key, &e); err != nil {
+		return 0, err
+	}
+	e.key = b.prefix + e.key
+	if len(e.key) > b.db.maxKeySize {
+		return 0, ErrKeyTooLarge
+	}
+	return b.db.putBatch(ctx, []entry{e})
+}
+
+// bucketPrefix returns the prefix of the stored keys of a bucket.
+func bucketPrefix(name string) (string, error) {
+	if name == "" || strings.Contains(name, bucketSeparator) || strings.HasPrefix(name, reservedBucketPrefix) {
+		return "", ErrInvalidBucket
+	}
+	return name + bucketSeparator, nil
+}
+
+// bucketPrefix is bucketPrefix that also rejects names too long to leave
+// room for a key under the key size limit.
+func (db *Db) bucketPrefix(name string) (string, error) {
+	prefix, err := bucketPrefix(name)
+	if err != nil {
+		return "", err
+	}
+	if len(prefix) >= db.maxKeySize {
+		return "", ErrInvalidBucket
+	}
+	return prefix, nil
+}
+
+// validKey reports whether key can be stored in the default key space.
+func validKey(key string) bool {
+	return !strings.Contains(key, bucketSeparator)
+}
+
+// validBucketKey reports whether key can be stored in a bucket. The empty
+// key is reserved for the bucket's drop markers; writes reject it anyway.
+func validBucketKey(key string) bool {
+	return key != "" && validKey(key)
+}
+
+// splitBucketKey splits a stored key into its bucket name and key. It
+// reports false for keys of the default key space.
+func splitBucketKey(storedKey string) (bucket, key string, ok bool) {
+	i := strings.Index(storedKey, bucketSeparator)
+	if i < 0 {
+		return "", storedKey, false
+	}
+	return storedKey[:i], storedKey[i+len(bucketSeparator):], true
+}
+
+// dropMarker is a bucket drop in the drop history of a bucket.
+type dropMarker struct {
+	Seq       uint64 `json:"seq"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// addDrops adds markers to the drop history of the bucket with the given
+// key prefix, keeping it sorted.
+func (db *Db) addDrops(prefix string, markers ...dropMarker) {
+	db.dropsMu.Lock()
+	defer db.dropsMu.Unlock()
+
+	history := append(db.drops[prefix], markers...)
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Seq < history[j].Seq
+	})
+	// A marker may be read twice from a segment an interrupted merge left
+	deduped := history[:0]
+	for i, marker := range history {
+		if i == 0 || marker.Seq != history[i-1].Seq {
+			deduped = append(deduped, marker)
+		}
+	}
+	db.drops[prefix] = deduped
+}
+
+// dropFloor returns the sequence number of the latest drop of the bucket
+// with the given key prefix made by the time of seq and timestamp, or zero
+// if there is none. Records of the bucket written before it are deleted at
+// that time.
+func (db *Db) dropFloor(prefix string, seq uint64, timestamp int64) uint64 {
+	db.dropsMu.RLock()
+	defer db.dropsMu.RUnlock()
+
+	history := db.drops[prefix]
+	i := sort.Search(len(history), func(i int) bool {
+		return history[i].Seq > seq || history[i].Timestamp > timestamp
+	})
+	if i == 0 {
+		return 0
+	}
+	return history[i-1].Seq
+}
+
+// droppedAfter returns the key prefixes of the buckets dropped after the
+// time of seq and timestamp.
+func (db *Db) droppedAfter(seq uint64, timestamp int64) map[string]bool {
+	db.dropsMu.RLock()
+	defer db.dropsMu.RUnlock()
+
+	prefixes := make(map[string]bool)
+	for prefix, history := range db.drops {
+		if last := history[len(history)-1]; last.Seq > seq || last.Timestamp > timestamp {
+			prefixes[prefix] = true
+		}
+	}
+	return prefixes
+}
+
+// bucketDroppedAfter reports whether the bucket with the given key prefix
+// was dropped after the time of seq and timestamp.
+func (db *Db) bucketDroppedAfter(prefix string, seq uint64, timestamp int64) bool {
+	db.dropsMu.RLock()
+	defer db.dropsMu.RUnlock()
+
+	history := db.drops[prefix]
+	if len(history) == 0 {
+		return false
+	}
+	last := history[len(history)-1]
+	return last.Seq > seq || last.Timestamp > timestamp
+}
+
+// droppedKeys returns the keys written before their bucket's latest drop
+// marker. drops maps bucket key prefixes to drop marker sequence numbers.
+func droppedKeys(index indexTable, drops map[string]uint64) []string {
+	if len(drops) == 0 {
+		return nil
+	}
+	var dropped []string
+	index.forEach(func(key string, location indexEntry) {
+		name, _, ok := splitBucketKey(key)
+		if !ok {
+			return
+		}
+		if seq, ok := drops[name+bucketSeparator]; ok && location.seq < seq {
+			dropped = append(dropped, key)
+		}
+	})
+	return dropped
+}
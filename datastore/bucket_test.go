@@ -0,0 +1,306 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBucket_IndependentKeySpaces(t *testing.T) {
+	db, err := OpenWithMaxSegmentSize(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	users, err := db.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders, err := db.Bucket("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Put("telepuziki", "default"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Put("telepuziki", "users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := orders.PutInt64("telepuziki", 42); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := orders.Put("other", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := db.Get("telepuziki"); value != "default" {
+		t.Errorf("Default bucket: got %q", value)
+	}
+	if value, _ := users.Get("telepuziki"); value != "users" {
+		t.Errorf("users bucket: got %q", value)
+	}
+	if value, _ := orders.GetInt64("telepuziki"); value != 42 {
+		t.Errorf("orders bucket: got %d", value)
+	}
+	if _, err := users.Get("other"); err != ErrNotFound {
+		t.Errorf("Key leaked between buckets: %v", err)
+	}
+
+	if keys := db.Keys(); !reflect.DeepEqual(keys, []string{"telepuziki"}) {
+		t.Errorf("Default keys: %v", keys)
+	}
+	if keys := orders.Keys(); !reflect.DeepEqual(keys, []string{"other", "telepuziki"}) {
+		t.Errorf("orders keys: %v", keys)
+	}
+	if names := db.Buckets(); !reflect.DeepEqual(names, []string{"orders", "users"}) {
+		t.Errorf("Buckets: %v", names)
+	}
+
+	// Stored keys of buckets cannot be reached from the default key space
+	if _, err := db.Put("users\x00telepuziki", "x"); err != ErrInvalidKey {
+		t.Errorf("Expected ErrInvalidKey, got %v", err)
+	}
+	if _, err := db.Get("users\x00telepuziki"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := users.Put("", "x"); err != ErrEmptyKey {
+		t.Errorf("Expected ErrEmptyKey for an empty bucket key, got %v", err)
+	}
+	if _, err := db.Bucket(""); err != ErrInvalidBucket {
+		t.Errorf("Expected ErrInvalidBucket, got %v", err)
+	}
+	// Names of the HTTP API's own routes
+	for _, name := range []string{"_tx", "_dump", "_load", "_buckets", "_index"} {
+		if _, err := db.Bucket(name); err != ErrInvalidBucket {
+			t.Errorf("%s: expected ErrInvalidBucket, got %v", name, err)
+		}
+	}
+}
+
+func TestBucket_Drop(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenWithMaxSegmentSize(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, _ := db.Bucket("tmp")
+	keep, _ := db.Bucket("keep")
+	for i := 0; i < 20; i++ {
+		if _, err := tmp.Put(string(rune('a'+i)), "temporary value"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := keep.Put(string(rune('a'+i)), "kept value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.DropBucket("tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmp.Get("a"); err != ErrNotFound {
+		t.Errorf("Dropped key still readable: %v", err)
+	}
+	if keys := tmp.Keys(); len(keys) != 0 {
+		t.Errorf("Dropped bucket still lists %v", keys)
+	}
+
+	// The bucket can be reused after the drop
+	if _, err := tmp.Put("b", "new value"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := db.Put("filler", "rotates the segment holding the drop"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Merge on the writer goroutine regardless of the segment count
+	req := putRequest{kind: requestMerge, result: make(chan putResult)}
+	db.putChan <- req
+	if res := <-req.result; res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	stale := 0
+	db.segmentMu.RLock()
+	for _, seg := range db.segments {
+		err := db.scanSegment(seg, func(e *entry) {
+			if bucket, _, ok := splitBucketKey(e.key); ok && bucket == "tmp" && e.stringValue == "temporary value" {
+				stale++
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.segmentMu.RUnlock()
+	if stale != 0 {
+		t.Errorf("Merge kept %d records of the dropped bucket", stale)
+	}
+
+	check := func(db *Db) {
+		t.Helper()
+		tmp, _ := db.Bucket("tmp")
+		keep, _ := db.Bucket("keep")
+		if keys := tmp.Keys(); !reflect.DeepEqual(keys, []string{"b"}) {
+			t.Errorf("tmp keys after drop: %v", keys)
+		}
+		if value, _ := tmp.Get("b"); value != "new value" {
+			t.Errorf("Write after drop lost: %q", value)
+		}
+		if keys := keep.Keys(); len(keys) != 20 {
+			t.Errorf("Drop affected another bucket: %d keys", len(keys))
+		}
+	}
+	check(db)
+
+	// The drop survives a restart
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithMaxSegmentSize(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestBucket_DropIsVersioned(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{MaxSegmentSize: 256}
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopMergeLoop(db)
+
+	tmp, _ := db.Bucket("tmp")
+	if _, err := tmp.Put("a", "before"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmp.Put("b", "old"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := db.Snapshot()
+	defer snapshot.Close()
+	before := snapshot.Seq()
+
+	if err := db.DropBucket("tmp"); err != nil {
+		t.Fatal(err)
+	}
+	dropped := db.LastSeq()
+	if _, err := tmp.Put("b", "new"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := db.Put("filler", "rotates the segment holding the drop"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mergeNow(db); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *Db, snapshot *Snapshot) {
+		t.Helper()
+		tmp, _ := db.Bucket("tmp")
+		if _, err := tmp.Get("a"); err != ErrNotFound {
+			t.Errorf("Dropped key still readable: %v", err)
+		}
+		if value, _ := tmp.Get("b"); value != "new" {
+			t.Errorf("Write after drop lost: %q", value)
+		}
+		for _, tc := range []struct {
+			key   string
+			seq   uint64
+			value interface{}
+		}{
+			{"a", before, "before"},
+			{"b", before, "old"},
+			{"a", dropped, nil},
+			{"b", dropped, nil},
+			{"b", db.LastSeq(), "new"},
+		} {
+			version, err := tmp.GetAt(tc.key, tc.seq)
+			if tc.value == nil {
+				if err != ErrNotFound {
+					t.Errorf("GetAt(%s, %d) after the drop = %+v, %v", tc.key, tc.seq, version, err)
+				}
+			} else if err != nil || version.Value != tc.value {
+				t.Errorf("GetAt(%s, %d) = %+v, %v, expected %v", tc.key, tc.seq, version, err, tc.value)
+			}
+		}
+		if snapshot != nil {
+			if v, err := snapshot.version("tmp" + bucketSeparator + "a"); err != nil || v.Value != "before" {
+				t.Errorf("Snapshot read %+v, %v after the drop", v, err)
+			}
+		}
+	}
+	check(db, snapshot)
+
+	// The drop history survives a restart
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stopMergeLoop(db)
+	check(db, nil)
+
+	// Without snapshots pinning them, merges reclaim the dropped records
+	if err := mergeNow(db); err != nil {
+		t.Fatal(err)
+	}
+	tmp, _ = db.Bucket("tmp")
+	if _, err := tmp.GetAt("a", before); err != ErrNotFound {
+		t.Errorf("Dropped record kept by a merge: %v", err)
+	}
+}
+
+func TestBucket_DropCountsAsVersion(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{MaxSegmentSize: 256, MaxVersions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stopMergeLoop(db)
+
+	tmp, _ := db.Bucket("tmp")
+	var seqs []uint64
+	for _, value := range []string{"v1", "v2"} {
+		seq, err := tmp.Put("a", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, seq)
+	}
+	if err := db.DropBucket("tmp"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := db.Put("filler", "rotates the segment holding the drop"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mergeNow(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// The drop and the version before it are the two most recent
+	history, err := tmp.History("a")
+	if err != nil || len(history) != 1 || history[0].Value != "v2" {
+		t.Errorf("History after drop = %+v, %v", history, err)
+	}
+	if version, err := tmp.GetAt("a", seqs[1]); err != nil || version.Value != "v2" {
+		t.Errorf("GetAt before the drop = %+v, %v", version, err)
+	}
+	if _, err := tmp.Get("a"); err != ErrNotFound {
+		t.Errorf("Dropped key still readable: %v", err)
+	}
+}
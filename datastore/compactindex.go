@@ -0,0 +1,235 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+const (
+	// An entry packs the segment ID into the bits above the record offset
+	compactOffsetBits   = 40
+	compactMaxOffset    = 1<<compactOffsetBits - 1
+	compactMaxSegmentID = 1<<(64-compactOffsetBits) - 1
+
+	// Values of free slots
+	compactSlotEmpty   = 0
+	compactSlotDeleted = math.MaxUint32
+
+	// A table starts with this many slots and is rebuilt once more than
+	// compactMaxLoad percent of them are taken, deleted slots included
+	compactInitialSlots = 8
+	compactMaxLoad      = 60
+)
+
+// compactTable is an indexTable taking a fraction of the memory of a map
+// for many small keys. The entries are kept in one slice and the keys in
+// one byte arena, each after its length; an open-addressing table of
+// entry numbers using linear probing finds them. None of it holds pointers
+// for the garbage collector to follow, and all of it grows by a quarter
+// at a time rather than doubling.
+//
+// An entry whose segment ID or offset does not fit is reported to the index
+// as an error and not stored.
+type compactTable struct {
+	slots      []uint32 // entry number plus one, or a free slot marker
+	entries    []compactEntry
+	arena      []byte
+	tombstones int
+	garbage    int // arena bytes of deleted keys
+	fail       func(error)
+}
+
+type compactEntry struct {
+	key  uint32 // arena offset
+	size uint32
+	pos  uint64 // segment ID << compactOffsetBits | offset
+	seq  uint64
+}
+
+func newCompactTable(fail func(error)) *compactTable {
+	return &compactTable{
+		slots: make([]uint32, compactInitialSlots),
+		fail:  fail,
+	}
+}
+
+// newCompactIndex returns a sharded index of compact tables.
+func newCompactIndex(shardCount int) *shardedIndex {
+	idx := &shardedIndex{shards: make([]indexShard, shardCount)}
+	for i := range idx.shards {
+		idx.shards[i].entries = newCompactTable(idx.fail)
+	}
+	return idx
+}
+
+// growSlice returns s with room for n more elements, growing it by a
+// quarter to keep the unused capacity small.
+func growSlice[T any](s []T, n int) []T {
+	if len(s)+n <= cap(s) {
+		return s
+	}
+	grown := make([]T, len(s), len(s)+n+len(s)/4+8)
+	copy(grown, s)
+	return grown
+}
+
+// keyAt returns the key stored at an arena offset, without copying it.
+func keyAt(arena []byte, off uint32) []byte {
+	length, n := binary.Uvarint(arena[off:])
+	start := int(off) + n
+	return arena[start : start+int(length)]
+}
+
+// find returns the slot referring to key if found, and otherwise the first
+// free slot probed, which is where the key goes.
+func (t *compactTable) find(key string) (int, bool) {
+	mask := len(t.slots) - 1
+	i := int(keyHash64(key) & uint64(mask))
+	free := -1
+	for {
+		switch slot := t.slots[i]; slot {
+		case compactSlotEmpty:
+			if free < 0 {
+				free = i
+			}
+			return free, false
+		case compactSlotDeleted:
+			if free < 0 {
+				free = i
+			}
+		default:
+			if string(keyAt(t.arena, t.entries[slot-1].key)) == key {
+				return i, true
+			}
+		}
+		i = (i + 1) & mask
+	}
+}
+
+func (e *compactEntry) location() indexEntry {
+	return indexEntry{
+		segmentID: int(e.pos >> compactOffsetBits),
+		offset:    int64(e.pos & compactMaxOffset),
+		seq:       e.seq,
+		size:      e.size,
+	}
+}
+
+func (t *compactTable) get(key string) (indexEntry, bool) {
+	i, found := t.find(key)
+	if !found {
+		return indexEntry{}, false
+	}
+	return t.entries[t.slots[i]-1].location(), true
+}
+
+func (t *compactTable) set(key string, location indexEntry) {
+	if location.segmentID < 0 || location.segmentID > compactMaxSegmentID ||
+		location.offset < 0 || location.offset > compactMaxOffset {
+		t.fail(fmt.Errorf("compact index cannot hold segment %d offset %d", location.segmentID, location.offset))
+		return
+	}
+
+	i, found := t.find(key)
+	if !found {
+		if len(t.entries) >= compactSlotDeleted-1 || len(t.arena)+binary.MaxVarintLen64+len(key) > math.MaxUint32 {
+			t.fail(fmt.Errorf("compact index shard is full"))
+			return
+		}
+		if t.slots[i] == compactSlotDeleted {
+			t.tombstones--
+		}
+		t.arena = growSlice(t.arena, binary.MaxVarintLen64+len(key))
+		t.entries = growSlice(t.entries, 1)
+		t.entries = append(t.entries, compactEntry{key: uint32(len(t.arena))})
+		t.arena = binary.AppendUvarint(t.arena, uint64(len(key)))
+		t.arena = append(t.arena, key...)
+		t.slots[i] = uint32(len(t.entries))
+	}
+	e := &t.entries[t.slots[i]-1]
+	e.size = location.size
+	e.pos = uint64(location.segmentID)<<compactOffsetBits | uint64(location.offset)
+	e.seq = location.seq
+
+	if (len(t.entries)+t.tombstones)*100 > len(t.slots)*compactMaxLoad {
+		t.rebuild()
+	}
+}
+
+// delete frees the slot of key and moves the last entry into the place of
+// the deleted one, keeping the entries dense.
+func (t *compactTable) delete(key string) {
+	i, found := t.find(key)
+	if !found {
+		return
+	}
+	n := t.slots[i] - 1
+	length, size := binary.Uvarint(t.arena[t.entries[n].key:])
+	t.garbage += size + int(length)
+	t.slots[i] = compactSlotDeleted
+	t.tombstones++
+
+	last := uint32(len(t.entries) - 1)
+	if n != last {
+		moved := t.entries[last]
+		t.entries[n] = moved
+		mask := len(t.slots) - 1
+		j := int(keyHash64(string(keyAt(t.arena, moved.key))) & uint64(mask))
+		for t.slots[j] != last+1 {
+			j = (j + 1) & mask
+		}
+		t.slots[j] = n + 1
+	}
+	t.entries = t.entries[:last]
+}
+
+func (t *compactTable) len() int {
+	return len(t.entries)
+}
+
+func (t *compactTable) forEach(fn func(key string, location indexEntry)) {
+	for i := range t.entries {
+		fn(string(keyAt(t.arena, t.entries[i].key)), t.entries[i].location())
+	}
+}
+
+func (t *compactTable) memoryBytes() int64 {
+	return int64(cap(t.slots))*int64(unsafe.Sizeof(uint32(0))) +
+		int64(cap(t.entries))*int64(unsafe.Sizeof(compactEntry{})) +
+		int64(cap(t.arena))
+}
+
+// rebuild drops the deleted slots, sizing the table so that a quarter of
+// the allowed load is left before the next rebuild. The arena is rewritten
+// too once deleted keys take half of it.
+func (t *compactTable) rebuild() {
+	slotCount := compactInitialSlots
+	for len(t.entries)*100*4 > slotCount*compactMaxLoad*3 {
+		slotCount *= 2
+	}
+
+	if t.garbage*2 > len(t.arena) {
+		arena := make([]byte, 0, len(t.arena)-t.garbage)
+		for i := range t.entries {
+			key := keyAt(t.arena, t.entries[i].key)
+			t.entries[i].key = uint32(len(arena))
+			arena = binary.AppendUvarint(arena, uint64(len(key)))
+			arena = append(arena, key...)
+		}
+		t.arena = arena
+		t.garbage = 0
+	}
+
+	t.slots = make([]uint32, slotCount)
+	t.tombstones = 0
+	mask := slotCount - 1
+	for n := range t.entries {
+		i := int(keyHash64(string(keyAt(t.arena, t.entries[n].key))) & uint64(mask))
+		for t.slots[i] != compactSlotEmpty {
+			i = (i + 1) & mask
+		}
+		t.slots[i] = uint32(n + 1)
+	}
+}
@@ -0,0 +1,164 @@
+package datastore
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func TestCompactTable(t *testing.T) {
+	var failure error
+	table := newCompactTable(func(err error) { failure = err })
+
+	expected := make(map[string]indexEntry)
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		location := indexEntry{segmentID: i % 7, offset: int64(i) * 100, seq: uint64(i + 1), size: uint32(i % 300)}
+		table.set(key, location)
+		expected[key] = location
+	}
+	for i := 0; i < 5000; i += 2 {
+		key := fmt.Sprintf("key%d", i)
+		location := indexEntry{segmentID: compactMaxSegmentID, offset: compactMaxOffset, seq: uint64(10000 + i)}
+		table.set(key, location)
+		expected[key] = location
+	}
+	for i := 0; i < 5000; i++ {
+		if i%4 != 0 {
+			key := fmt.Sprintf("key%d", i)
+			table.delete(key)
+			delete(expected, key)
+		}
+	}
+
+	// Keys coming and going do not pile up in the arena
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 1000; i++ {
+			table.set(fmt.Sprintf("churn%02d-%d", round, i), indexEntry{seq: uint64(i)})
+		}
+		for i := 0; i < 1000; i++ {
+			table.delete(fmt.Sprintf("churn%02d-%d", round, i))
+		}
+	}
+	if len(table.arena) > 100000 {
+		t.Errorf("The arena holds %d bytes for %d keys", len(table.arena), table.len())
+	}
+
+	if table.len() != len(expected) {
+		t.Errorf("Expected %d entries, got %d", len(expected), table.len())
+	}
+	for key, location := range expected {
+		if got, ok := table.get(key); !ok || got != location {
+			t.Fatalf("get(%q) = %+v, %v, expected %+v", key, got, ok, location)
+		}
+	}
+	if _, ok := table.get("key1"); ok {
+		t.Error("A deleted key was found")
+	}
+	seen := 0
+	table.forEach(func(key string, location indexEntry) {
+		seen++
+		if expected[key] != location {
+			t.Errorf("forEach: %q at %+v, expected %+v", key, location, expected[key])
+		}
+	})
+	if seen != len(expected) {
+		t.Errorf("forEach saw %d entries, expected %d", seen, len(expected))
+	}
+	if failure != nil {
+		t.Fatal(failure)
+	}
+
+	// Locations that do not fit a slot are refused
+	table.set("far", indexEntry{segmentID: compactMaxSegmentID + 1})
+	if failure == nil {
+		t.Error("Expected a segment ID out of range to be reported")
+	}
+	if _, ok := table.get("far"); ok {
+		t.Error("An entry out of range was stored")
+	}
+}
+
+func TestCompactIndex_Stats(t *testing.T) {
+	open := func(compact bool) *Db {
+		db, err := OpenWithOptions(t.TempDir(), Options{MaxSegmentSize: 4096, CompactIndex: compact})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3000; i++ {
+			if _, err := db.PutInt64(fmt.Sprintf("key%d", i%1000), int64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return db
+	}
+	maps, compact := open(false), open(true)
+	defer maps.Close()
+	defer compact.Close()
+
+	for i := 0; i < 1000; i++ {
+		if value, err := compact.GetInt64(fmt.Sprintf("key%d", i)); err != nil || value != int64(2000+i) {
+			t.Fatalf("key%d = %d, %v", i, value, err)
+		}
+	}
+
+	mapStats, _ := maps.Stats()
+	compactStats, err := compact.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compactStats.Keys != 1000 || compactStats.IndexBytes <= 0 || compactStats.IndexBytes >= mapStats.IndexBytes {
+		t.Errorf("Compact index: %d keys in %d bytes, maps take %d", compactStats.Keys, compactStats.IndexBytes, mapStats.IndexBytes)
+	}
+}
+
+// BenchmarkIndexTable compares a compact table to a map: the heap taken
+// per key, and the time of lookups and updates.
+func BenchmarkIndexTable(b *testing.B) {
+	keys := make([]string, 200000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%08d", i)
+	}
+
+	tables := []struct {
+		name     string
+		newTable func() indexTable
+	}{
+		{"map", func() indexTable { return make(hashIndex) }},
+		{"compact", func() indexTable { return newCompactTable(func(err error) { b.Fatal(err) }) }},
+	}
+	for _, tt := range tables {
+		b.Run(tt.name+"/memory", func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				table := tt.newTable()
+				for i, key := range keys {
+					// Keys are copied, as they are when read from segments
+					table.set(string([]byte(key)), indexEntry{segmentID: i % 50, offset: int64(i), seq: uint64(i), size: 40})
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(len(keys)), "heap-bytes/key")
+				b.ReportMetric(float64(table.memoryBytes())/float64(len(keys)), "reported-bytes/key")
+				runtime.KeepAlive(table)
+			}
+		})
+
+		table := tt.newTable()
+		for i, key := range keys {
+			table.set(key, indexEntry{seq: uint64(i)})
+		}
+		b.Run(tt.name+"/get", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				table.get(keys[(i*7919)%len(keys)])
+			}
+		})
+		b.Run(tt.name+"/set", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				table.set(keys[(i*7919)%len(keys)], indexEntry{seq: uint64(i)})
+			}
+		})
+	}
+}
@@ -2,15 +2,18 @@ package datastore
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,103 +28,387 @@ const (
 const (
 	TypeString uint8 = 1
 	TypeInt64  uint8 = 2
+
+	// typeDropBucket marks the point after which the keys of a bucket
+	// written earlier are deleted
+	typeDropBucket uint8 = 3
 )
 
+// TypeName returns a readable name for a value type.
+func TypeName(valueType uint8) string {
+	switch valueType {
+	case TypeString:
+		return "string"
+	case TypeInt64:
+		return "int64"
+	case typeDropBucket:
+		return "bucket drop"
+	}
+	return "type " + strconv.Itoa(int(valueType))
+}
+
 var ErrNotFound = fmt.Errorf("record does not exist")
 var ErrTypeMismatch = fmt.Errorf("value type does not match expected type")
+var ErrReadOnly = fmt.Errorf("database is opened read-only")
+var ErrClosed = fmt.Errorf("database is closed")
 
 type segmentInfo struct {
 	id       int
 	filePath string
 	readOnly bool
+
+	// Set once the segment has been offloaded to the object store, where
+	// it is kept under the base name of filePath
+	remote bool
+	size   int64 // of the file, kept for cheap metrics
+
+	seqs seqRange
 }
 
 type indexEntry struct {
 	segmentID int
 	offset    int64
+	seq       uint64
+	size      uint32 // record size, to account live bytes per segment
 }
 
 type hashIndex map[string]indexEntry
 
+type requestKind uint8
+
+const (
+	requestPut requestKind = iota
+	requestMerge
+	requestCommit
+)
+
 type putRequest struct {
+	kind       requestKind
 	key        string
 	value      string
 	int64Value int64
 	valueType  uint8
-	result     chan error
+	result     chan putResult // buffered, the sender may have given up
+
+	// The writer skips the request if ctx is done by the time it gets to it
+	ctx context.Context
+
+	// Transaction commit: sequence numbers observed by reads and the
+	// records to write if none of them changed
+	reads  map[string]uint64
+	writes []entry
+}
+
+type putResult struct {
+	seq uint64
+	err error
 }
 
 type Db struct {
-	// Index synchronization - separate from file operations
-	indexMu sync.RWMutex
-	index   hashIndex
+	// In-memory index, split into shards with a lock each. Secondary
+	// indexes have a lock of their own, taken after any shard locks.
+	index       *shardedIndex
+	secondaryMu sync.RWMutex
+	secondary   map[string]*secondaryIndex
 	
 	// Database configuration
-	dir            string
-	maxSegmentSize int64
+	fs               FS
+	dir              string
+	readOnly         bool
+	lock             *dirLock
+	maxSegmentSize   int64
+	maxVersions      int
+	versionRetention time.Duration
+	maxKeySize       int
+	maxValueSize     int
+	indexWorkers     int
+	objects          ObjectStore // nil keeps all segments local
+	localSegments    int
+	indexOnDisk      bool
+	indexCacheSize   int
 	
 	// Active segment info (needs separate protection for reads)
 	segmentMu       sync.RWMutex
 	activeSegmentID int
 	segments        []segmentInfo
+	activeSeqs      seqRange // of the active segment, open-ended
 	
 	// Writer goroutine communication
 	putChan    chan putRequest
 	stopWriter chan struct{}
 	writerWG   sync.WaitGroup
+
+	// What writes do while putChan is full, and how often they found it so
+	admission        AdmissionPolicy
+	admissionTimeout time.Duration
+	writeStalls      atomic.Int64
+	writesRejected   atomic.Int64
+
+	// Senders hold closeMu for reading while queueing a request, so once
+	// Close has set closed nothing more enters putChan
+	closeMu sync.RWMutex
+	closed  atomic.Bool
 	
+	// Open snapshots pin the versions they can see against merges
+	snapshotMu sync.Mutex
+	snapshots  map[*Snapshot]struct{}
+
+	// Drop history of every dropped bucket by key prefix, oldest first, for
+	// reads of older versions
+	dropsMu sync.RWMutex
+	drops   map[string][]dropMarker
+
 	// Merge control
 	mergeChan chan struct{}
 	stopMerge chan struct{}
 	mergeWG   sync.WaitGroup
 	
 	// Writer goroutine state
-	out       *os.File
-	outOffset int64
+	out           File
+	lastTimestamp int64
+
+	// Write offset in the active segment. Only the writer goroutine
+	// changes it; readers may load it at any time.
+	outOffset atomic.Int64
+
+	// Merge statistics
+	mergeStatsMu sync.Mutex
+	mergeStats   mergeStats
+
+	// Set when the active segment could not be repaired after a failed
+	// write; all later writes fail with it
+	writeErr error
+
+	// Sequence number of the most recently written record. Only the writer
+	// goroutine advances it; readers may load it at any time.
+	lastSeq atomic.Uint64
 }
 
 type mergeRequest struct {
 	result chan error
 }
 
+// mergeRecord is a record read by a merge, with where it was read from:
+// the position of its segment among the merged ones and its offset.
+type mergeRecord struct {
+	entry
+	segment int
+	offset  int64
+}
+
+// Options configures a database opened with OpenWithOptions.
+type Options struct {
+	// MaxSegmentSize is the size after which the active segment is sealed.
+	// The LSM engine flushes its memtable to a sorted table at this size.
+	// Zero selects the default of 10MB.
+	MaxSegmentSize int64
+
+	// MaxVersions is the number of most recent versions of every key kept
+	// when segments are merged. Values below 1 keep only the latest one, as
+	// the LSM engine always does.
+	MaxVersions int
+
+	// VersionRetention additionally keeps all versions written within this
+	// window before a merge. Zero disables time-based retention.
+	VersionRetention time.Duration
+
+	// MaxKeySize is the largest key accepted, in bytes. Zero selects the
+	// default of 4KB.
+	MaxKeySize int
+
+	// MaxValueSize is the largest string value accepted, in bytes. It may not
+	// exceed MaxSegmentSize. Zero selects 1MB or MaxSegmentSize if smaller.
+	MaxValueSize int
+
+	// FS is the filesystem holding the database files. Nil selects the
+	// operating system's.
+	FS FS
+
+	// IndexWorkers is the number of segments indexed concurrently on open.
+	// Zero selects the number of CPUs.
+	IndexWorkers int
+
+	// Indexes declares secondary indexes over fields of JSON values. They
+	// are kept in memory and rebuilt on open. The LSM engine does not
+	// support them.
+	Indexes []IndexSpec
+
+	// WriteQueueSize is the number of writes queued for the writer before
+	// the admission policy applies. Zero selects 100. The LSM engine has no
+	// write queue and ignores the admission options.
+	WriteQueueSize int
+
+	// Admission is what writes do while the write queue is full. The zero
+	// value, AdmitBlock, waits for room.
+	Admission AdmissionPolicy
+
+	// AdmissionTimeout is how long AdmitTimeout waits for room in the write
+	// queue. Zero selects one second.
+	AdmissionTimeout time.Duration
+
+	// ObjectStore receives sealed segments once they are no longer among
+	// the LocalSegments most recent ones. Offloaded segments are removed
+	// from the directory and read from the store when needed, so tools
+	// working on the directory alone only see the local ones. Merges take
+	// them in like local segments: the merged segment is written locally,
+	// to be offloaded again in turn, and the objects it replaces are
+	// deleted. Nil keeps all segments local. The LSM engine ignores the
+	// tiering options.
+	ObjectStore ObjectStore
+
+	// LocalSegments is the number of most recent sealed segments kept
+	// local with an ObjectStore. Zero selects 2.
+	LocalSegments int
+
+	// IndexOnDisk keeps the index in files under the directory instead of
+	// memory, so that the keys need not fit in memory, at the cost of extra
+	// reads for lookups the cache does not serve. The files are reused on
+	// open after a clean Close; otherwise the index is rebuilt from the
+	// segments. Read-only opens and the LSM engine keep it in memory.
+	IndexOnDisk bool
+
+	// IndexCacheSize is the number of index entries cached in memory with
+	// IndexOnDisk. Zero selects 100000.
+	IndexCacheSize int
+
+	// CompactIndex keeps the in-memory index in open-addressing tables
+	// with the keys packed into byte arenas, which takes a fraction of the
+	// memory of the default maps for many small keys. It holds segment IDs
+	// below 2^24 and offsets below 2^40. IndexOnDisk takes precedence.
+	CompactIndex bool
+}
+
 func Open(dir string) (*Db, error) {
-	return OpenWithMaxSegmentSize(dir, defaultMaxSegmentSize)
+	return OpenWithOptions(dir, Options{})
 }
 
 func OpenWithMaxSegmentSize(dir string, maxSegmentSize int64) (*Db, error) {
-	err := os.MkdirAll(dir, 0755)
+	return OpenWithOptions(dir, Options{MaxSegmentSize: maxSegmentSize})
+}
+
+func OpenWithOptions(dir string, opts Options) (*Db, error) {
+	if opts.FS == nil {
+		opts.FS = osFS{}
+	}
+	err := opts.FS.MkdirAll(dir, 0755)
 	if err != nil {
 		return nil, err
 	}
+	return open(dir, opts, false)
+}
 
-	db := &Db{
-		dir:            dir,
-		maxSegmentSize: maxSegmentSize,
-		index:          make(hashIndex),
-		putChan:        make(chan putRequest, 100), // Buffered channel for better performance
-		stopWriter:     make(chan struct{}),
-		mergeChan:      make(chan struct{}, 1),
-		stopMerge:      make(chan struct{}),
-	}
+// OpenReadOnly opens an existing database for reading only. It never writes
+// to the directory or merges segments and can be used while another process
+// has the database open for writing. The index is built once on open, so
+// records written afterwards are not visible, and reading records a merge
+// has since moved fails. Writes return ErrReadOnly.
+func OpenReadOnly(dir string) (*Db, error) {
+	return OpenReadOnlyWithOptions(dir, Options{})
+}
 
-	// Load existing segments
-	err = db.loadExistingSegments()
+// OpenReadOnlyWithOptions is OpenReadOnly with options, such as the
+// ObjectStore holding the segments the database offloaded, without which
+// only the local ones are read. Options concerning writes are ignored.
+func OpenReadOnlyWithOptions(dir string, opts Options) (*Db, error) {
+	if opts.FS == nil {
+		opts.FS = osFS{}
+	}
+	info, err := opts.FS.Stat(dir)
 	if err != nil {
 		return nil, err
 	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return open(dir, opts, true)
+}
 
-	// Create or open active segment
-	err = db.openActiveSegment()
+func open(dir string, opts Options, readOnly bool) (*Db, error) {
+	if opts.MaxSegmentSize <= 0 {
+		opts.MaxSegmentSize = defaultMaxSegmentSize
+	}
+	if opts.MaxVersions < 1 {
+		opts.MaxVersions = 1
+	}
+	if opts.IndexWorkers <= 0 {
+		opts.IndexWorkers = runtime.NumCPU()
+	}
+	if opts.WriteQueueSize <= 0 {
+		opts.WriteQueueSize = defaultWriteQueueSize
+	}
+	if opts.AdmissionTimeout <= 0 {
+		opts.AdmissionTimeout = defaultAdmissionTimeout
+	}
+	if opts.LocalSegments <= 0 {
+		opts.LocalSegments = defaultLocalSegments
+	}
+	if opts.IndexCacheSize <= 0 {
+		opts.IndexCacheSize = defaultIndexCacheSize
+	}
+	if err := applyLimitDefaults(&opts); err != nil {
+		return nil, err
+	}
+	secondary, err := newSecondaryIndexes(opts.Indexes)
 	if err != nil {
 		return nil, err
 	}
 
-	// Rebuild index from all segments
-	err = db.rebuildIndex()
+	// Fail fast instead of corrupting a directory another process writes to
+	var lock *dirLock
+	if readOnly {
+		lock, err = lockForRead(opts.FS, dir)
+	} else {
+		lock, err = lockForWrite(opts.FS, dir)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	db := &Db{
+		fs:               opts.FS,
+		dir:              dir,
+		readOnly:         readOnly,
+		lock:             lock,
+		maxSegmentSize:   opts.MaxSegmentSize,
+		maxVersions:      opts.MaxVersions,
+		versionRetention: opts.VersionRetention,
+		maxKeySize:       opts.MaxKeySize,
+		maxValueSize:     opts.MaxValueSize,
+		indexWorkers:     opts.IndexWorkers,
+		objects:          opts.ObjectStore,
+		localSegments:    opts.LocalSegments,
+		indexOnDisk:      opts.IndexOnDisk && !readOnly,
+		indexCacheSize:   opts.IndexCacheSize,
+		index:            newShardedIndex(indexShardCount),
+		activeSeqs:       unboundedRange,
+		secondary:        secondary,
+		snapshots:        make(map[*Snapshot]struct{}),
+		drops:            make(map[string][]dropMarker),
+		admission:        opts.Admission,
+		admissionTimeout: opts.AdmissionTimeout,
+		putChan:        make(chan putRequest, opts.WriteQueueSize), // Buffered channel for better performance
+		stopWriter:     make(chan struct{}),
+		mergeChan:      make(chan struct{}, 1),
+		stopMerge:      make(chan struct{}),
+	}
+
+	if opts.CompactIndex {
+		db.index = newCompactIndex(indexShardCount)
+	}
+
+	if err := db.load(); err != nil {
+		if db.out != nil {
+			db.out.Close()
+		}
+		db.index.close()
+		lock.release()
+		return nil, err
+	}
+
+	if readOnly {
+		return db, nil
+	}
+
 	// Start writer goroutine
 	db.writerWG.Add(1)
 	go db.writerLoop()
@@ -133,8 +420,44 @@ func OpenWithMaxSegmentSize(dir string, maxSegmentSize int64) (*Db, error) {
 	return db, nil
 }
 
+// load reads the segment files of the directory and builds the indexes.
+func (db *Db) load() error {
+	// Load existing segments
+	err := db.loadExistingSegments()
+	if err != nil {
+		return err
+	}
+
+	// Rebuild index from all segments, unless kept on disk since a clean
+	// close
+	rebuild := true
+	if db.indexOnDisk {
+		trusted, err := db.openDiskIndex()
+		if err != nil {
+			return err
+		}
+		rebuild = !trusted
+	}
+	if rebuild {
+		err = db.rebuildIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Create or open active segment, after indexing has cut off any torn
+	// record at its end
+	if !db.readOnly {
+		err = db.openActiveSegment()
+		if err != nil {
+			return err
+		}
+	}
+	return db.rebuildSecondaryIndexes()
+}
+
 func (db *Db) loadExistingSegments() error {
-	entries, err := os.ReadDir(db.dir)
+	entries, err := db.fs.ReadDir(db.dir)
 	if err != nil {
 		return err
 	}
@@ -149,10 +472,16 @@ func (db *Db) loadExistingSegments() error {
 			// Extract segment ID
 			idStr := strings.TrimPrefix(name, segmentFilePrefix)
 			if id, err := strconv.Atoi(idStr); err == nil {
+				info, err := entry.Info()
+				if err != nil {
+					return err
+				}
 				segmentInfos = append(segmentInfos, segmentInfo{
 					id:       id,
 					filePath: filepath.Join(db.dir, name),
 					readOnly: true,
+					size:     info.Size(),
+					seqs:     unboundedRange,
 				})
 				if id > maxSegmentID {
 					maxSegmentID = id
@@ -163,6 +492,25 @@ func (db *Db) loadExistingSegments() error {
 		}
 	}
 
+	// Offloaded segments, unless a local copy is left from an offload
+	// interrupted before its removal
+	if db.objects != nil {
+		local := make(map[int]bool)
+		for _, seg := range segmentInfos {
+			local[seg.id] = true
+		}
+		remote, err := db.remoteSegments(local)
+		if err != nil {
+			return err
+		}
+		for _, seg := range remote {
+			segmentInfos = append(segmentInfos, seg)
+			if seg.id > maxSegmentID {
+				maxSegmentID = seg.id
+			}
+		}
+	}
+
 	// Sort segments by ID (not by name)
 	sort.Slice(segmentInfos, func(i, j int) bool {
 		return segmentInfos[i].id < segmentInfos[j].id
@@ -188,114 +536,213 @@ func (db *Db) loadExistingSegments() error {
 
 func (db *Db) openActiveSegment() error {
 	outputPath := filepath.Join(db.dir, outFileName)
-	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	f, size, err := openSegmentForAppend(db.fs, outputPath)
 	if err != nil {
 		return err
 	}
 
-	// Get current size
-	stat, err := f.Stat()
-	if err != nil {
-		f.Close()
-		return err
-	}
-
 	db.out = f
-	db.outOffset = stat.Size()
+	db.outOffset.Store(size)
 
 	return nil
 }
 
+// rebuildIndex fills the index from all segment files. It runs on open,
+// before the database is shared.
 func (db *Db) rebuildIndex() error {
-	// Create a list of all segments including active segment
-	type segmentToIndex struct {
-		id       int
-		filePath string
-	}
-	
-	var allSegments []segmentToIndex
-	
-	// Get segments info safely
+	// Create a list of all segments including active segment; read-only
+	// opens may find none
 	db.segmentMu.RLock()
-	// Add read-only segments
-	for _, seg := range db.segments {
-		allSegments = append(allSegments, segmentToIndex{
-			id:       seg.id,
-			filePath: seg.filePath,
-		})
-	}
-	
-	// Add active segment if exists
+	allSegments := db.allSegments()
 	activeID := db.activeSegmentID
 	db.segmentMu.RUnlock()
 	
-	if db.out != nil {
-		allSegments = append(allSegments, segmentToIndex{
-			id:       activeID,
-			filePath: filepath.Join(db.dir, outFileName),
-		})
-	}
-	
 	// Sort by segment ID (older segments first, newer segments last)
 	sort.Slice(allSegments, func(i, j int) bool {
 		return allSegments[i].id < allSegments[j].id
 	})
 	
-	// Build new index
-	newIndex := make(hashIndex)
-	
-	// Index segments in order - newer entries will override older ones
-	for _, seg := range allSegments {
-		err := db.indexSegmentFile(seg.filePath, seg.id, newIndex)
-		if err != nil {
-			return fmt.Errorf("failed to index segment %d (%s): %w", seg.id, seg.filePath, err)
+	// Scan the segments concurrently, then combine the partial indexes in
+	// segment order so that newer entries win exactly as if the segments
+	// had been indexed one after another
+	results := make([]chan segmentIndexResult, len(allSegments))
+	for i := range results {
+		results[i] = make(chan segmentIndexResult, 1)
+	}
+	jobs := make(chan int)
+	stop := make(chan struct{})
+	var workers sync.WaitGroup
+	for w := 0; w < db.indexWorkers && w < len(allSegments); w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range jobs {
+				seg := allSegments[i]
+				partial, err := db.indexSegmentFile(seg, seg.id == activeID)
+				results[i] <- segmentIndexResult{partial, err}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for i := range allSegments {
+			select {
+			case jobs <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	// On error, let the workers finish the segments they are on
+	defer workers.Wait()
+	defer close(stop)
+
+	drops := make(map[string]uint64)
+	ranges := make([]seqRange, len(allSegments))
+	var maxSeq uint64
+	var maxTimestamp int64
+	for i, seg := range allSegments {
+		res := <-results[i]
+		if res.err != nil {
+			return fmt.Errorf("failed to index segment %d (%s): %w", seg.id, seg.filePath, res.err)
+		}
+		partial := res.partial
+
+		for key, location := range partial.entries {
+			// Sequence numbers decide rather than segment order, so a
+			// segment left behind by an interrupted merge cannot shadow
+			// newer data; records without one fall back to order.
+			if current, ok := db.index.get(key); !ok || location.seq >= current.seq {
+				db.index.set(key, location)
+			}
+		}
+		for prefix, markers := range partial.drops {
+			db.addDrops(prefix, markers...)
+			if last := markers[len(markers)-1].Seq; last > drops[prefix] {
+				drops[prefix] = last
+			}
+		}
+		ranges[i] = partial.seqs
+		if partial.seqs.MaxSeq > maxSeq {
+			maxSeq = partial.seqs.MaxSeq
+		}
+		if partial.seqs.MaxTimestamp > maxTimestamp {
+			maxTimestamp = partial.seqs.MaxTimestamp
 		}
 	}
 
-	// Update index atomically
-	db.indexMu.Lock()
-	db.index = newIndex
-	db.indexMu.Unlock()
+	if len(drops) > 0 {
+		batch := db.index.lockAll()
+		batch.dropBuckets(drops)
+		batch.unlock()
+	}
 
-	return nil
+	// Recover the sequence counter, never moving it backwards
+	if maxSeq > db.lastSeq.Load() {
+		db.lastSeq.Store(maxSeq)
+	}
+	if maxTimestamp > db.lastTimestamp {
+		db.lastTimestamp = maxTimestamp
+	}
+
+	db.segmentMu.Lock()
+	for i, seg := range allSegments {
+		if seg.id == activeID {
+			// The active segment also takes the records written from now on
+			seqs := openRange(db.lastSeq.Load()+1, db.lastTimestamp)
+			seqs.MinSeq = min(seqs.MinSeq, ranges[i].MinSeq)
+			seqs.MinTimestamp = min(seqs.MinTimestamp, ranges[i].MinTimestamp)
+			db.activeSeqs = seqs
+			continue
+		}
+		for j := range db.segments {
+			if db.segments[j].id == seg.id {
+				db.segments[j].seqs = ranges[i]
+			}
+		}
+	}
+	db.segmentMu.Unlock()
+
+	return db.index.err()
+}
+
+// segmentIndex is the partial index built from a single segment file.
+type segmentIndex struct {
+	entries      hashIndex
+	drops        map[string][]dropMarker // by bucket key prefix, in file order
+	seqs         seqRange
 }
 
-func (db *Db) indexSegmentFile(filePath string, segmentID int, index hashIndex) error {
-	file, err := os.Open(filePath)
+type segmentIndexResult struct {
+	partial *segmentIndex
+	err     error
+}
+
+// indexSegmentFile builds the partial index of a segment file, holding the
+// latest record of every key in it, its bucket drop markers and the range of
+// sequence numbers and timestamps found. A record cut short at the end of the
+// active segment was never acknowledged; it ends the scan and is cut off
+// unless opened read-only.
+func (db *Db) indexSegmentFile(seg segmentInfo, active bool) (*segmentIndex, error) {
+	partial := &segmentIndex{
+		entries: make(hashIndex),
+		drops:   make(map[string][]dropMarker),
+		seqs:    emptyRange,
+	}
+
+	file, reader, err := db.openSegment(seg)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil // Skip non-existent files
+			return partial, nil // Skip non-existent files
 		}
-		return err
+		return nil, err
 	}
 	defer file.Close()
 
-	reader := bufio.NewReader(file)
-	offset := int64(0)
-
+	offset := int64(segmentHeaderSize)
 	for {
 		var record entry
 		n, err := record.DecodeFromReader(reader)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				if n != 0 {
-					return fmt.Errorf("corrupted segment file %s", filePath)
+				break
+			}
+			if active && errors.Is(err, io.ErrUnexpectedEOF) {
+				if !db.readOnly {
+					if err := truncateFile(db.fs, seg.filePath, offset); err != nil {
+						return nil, err
+					}
 				}
 				break
 			}
-			return err
+			return nil, fmt.Errorf("corrupted segment file %s at offset %d: %w", seg.filePath, offset, err)
 		}
 
-		// Update index (latest entry wins)
-		index[record.key] = indexEntry{
-			segmentID: segmentID,
-			offset:    offset,
+		partial.seqs.add(&record)
+
+		if record.valueType == typeDropBucket {
+			partial.drops[record.key] = append(partial.drops[record.key], dropMarker{
+				Seq:       record.seq,
+				Timestamp: record.timestamp,
+			})
+			offset += int64(n)
+			continue
 		}
-		
+
+		// Latest entry wins, by sequence number and then by file order
+		if current, ok := partial.entries[record.key]; !ok || record.seq >= current.seq {
+			partial.entries[record.key] = indexEntry{
+				segmentID: seg.id,
+				offset:    offset,
+				seq:       record.seq,
+				size:      uint32(n),
+			}
+		}
+
 		offset += int64(n)
 	}
 
-	return nil
+	return partial, nil
 }
 
 func (db *Db) writerLoop() {
@@ -304,27 +751,43 @@ func (db *Db) writerLoop() {
 	for {
 		select {
 		case <-db.stopWriter:
-			return
-			
+			// Write what was queued before Close. Merges not started yet
+			// are skipped, there is nothing left to wait for.
+			for {
+				select {
+				case req := <-db.putChan:
+					if req.kind == requestMerge {
+						req.result <- putResult{err: ErrClosed}
+						continue
+					}
+					db.serve(req)
+				default:
+					return
+				}
+			}
+
 		case req := <-db.putChan:
-			err := db.handlePut(req)
-			req.result <- err
+			db.serve(req)
 		}
 	}
 }
 
-func (db *Db) handlePut(req putRequest) error {
-	// Handle special merge request
-	if req.key == "__MERGE__" {
-		return db.mergeSegments()
+// serve handles a request on the writer goroutine and sends its result.
+func (db *Db) serve(req putRequest) {
+	if req.ctx != nil && req.ctx.Err() != nil {
+		req.result <- putResult{err: req.ctx.Err()}
+		return
 	}
+	seq, err := db.handlePut(req)
+	req.result <- putResult{seq: seq, err: err}
+}
 
-	// Check if we need to rotate segment
-	if db.outOffset >= db.maxSegmentSize {
-		err := db.rotateActiveSegment()
-		if err != nil {
-			return err
-		}
+func (db *Db) handlePut(req putRequest) (uint64, error) {
+	switch req.kind {
+	case requestMerge:
+		return 0, db.runMerge()
+	case requestCommit:
+		return db.handleCommit(req)
 	}
 
 	// Create entry based on type
@@ -343,35 +806,140 @@ func (db *Db) handlePut(req putRequest) error {
 			int64Value: req.int64Value,
 		}
 	default:
-		return fmt.Errorf("unsupported value type: %d", req.valueType)
+		return 0, fmt.Errorf("unsupported value type: %d", req.valueType)
+	}
+
+	return db.appendEntries([]entry{e})
+}
+
+// appendEntries stamps records with consecutive sequence numbers, writes them
+// to the active segment with a single write and indexes them. It returns the
+// sequence number of the last record and must run on the writer goroutine.
+func (db *Db) appendEntries(entries []entry) (uint64, error) {
+	if db.writeErr != nil {
+		return 0, db.writeErr
+	}
+
+	// Reopen the active segment if a failed rotation left none
+	if db.out == nil {
+		if err := db.openActiveSegment(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Check if we need to rotate segment
+	if db.outOffset.Load() >= db.maxSegmentSize {
+		err := db.rotateActiveSegment()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Stamp the records with the next sequence numbers and a timestamp that
+	// never goes backwards, so versions can be looked up by time
+	seq := db.lastSeq.Load()
+	timestamp := time.Now().UnixNano()
+	if timestamp < db.lastTimestamp {
+		timestamp = db.lastTimestamp
 	}
 
 	// Remember current offset for index
-	currentOffset := db.outOffset
+	currentOffset := db.outOffset.Load()
+
+	var data []byte
+	offsets := make([]int64, len(entries))
+	sizes := make([]uint32, len(entries))
+	for i := range entries {
+		seq++
+		entries[i].seq = seq
+		entries[i].timestamp = timestamp
+		offsets[i] = currentOffset + int64(len(data))
+		record := entries[i].Encode()
+		sizes[i] = uint32(len(record))
+		data = append(data, record...)
+	}
 
-	// Write to active segment
-	data := e.Encode()
+	// Write to active segment. A failed write must not leave part of a
+	// record behind: later records would be appended after it and the
+	// segment could not be read past it.
 	n, err := db.out.Write(data)
 	if err != nil {
-		return err
+		if n > 0 {
+			if truncErr := db.out.Truncate(currentOffset); truncErr != nil {
+				db.writeErr = fmt.Errorf("active segment holds a partial record: %w", truncErr)
+			}
+		}
+		return 0, err
 	}
 
-	// Get current active segment ID for index update
-	db.segmentMu.RLock()
+	// Only the writer goroutine changes the active segment ID, so it can
+	// be read here without segmentMu
 	currentActiveID := db.activeSegmentID
-	db.segmentMu.RUnlock()
 
-	// Update index atomically
-	db.indexMu.Lock()
-	db.index[req.key] = indexEntry{
-		segmentID: currentActiveID,
-		offset:    currentOffset,
+	secondaryUpdates := db.secondaryUpdates(entries)
+
+	// Record drops before their keys leave the index, so that reads of
+	// older versions missing a key know to look for it
+	for _, e := range entries {
+		if e.valueType == typeDropBucket {
+			db.addDrops(e.key, dropMarker{Seq: e.seq, Timestamp: e.timestamp})
+		}
 	}
-	db.indexMu.Unlock()
+
+	// Update the index atomically: readers see all records of the batch or
+	// none of them
+	batch := db.lockIndexFor(entries)
+	if secondaryUpdates != nil {
+		db.secondaryMu.Lock()
+	}
+	for i, e := range entries {
+		if e.valueType == typeDropBucket {
+			batch.dropBuckets(map[string]uint64{e.key: e.seq})
+			db.dropSecondaryBucket(e.key)
+			continue
+		}
+		if secondaryUpdates != nil {
+			for _, u := range secondaryUpdates[i] {
+				u.index.set(u)
+			}
+		}
+		batch.set(e.key, indexEntry{
+			segmentID: currentActiveID,
+			offset:    offsets[i],
+			seq:       e.seq,
+			size:      sizes[i],
+		})
+	}
+	if secondaryUpdates != nil {
+		db.secondaryMu.Unlock()
+	}
+	batch.unlock()
 	
-	db.outOffset += int64(n)
+	db.outOffset.Add(int64(n))
+	db.lastTimestamp = timestamp
+	db.lastSeq.Store(seq)
+
+	// The records are stored but an index on disk may have failed to take
+	// them
+	if err := db.index.err(); err != nil {
+		db.writeErr = err
+		return 0, err
+	}
 
-	return nil
+	return seq, nil
+}
+
+// lockIndexFor locks the index shards the records of a batch touch, or all
+// of them if the batch drops a bucket.
+func (db *Db) lockIndexFor(entries []entry) *indexBatch {
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		if e.valueType == typeDropBucket {
+			return db.index.lockAll()
+		}
+		keys[i] = e.key
+	}
+	return db.index.lock(keys)
 }
 
 func (db *Db) rotateActiveSegment() error {
@@ -379,31 +947,40 @@ func (db *Db) rotateActiveSegment() error {
 		return nil
 	}
 
-	// Close current active segment
+	// Close current active segment. Until a new one is open, the next
+	// write reopens whatever current-data is there.
 	db.out.Close()
+	db.out = nil
 
-	// Get current active segment ID
-	db.segmentMu.RLock()
+	// Readers resolve segment paths under segmentMu, so the file is renamed
+	// and the active ID advanced in one critical section
+	db.segmentMu.Lock()
 	currentActiveID := db.activeSegmentID
-	db.segmentMu.RUnlock()
 
 	// Move to read-only segment
 	oldPath := filepath.Join(db.dir, outFileName)
 	newPath := filepath.Join(db.dir, fmt.Sprintf("%s%d", segmentFilePrefix, currentActiveID))
 	
-	err := os.Rename(oldPath, newPath)
+	err := db.fs.Rename(oldPath, newPath)
 	if err != nil {
+		db.segmentMu.Unlock()
 		return err
 	}
 
-	// Update segments list and active ID
-	db.segmentMu.Lock()
+	// Update segments list and active ID. Only the writer goroutine stamps
+	// records, so the sealed segment ends with the last one.
+	sealed := db.activeSeqs
+	sealed.MaxSeq = db.lastSeq.Load()
+	sealed.MaxTimestamp = db.lastTimestamp
 	db.segments = append(db.segments, segmentInfo{
 		id:       currentActiveID,
 		filePath: newPath,
 		readOnly: true,
+		size:     db.outOffset.Load(),
+		seqs:     sealed,
 	})
 	db.activeSegmentID++
+	db.activeSeqs = openRange(sealed.MaxSeq+1, sealed.MaxTimestamp)
 	db.segmentMu.Unlock()
 
 	// Create new active segment
@@ -421,54 +998,60 @@ func (db *Db) rotateActiveSegment() error {
 	return nil
 }
 
+// Close stops accepting operations, which fail with ErrClosed from then
+// on, writes the requests already queued, lets a merge in progress finish
+// and closes the database. Calling Close again does nothing.
 func (db *Db) Close() error {
-	// Stop writer goroutine
-	close(db.stopWriter)
-	db.writerWG.Wait()
+	db.closeMu.Lock()
+	if db.closed.Load() {
+		db.closeMu.Unlock()
+		return nil
+	}
+	db.closed.Store(true)
+	db.closeMu.Unlock()
+
+	defer db.lock.release()
+
+	if db.readOnly {
+		return nil
+	}
 
-	// Stop merge process
+	// Stop merge process first: an in-flight merge waits for the writer
 	close(db.stopMerge)
 	db.mergeWG.Wait()
 
+	// Stop writer goroutine once the queue is drained
+	close(db.stopWriter)
+	db.writerWG.Wait()
+
 	// Close active segment
+	var err error
 	if db.out != nil {
-		return db.out.Close()
+		err = db.out.Close()
 	}
-	
-	return nil
+
+	// Let the next open reuse an index kept on disk
+	if db.indexOnDisk && err == nil {
+		err = db.saveDiskIndex()
+	}
+	if closeErr := db.index.close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 func (db *Db) Get(key string) (string, error) {
-	// Get index entry with read lock (non-blocking for other readers)
-	db.indexMu.RLock()
-	indexEntry, ok := db.index[key]
-	db.indexMu.RUnlock()
+	return db.GetContext(context.Background(), key)
+}
 
-	if !ok {
+// GetContext is Get that gives up with ctx.Err() once ctx is done.
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	// Keys with NUL bytes belong to buckets
+	if !validKey(key) {
 		return "", ErrNotFound
 	}
 
-	// Get current active segment ID safely
-	db.segmentMu.RLock()
-	currentActiveID := db.activeSegmentID
-	db.segmentMu.RUnlock()
-
-	// Determine which file to read from
-	var filePath string
-	if indexEntry.segmentID == currentActiveID {
-		filePath = filepath.Join(db.dir, outFileName)
-	} else {
-		filePath = filepath.Join(db.dir, fmt.Sprintf("%s%d", segmentFilePrefix, indexEntry.segmentID))
-	}
-
-	// Open file for reading (each Get creates its own file descriptor)
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	record, err := db.readEntryFromFile(file, indexEntry.offset)
+	record, err := db.readLatest(ctx, key)
 	if err != nil {
 		return "", err
 	}
@@ -482,49 +1065,114 @@ func (db *Db) Get(key string) (string, error) {
 }
 
 func (db *Db) GetInt64(key string) (int64, error) {
-	// Get index entry with read lock (non-blocking for other readers)
-	db.indexMu.RLock()
-	indexEntry, ok := db.index[key]
-	db.indexMu.RUnlock()
+	return db.GetInt64Context(context.Background(), key)
+}
 
-	if !ok {
+// GetInt64Context is GetInt64 that gives up with ctx.Err() once ctx is done.
+func (db *Db) GetInt64Context(ctx context.Context, key string) (int64, error) {
+	// Keys with NUL bytes belong to buckets
+	if !validKey(key) {
 		return 0, ErrNotFound
 	}
 
-	// Get current active segment ID safely
+	record, err := db.readLatest(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	// Check if the stored value is an int64
+	if record.valueType != TypeInt64 {
+		return 0, ErrTypeMismatch
+	}
+
+	return record.int64Value, nil
+}
+
+// readLatest reads the most recent record stored for key.
+func (db *Db) readLatest(ctx context.Context, key string) (*entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	// Hold the segment lock for the whole local read so that rotation and
+	// merges cannot move the record between the index lookup and the file
+	// read
 	db.segmentMu.RLock()
-	currentActiveID := db.activeSegmentID
+
+	// Waiting for a merge to finish may have taken a while
+	if err := ctx.Err(); err != nil {
+		db.segmentMu.RUnlock()
+		return nil, err
+	}
+
+	indexEntry, ok := db.index.get(key)
+	if err := db.index.err(); err != nil {
+		db.segmentMu.RUnlock()
+		return nil, err
+	}
+
+	if !ok {
+		db.segmentMu.RUnlock()
+		return nil, ErrNotFound
+	}
+
+	seg, remote := db.remoteSegment(indexEntry.segmentID)
+	if !remote {
+		defer db.segmentMu.RUnlock()
+		return db.readIndexedEntry(indexEntry)
+	}
+
+	// Records are fetched from the object store without holding up
+	// rotation and merges. A merge may replace the object meanwhile, in
+	// which case the read starts over from the index.
 	db.segmentMu.RUnlock()
+	record, err := db.readRemoteEntry(seg, indexEntry)
+	if err == nil && record.key == key && record.seq == indexEntry.seq {
+		return record, nil
+	}
+	db.segmentMu.RLock()
+	current, _ := db.index.get(key)
+	_, stillRemote := db.remoteSegment(seg.id)
+	db.segmentMu.RUnlock()
+	if current != indexEntry || !stillRemote {
+		return db.readLatest(ctx, key)
+	}
+	if err == nil {
+		err = fmt.Errorf("segment %d holds no record of key %q at offset %d", seg.id, key, indexEntry.offset)
+	}
+	return nil, err
+}
 
-	// Determine which file to read from
-	var filePath string
-	if indexEntry.segmentID == currentActiveID {
-		filePath = filepath.Join(db.dir, outFileName)
-	} else {
-		filePath = filepath.Join(db.dir, fmt.Sprintf("%s%d", segmentFilePrefix, indexEntry.segmentID))
+// readIndexedEntry reads the record an index entry points to. The caller
+// must hold segmentMu.
+func (db *Db) readIndexedEntry(indexEntry indexEntry) (*entry, error) {
+	if seg, ok := db.remoteSegment(indexEntry.segmentID); ok {
+		return db.readRemoteEntry(seg, indexEntry)
 	}
 
 	// Open file for reading (each Get creates its own file descriptor)
-	file, err := os.Open(filePath)
+	file, err := openFile(db.fs, db.segmentPath(indexEntry.segmentID))
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	defer file.Close()
 
-	record, err := db.readEntryFromFile(file, indexEntry.offset)
-	if err != nil {
-		return 0, err
-	}
+	return db.readEntryFromFile(file, indexEntry.offset)
+}
 
-	// Check if the stored value is an int64
-	if record.valueType != TypeInt64 {
-		return 0, ErrTypeMismatch
+// segmentPath returns the file holding the segment with the given ID. The
+// caller must hold segmentMu.
+func (db *Db) segmentPath(segmentID int) string {
+	if segmentID == db.activeSegmentID {
+		return filepath.Join(db.dir, outFileName)
 	}
-
-	return record.int64Value, nil
+	return filepath.Join(db.dir, fmt.Sprintf("%s%d", segmentFilePrefix, segmentID))
 }
 
-func (db *Db) readEntryFromFile(file *os.File, offset int64) (*entry, error) {
+func (db *Db) readEntryFromFile(file File, offset int64) (*entry, error) {
 	// Seek to position
 	_, err := file.Seek(offset, 0)
 	if err != nil {
@@ -541,32 +1189,107 @@ func (db *Db) readEntryFromFile(file *os.File, offset int64) (*entry, error) {
 	return &record, nil
 }
 
-func (db *Db) Put(key, value string) error {
+// Put stores a string value and returns the sequence number assigned to
+// the written record. Empty keys and keys or values over the configured
+// size limits are rejected with ErrEmptyKey, ErrKeyTooLarge or
+// ErrValueTooLarge.
+func (db *Db) Put(key, value string) (uint64, error) {
+	return db.PutContext(context.Background(), key, value)
+}
+
+// PutContext is Put that gives up with ctx.Err() once ctx is done, whether
+// the write is still queued for the writer or being written. A write given
+// up on while being written may still be stored.
+func (db *Db) PutContext(ctx context.Context, key, value string) (uint64, error) {
+	if err := db.checkWrite(key, &entry{valueType: TypeString, stringValue: value}); err != nil {
+		return 0, err
+	}
+
 	// Send request to writer goroutine
 	req := putRequest{
 		key:       key,
 		value:     value,
 		valueType: TypeString,
-		result:    make(chan error),
+		result:    make(chan putResult, 1),
 	}
 	
-	db.putChan <- req
-	return <-req.result
+	res := db.send(ctx, req)
+	return res.seq, res.err
+}
+
+// PutInt64 stores an int64 value and returns the sequence number assigned
+// to the written record.
+func (db *Db) PutInt64(key string, value int64) (uint64, error) {
+	return db.PutInt64Context(context.Background(), key, value)
 }
 
-func (db *Db) PutInt64(key string, value int64) error {
+// PutInt64Context is PutInt64 that gives up with ctx.Err() once ctx is done,
+// with the same guarantees as PutContext.
+func (db *Db) PutInt64Context(ctx context.Context, key string, value int64) (uint64, error) {
+	if err := db.checkWrite(key, &entry{valueType: TypeInt64}); err != nil {
+		return 0, err
+	}
+
 	// Send request to writer goroutine
 	req := putRequest{
 		key:        key,
 		int64Value: value,
 		valueType:  TypeInt64,
-		result:     make(chan error),
+		result:     make(chan putResult, 1),
 	}
 	
-	db.putChan <- req
-	return <-req.result
+	res := db.send(ctx, req)
+	return res.seq, res.err
+}
+
+// send hands a request to the writer goroutine and waits for its result,
+// unless ctx is done first. req.result must be buffered so that the writer
+// does not block on a request given up on.
+func (db *Db) send(ctx context.Context, req putRequest) putResult {
+	if err := db.enqueue(ctx, req); err != nil {
+		return putResult{err: err}
+	}
+
+	select {
+	case res := <-req.result:
+		return res
+	case <-ctx.Done():
+		return putResult{err: ctx.Err()}
+	}
 }
 
+// enqueue queues a request for the writer goroutine. If the queue is full
+// the admission policy decides whether to wait for room, unless ctx is done
+// first. The writer handles requests in the order they were queued.
+func (db *Db) enqueue(ctx context.Context, req putRequest) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	if db.closed.Load() {
+		return ErrClosed
+	}
+
+	req.ctx = ctx
+	select {
+	case db.putChan <- req:
+		return nil
+	default:
+		return db.admit(ctx, req)
+	}
+}
+
+// LastSeq returns the sequence number of the most recently written record.
+// Sequence numbers are assigned by the writer goroutine, start at 1 and
+// grow monotonically across restarts; zero means nothing has been written.
+func (db *Db) LastSeq() uint64 {
+	return db.lastSeq.Load()
+}
+
+// Size returns the bytes taken by the segment files on local disk.
+// Segments offloaded to the object store are not counted.
 func (db *Db) Size() (int64, error) {
 	// Get current segment list
 	db.segmentMu.RLock()
@@ -578,7 +1301,10 @@ func (db *Db) Size() (int64, error) {
 
 	// Size of read-only segments
 	for _, seg := range segments {
-		stat, err := os.Stat(seg.filePath)
+		if seg.remote {
+			continue
+		}
+		stat, err := db.fs.Stat(seg.filePath)
 		if err != nil {
 			if !os.IsNotExist(err) {
 				return 0, err
@@ -590,7 +1316,7 @@ func (db *Db) Size() (int64, error) {
 
 	// Size of active segment
 	activePath := filepath.Join(db.dir, outFileName)
-	stat, err := os.Stat(activePath)
+	stat, err := db.fs.Stat(activePath)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return 0, err
@@ -614,13 +1340,19 @@ func (db *Db) mergeLoop() {
 			return
 		case <-ticker.C:
 			db.tryMerge()
+			db.tryOffload()
 		case <-db.mergeChan:
 			db.tryMerge()
+			db.tryOffload()
 		}
 	}
 }
 
 func (db *Db) tryMerge() {
+	if db.closed.Load() {
+		return
+	}
+
 	// Check if merge is needed without blocking writers
 	db.segmentMu.RLock()
 	segmentCount := len(db.segments)
@@ -633,36 +1365,35 @@ func (db *Db) tryMerge() {
 
 	// Send merge request to writer goroutine to avoid concurrent modifications
 	req := putRequest{
-		key:       "__MERGE__",
-		valueType: TypeString, // doesn't matter for merge
-		result:    make(chan error),
+		kind:   requestMerge,
+		result: make(chan putResult),
 	}
 	
+	// A failure is recorded in the merge statistics
 	select {
 	case db.putChan <- req:
-		err := <-req.result
-		if err != nil {
-			// Log error but don't crash (comment out for cleaner tests)
-			// fmt.Printf("Merge failed: %v\n", err)
-		}
+		<-req.result
 	default:
 		// Writer is busy, skip merge
 	}
 }
 
 func (db *Db) mergeSegments() error {
-	// Get segments to merge safely
+	// Get segments to merge safely. Offloaded segments are fetched from
+	// the object store like local ones are read.
 	db.segmentMu.RLock()
 	segmentsToMerge := make([]segmentInfo, len(db.segments))
 	copy(segmentsToMerge, db.segments)
 	db.segmentMu.RUnlock()
 
-	// Collect all key-value pairs from read-only segments
-	keyEntries := make(map[string]entry)
+	// Collect every version of every key from read-only segments, and the
+	// drop markers of every bucket
+	keyVersions := make(map[string][]mergeRecord)
+	drops := make(map[string][]mergeRecord)
 	
 	// Process segments in order (oldest first, newest last)
-	for _, seg := range segmentsToMerge {
-		file, err := os.Open(seg.filePath)
+	for i, seg := range segmentsToMerge {
+		file, reader, err := db.openSegment(seg)
 		if err != nil {
 			if os.IsNotExist(err) {
 				continue
@@ -670,10 +1401,10 @@ func (db *Db) mergeSegments() error {
 			return err
 		}
 		
-		reader := bufio.NewReader(file)
+		offset := int64(segmentHeaderSize)
 		for {
-			var record entry
-			_, err := record.DecodeFromReader(reader)
+			record := mergeRecord{segment: i, offset: offset}
+			n, err := record.DecodeFromReader(reader)
 			if err != nil {
 				if errors.Is(err, io.EOF) {
 					break
@@ -681,66 +1412,185 @@ func (db *Db) mergeSegments() error {
 				file.Close()
 				return err
 			}
-			// Keep latest entry for each key (preserves type and value)
-			keyEntries[record.key] = record
+			offset += int64(n)
+			if record.valueType == typeDropBucket {
+				drops[record.key] = append(drops[record.key], record)
+				continue
+			}
+			keyVersions[record.key] = append(keyVersions[record.key], record)
 		}
 		file.Close()
 	}
 
-	if len(keyEntries) == 0 {
+	if len(keyVersions) == 0 && len(drops) == 0 {
 		return nil // Nothing to merge
 	}
 
+	dropSeqs := make(map[string][]uint64)
+	for prefix, markers := range drops {
+		sort.Slice(markers, func(i, j int) bool {
+			return markers[i].seq < markers[j].seq
+		})
+		for _, marker := range markers {
+			dropSeqs[prefix] = append(dropSeqs[prefix], marker.seq)
+		}
+	}
+
+	// Keep the versions required by the retention policy and open
+	// snapshots. Dropping a bucket ends the versions of its keys like
+	// writing newer ones would.
+	now := time.Now()
+	pinned := db.pinnedSeqs()
+	var merged []mergeRecord
+	oldestKept := make(map[string]uint64) // by bucket key prefix
+	for key, versions := range keyVersions {
+		prefix := ""
+		if name, _, ok := splitBucketKey(key); ok {
+			prefix = name + bucketSeparator
+		}
+		kept := db.retainVersions(versions, dropSeqs[prefix], now, pinned)
+		if len(kept) > 0 && prefix != "" {
+			if oldest, ok := oldestKept[prefix]; !ok || kept[0].seq < oldest {
+				oldestKept[prefix] = kept[0].seq
+			}
+		}
+		merged = append(merged, kept...)
+	}
+
+	// The latest drop of a bucket is kept: an older segment left behind by
+	// an interrupted merge must not bring the bucket back. Earlier drops are
+	// kept as long as records written before them are.
+	for prefix, markers := range drops {
+		for i, marker := range markers {
+			if oldest, ok := oldestKept[prefix]; i == len(markers)-1 || (ok && oldest < marker.seq) {
+				merged = append(merged, marker)
+			}
+		}
+	}
+
+	// Write merged data in sequence order so the merged segment keeps the
+	// original write order of the surviving records. Records without
+	// sequence numbers, as migrated from the legacy format, keep the order
+	// they were read in.
+	sort.SliceStable(merged, func(i, j int) bool {
+		a, b := &merged[i], &merged[j]
+		if a.seq != b.seq {
+			return a.seq < b.seq
+		}
+		if a.segment != b.segment {
+			return a.segment < b.segment
+		}
+		return a.offset < b.offset
+	})
+
 	// Create temporary merged file
 	tempPath := filepath.Join(db.dir, "temp-merge")
-	tempFile, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	tempFile, err := db.fs.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
 
-	// Write merged data
-	for _, entryData := range keyEntries {
+	// Write merged data, remembering where the latest version of each key
+	// ends up
+	mergedID := segmentsToMerge[0].id
+	newLocations := make(hashIndex)
+	mergedSeqs := emptyRange
+	offset := int64(segmentHeaderSize)
+	if _, err := tempFile.Write(encodeSegmentHeader()); err != nil {
+		tempFile.Close()
+		db.fs.Remove(tempPath)
+		return err
+	}
+	for _, entryData := range merged {
 		data := entryData.Encode()
 		
 		_, err := tempFile.Write(data)
 		if err != nil {
 			tempFile.Close()
-			os.Remove(tempPath)
+			db.fs.Remove(tempPath)
 			return err
 		}
+
+		mergedSeqs.add(&entryData.entry)
+		newLocations[entryData.key] = indexEntry{
+			segmentID: mergedID,
+			offset:    offset,
+			seq:       entryData.seq,
+			size:      uint32(len(data)),
+		}
+		offset += int64(len(data))
 	}
-	
-	tempFile.Close()
 
-	// Replace first segment with merged file
-	mergedPath := segmentsToMerge[0].filePath
-	
-	// Remove old segments
+	// The merged file replaces segments holding acknowledged writes, so it
+	// has to be complete on disk before the rename
+	err = tempFile.Sync()
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		db.fs.Remove(tempPath)
+		return err
+	}
+
+	mergedIDs := make(map[int]bool)
 	for _, seg := range segmentsToMerge {
-		os.Remove(seg.filePath)
+		mergedIDs[seg.id] = true
 	}
 
-	// Move temp file to merged location
-	err = os.Rename(tempPath, mergedPath)
+	// Swap the files and repoint the index in one critical section so that
+	// readers never see an index entry for a file that has been replaced
+	db.segmentMu.Lock()
+
+	// Replace first segment with merged file
+	mergedPath := segmentsToMerge[0].filePath
+	err = db.fs.Rename(tempPath, mergedPath)
 	if err != nil {
+		db.segmentMu.Unlock()
+		db.fs.Remove(tempPath)
 		return err
 	}
 
-	// Update segments list - keep only the merged segment
-	db.segmentMu.Lock()
-	db.segments = []segmentInfo{{
-		id:       segmentsToMerge[0].id,
+	// Remove the remaining merged local segments
+	for _, seg := range segmentsToMerge[1:] {
+		if !seg.remote {
+			db.fs.Remove(seg.filePath)
+		}
+	}
+
+	// Update segments list - replace the merged segments with the result
+	remaining := []segmentInfo{{
+		id:       mergedID,
 		filePath: mergedPath,
 		readOnly: true,
+		size:     offset,
+		seqs:     mergedSeqs,
 	}}
-	db.segmentMu.Unlock()
+	for _, seg := range db.segments {
+		if !mergedIDs[seg.id] {
+			remaining = append(remaining, seg)
+		}
+	}
+	db.segments = remaining
 
-	// Rebuild index after merge to respect active segment
-	// This ensures newer entries in active segment override merged ones
-	err = db.rebuildIndex()
-	if err != nil {
-		return fmt.Errorf("failed to rebuild index after merge: %w", err)
+	// Repoint keys whose latest version was merged. Keys written to the
+	// active segment since keep their newer index entries.
+	db.index.repoint(newLocations, mergedIDs)
+	db.segmentMu.Unlock()
+	if err := db.index.err(); err != nil {
+		return err
 	}
 
+	// The merged segment is local now, so the objects it replaces only hold
+	// superseded copies of its records. Reads that looked them up before
+	// the swap start over once they are gone. An object left behind by a
+	// failed delete cannot shadow the newer records on the next open.
+	for _, seg := range segmentsToMerge {
+		if !seg.remote {
+			continue
+		}
+		if err := db.objects.Delete(filepath.Base(seg.filePath)); err != nil {
+			return fmt.Errorf("failed to delete offloaded segment %d: %w", seg.id, err)
+		}
+	}
 	return nil
-}
\ No newline at end of file
+}
@@ -1,6 +1,8 @@
 package datastore
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -17,7 +19,7 @@ func TestSegmentedDb_BasicOperations(t *testing.T) {
 	defer db.Close()
 
 	// Test basic put/get
-	err = db.Put("key1", "value1")
+	_, err = db.Put("key1", "value1")
 	if err != nil {
 		t.Fatalf("Failed to put: %v", err)
 	}
@@ -31,7 +33,7 @@ func TestSegmentedDb_BasicOperations(t *testing.T) {
 	}
 
 	// Test key update
-	err = db.Put("key1", "value1_updated")
+	_, err = db.Put("key1", "value1_updated")
 	if err != nil {
 		t.Fatalf("Failed to update: %v", err)
 	}
@@ -65,7 +67,7 @@ func TestSegmentedDb_SegmentCreation(t *testing.T) {
 	for i := 0; i < 15; i++ {
 		key := fmt.Sprintf("key_%d", i)
 		value := fmt.Sprintf("value_%d_with_some_extra_data_to_make_it_larger", i)
-		err = db.Put(key, value)
+		_, err = db.Put(key, value)
 		if err != nil {
 			t.Fatalf("Failed to put %s: %v", key, err)
 		}
@@ -132,7 +134,7 @@ func TestSegmentedDb_PersistenceAcrossRestarts(t *testing.T) {
 		}
 
 		for _, pair := range pairs {
-			err = db.Put(pair[0], pair[1])
+			_, err = db.Put(pair[0], pair[1])
 			if err != nil {
 				t.Fatalf("Failed to put %s: %v", pair[0], err)
 			}
@@ -183,7 +185,7 @@ func TestSegmentedDb_KeyUpdates(t *testing.T) {
 	keys := []string{"update1", "update2", "update3"}
 	for i, key := range keys {
 		value := fmt.Sprintf("initial_value_%d", i)
-		err = db.Put(key, value)
+		_, err = db.Put(key, value)
 		if err != nil {
 			t.Fatalf("Failed to put %s: %v", key, err)
 		}
@@ -192,7 +194,7 @@ func TestSegmentedDb_KeyUpdates(t *testing.T) {
 	// Update values
 	for i, key := range keys {
 		value := fmt.Sprintf("updated_value_%d", i)
-		err = db.Put(key, value)
+		_, err = db.Put(key, value)
 		if err != nil {
 			t.Fatalf("Failed to update %s: %v", key, err)
 		}
@@ -229,7 +231,7 @@ func TestSegmentedDb_LargeDataset(t *testing.T) {
 		value := fmt.Sprintf("large_value_%04d", i)
 		keyValuePairs[key] = value
 		
-		err = db.Put(key, value)
+		_, err = db.Put(key, value)
 		if err != nil {
 			t.Fatalf("Failed to put %s: %v", key, err)
 		}
@@ -241,7 +243,7 @@ func TestSegmentedDb_LargeDataset(t *testing.T) {
 		value := fmt.Sprintf("updated_large_value_%04d", i)
 		keyValuePairs[key] = value
 		
-		err = db.Put(key, value)
+		_, err = db.Put(key, value)
 		if err != nil {
 			t.Fatalf("Failed to update %s: %v", key, err)
 		}
@@ -283,26 +285,23 @@ func TestSegmentedDb_EdgeCases(t *testing.T) {
 	defer db.Close()
 
 	// Test empty key
-	err = db.Put("", "empty_key_value")
-	if err != nil {
-		t.Fatalf("Failed to put empty key: %v", err)
+	_, err = db.Put("", "empty_key_value")
+	if err != ErrEmptyKey {
+		t.Fatalf("Expected ErrEmptyKey, got %v", err)
 	}
 	
-	value, err := db.Get("")
-	if err != nil {
-		t.Fatalf("Failed to get empty key: %v", err)
-	}
-	if value != "empty_key_value" {
-		t.Errorf("Empty key: expected 'empty_key_value', got '%s'", value)
+	_, err = db.Get("")
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for empty key, got %v", err)
 	}
 
 	// Test empty value
-	err = db.Put("empty_value_key", "")
+	_, err = db.Put("empty_value_key", "")
 	if err != nil {
 		t.Fatalf("Failed to put empty value: %v", err)
 	}
 	
-	value, err = db.Get("empty_value_key")
+	value, err := db.Get("empty_value_key")
 	if err != nil {
 		t.Fatalf("Failed to get empty value: %v", err)
 	}
@@ -320,7 +319,7 @@ func TestSegmentedDb_EdgeCases(t *testing.T) {
 	specialKey := "key:with/special\\chars"
 	specialValue := "value with spaces and symbols!@#$%"
 	
-	err = db.Put(specialKey, specialValue)
+	_, err = db.Put(specialKey, specialValue)
 	if err != nil {
 		t.Fatalf("Failed to put special key: %v", err)
 	}
@@ -347,7 +346,7 @@ func TestSegmentedDb_ManualMerge(t *testing.T) {
 	for i := 0; i < 20; i++ {
 		key := fmt.Sprintf("merge_key_%d", i)
 		value := fmt.Sprintf("merge_value_%d_with_extra_data", i)
-		err = db.Put(key, value)
+		_, err = db.Put(key, value)
 		if err != nil {
 			t.Fatalf("Failed to put %s: %v", key, err)
 		}
@@ -357,7 +356,7 @@ func TestSegmentedDb_ManualMerge(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		key := fmt.Sprintf("merge_key_%d", i)
 		value := fmt.Sprintf("updated_merge_value_%d", i)
-		err = db.Put(key, value)
+		_, err = db.Put(key, value)
 		if err != nil {
 			t.Fatalf("Failed to update %s: %v", key, err)
 		}
@@ -398,7 +397,7 @@ func TestSegmentedDb_FileSystemIntegrity(t *testing.T) {
 	for i := 0; i < 25; i++ {
 		key := fmt.Sprintf("integrity_key_%d", i)
 		value := fmt.Sprintf("integrity_value_%d", i)
-		err = db.Put(key, value)
+		_, err = db.Put(key, value)
 		if err != nil {
 			t.Fatalf("Failed to put %s: %v", key, err)
 		}
@@ -442,6 +441,77 @@ func TestSegmentedDb_FileSystemIntegrity(t *testing.T) {
 	t.Logf("Database size after reopen: %d bytes", sizeAfter)
 }
 
+func TestSegmentedDb_SequenceNumbers(t *testing.T) {
+	tmp := t.TempDir()
+
+	db, err := OpenWithMaxSegmentSize(tmp, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every write gets the next sequence number
+	var lastSeq uint64
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("seq_key_%d", i%7)
+		var seq uint64
+		if i%2 == 0 {
+			seq, err = db.Put(key, fmt.Sprintf("seq_value_%d", i))
+		} else {
+			seq, err = db.PutInt64(key, int64(i))
+		}
+		if err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+		if seq != lastSeq+1 {
+			t.Fatalf("Expected sequence number %d, got %d", lastSeq+1, seq)
+		}
+		lastSeq = seq
+	}
+	if db.LastSeq() != lastSeq {
+		t.Errorf("LastSeq() = %d, expected %d", db.LastSeq(), lastSeq)
+	}
+
+	// Merged segments keep records in sequence order
+	db.tryMerge()
+
+	db.segmentMu.RLock()
+	segments := append([]segmentInfo(nil), db.segments...)
+	db.segmentMu.RUnlock()
+
+	for _, seg := range segments {
+		var prev uint64
+		err := db.scanSegment(seg, func(record *entry) {
+			if record.seq <= prev {
+				t.Errorf("Segment %d: sequence %d follows %d", seg.id, record.seq, prev)
+			}
+			prev = record.seq
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db.Close()
+
+	// The counter is recovered on open
+	db2, err := OpenWithMaxSegmentSize(tmp, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+
+	if db2.LastSeq() != lastSeq {
+		t.Errorf("LastSeq() after reopen = %d, expected %d", db2.LastSeq(), lastSeq)
+	}
+	seq, err := db2.Put("seq_key_after_reopen", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != lastSeq+1 {
+		t.Errorf("Expected sequence number %d after reopen, got %d", lastSeq+1, seq)
+	}
+}
+
 // Benchmark tests
 func BenchmarkSegmentedDb_Put(b *testing.B) {
 	tmp := b.TempDir()
@@ -455,7 +525,7 @@ func BenchmarkSegmentedDb_Put(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		key := fmt.Sprintf("bench_key_%d", i)
 		value := fmt.Sprintf("bench_value_%d", i)
-		err := db.Put(key, value)
+		_, err := db.Put(key, value)
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -474,7 +544,7 @@ func BenchmarkSegmentedDb_Get(b *testing.B) {
 	for i := 0; i < 1000; i++ {
 		key := fmt.Sprintf("bench_key_%d", i)
 		value := fmt.Sprintf("bench_value_%d", i)
-		err := db.Put(key, value)
+		_, err := db.Put(key, value)
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -488,4 +558,139 @@ func BenchmarkSegmentedDb_Get(b *testing.B) {
 			b.Fatal(err)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestSegmentedDb_Context(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.PutContext(canceled, "key", "value"); !errors.Is(err, context.Canceled) {
+		t.Errorf("PutContext: expected context.Canceled, got %v", err)
+	}
+	if _, err := db.Get("key"); err != ErrNotFound {
+		t.Errorf("A canceled write was stored: %v", err)
+	}
+	db.Put("key", "value")
+	if _, err := db.GetContext(canceled, "key"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetContext: expected context.Canceled, got %v", err)
+	}
+	ran := false
+	err = db.UpdateContext(canceled, func(tx *Tx) error {
+		ran = true
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || ran {
+		t.Errorf("UpdateContext: expected context.Canceled without running, got %v", err)
+	}
+	bucket, _ := db.Bucket("bucket")
+	bucket.Put("key", "value")
+	if err := db.DropBucketContext(canceled, "bucket"); !errors.Is(err, context.Canceled) {
+		t.Errorf("DropBucketContext: expected context.Canceled, got %v", err)
+	}
+	if _, err := bucket.Get("key"); err != nil {
+		t.Errorf("A canceled drop was applied: %v", err)
+	}
+
+	// Hold the writer up on the index locks with a write it has taken
+	batch := db.index.lockAll()
+	first := putRequest{key: "first", value: "value", valueType: TypeString, result: make(chan putResult, 1)}
+	db.putChan <- first
+	for len(db.putChan) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := db.PutContext(ctx, "second", "value"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("PutContext with a stuck writer: expected context.DeadlineExceeded, got %v", err)
+	}
+	batch.unlock()
+	if res := <-first.result; res.err != nil {
+		t.Fatal(res.err)
+	}
+	// The writer skips the queued write given up on
+	db.Put("third", "value")
+	if _, err := db.Get("second"); err != ErrNotFound {
+		t.Errorf("A write given up on in the queue was stored: %v", err)
+	}
+
+	// Reads waiting for a merge give up once it is done
+	db.segmentMu.Lock()
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	read := make(chan error)
+	go func() {
+		_, err := db.GetContext(ctx, "key")
+		read <- err
+	}()
+	<-ctx.Done()
+	db.segmentMu.Unlock()
+	if err := <-read; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetContext behind a merge: expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestSegmentedDb_CloseDrainsQueuedWrites(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the writer up on the index locks while writes queue behind it
+	batch := db.index.lockAll()
+	const queued = 20
+	results := make(chan error, queued)
+	for i := 0; i < queued; i++ {
+		go func(i int) {
+			_, err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+			results <- err
+		}(i)
+	}
+	for len(db.putChan) < queued-1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- db.Close() }()
+	for !db.closed.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := db.Put("late", "value"); err != ErrClosed {
+		t.Errorf("Put during Close: expected ErrClosed, got %v", err)
+	}
+
+	batch.unlock()
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < queued; i++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				t.Errorf("Queued write failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Queued writes were dropped by Close")
+		}
+	}
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < queued; i++ {
+		if value, err := db.Get(fmt.Sprintf("key%d", i)); err != nil || value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Queued write of key%d lost: %q, %v", i, value, err)
+		}
+	}
+	if _, err := db.Get("late"); err != ErrNotFound {
+		t.Errorf("A write refused by Close was stored: %v", err)
+	}
+}
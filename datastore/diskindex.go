@@ -0,0 +1,908 @@
+package datastore
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+)
+
+const (
+	indexDirName          = "index"
+	indexMetaName         = "meta"
+	defaultIndexCacheSize = 100000
+
+	// A table starts with this many slots and doubles once more than
+	// diskMaxLoad percent of them are taken, deleted slots included
+	diskInitialSlots = 1024
+	diskMaxLoad      = 70
+
+	// Slots are read in windows of this many while probing
+	diskProbeWindow = 16
+
+	// Slot layout: key hash, key offset in the keys file, record offset,
+	// sequence number, segment ID and record size
+	diskSlotSize = 8 + 8 + 8 + 8 + 4 + 4
+
+	// Hashes of free slots; key hashes are moved past them
+	diskSlotEmpty   = 0
+	diskSlotDeleted = 1
+)
+
+// diskTable is an indexTable kept in two files: a hash table of fixed-size
+// slots using linear probing, and a file the keys are appended to. A slot
+// holds the hash of its key, so the key itself is only read to confirm a
+// match. The most recently used entries are cached in memory.
+//
+// After an I/O error the table reports it to the index and stops changing
+// its files.
+type diskTable struct {
+	fs        FS
+	slotsPath string
+	keysPath  string
+	slots     File
+	keys      File
+	fail      func(error)
+	broken    bool
+
+	slotCount  int64 // a power of two
+	count      int64
+	tombstones int64
+	keysSize   int64
+	garbage    int64 // bytes of deleted keys in the keys file
+
+	cache *entryCache
+}
+
+// diskTableState is what a table needs to reopen its files as they were
+// left, recorded on a clean close.
+type diskTableState struct {
+	Slots      int64 `json:"slots"`
+	Count      int64 `json:"count"`
+	Tombstones int64 `json:"tombstones"`
+	KeysSize   int64 `json:"keys_size"`
+	Garbage    int64 `json:"garbage"`
+}
+
+// diskSlot is the decoded content of a slot.
+type diskSlot struct {
+	hash     uint64
+	keyOff   int64
+	location indexEntry
+}
+
+// openDiskTable opens the files of a table at the given base path. With a
+// nil state the files are created empty, replacing any found.
+func openDiskTable(fsys FS, basePath string, state *diskTableState, cacheSize int, fail func(error)) (*diskTable, error) {
+	t := &diskTable{
+		fs:        fsys,
+		slotsPath: basePath + ".slots",
+		keysPath:  basePath + ".keys",
+		fail:      fail,
+		slotCount: diskInitialSlots,
+		cache:     newEntryCache(cacheSize),
+	}
+	flag := os.O_RDWR | os.O_CREATE
+	if state == nil {
+		flag |= os.O_TRUNC
+	} else {
+		t.slotCount = state.Slots
+		t.count = state.Count
+		t.tombstones = state.Tombstones
+		t.keysSize = state.KeysSize
+		t.garbage = state.Garbage
+	}
+
+	var err error
+	if t.slots, err = fsys.OpenFile(t.slotsPath, flag, 0600); err != nil {
+		return nil, err
+	}
+	if t.keys, err = fsys.OpenFile(t.keysPath, flag, 0600); err != nil {
+		t.slots.Close()
+		return nil, err
+	}
+	if state == nil {
+		// Empty slots are zeros
+		err = t.slots.Truncate(t.slotCount * diskSlotSize)
+	} else {
+		err = t.checkSizes()
+	}
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// checkSizes verifies that the files are as large as the recorded state
+// says.
+func (t *diskTable) checkSizes() error {
+	if t.slotCount < diskInitialSlots || t.slotCount&(t.slotCount-1) != 0 {
+		return fmt.Errorf("%s: invalid slot count %d", t.slotsPath, t.slotCount)
+	}
+	for _, file := range []struct {
+		f    File
+		size int64
+	}{{t.slots, t.slotCount * diskSlotSize}, {t.keys, t.keysSize}} {
+		info, err := file.f.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() != file.size {
+			return fmt.Errorf("%s: size %d, expected %d", info.Name(), info.Size(), file.size)
+		}
+	}
+	return nil
+}
+
+func (t *diskTable) state() diskTableState {
+	return diskTableState{Slots: t.slotCount, Count: t.count, Tombstones: t.tombstones, KeysSize: t.keysSize, Garbage: t.garbage}
+}
+
+// sync flushes both files to disk.
+func (t *diskTable) sync() error {
+	if err := t.slots.Sync(); err != nil {
+		return err
+	}
+	return t.keys.Sync()
+}
+
+func (t *diskTable) Close() error {
+	err := t.slots.Close()
+	if keysErr := t.keys.Close(); err == nil {
+		err = keysErr
+	}
+	return err
+}
+
+func (t *diskTable) diskBytes() int64 {
+	return t.slotCount*diskSlotSize + t.keysSize
+}
+
+func (t *diskTable) setBroken(err error) {
+	if !t.broken {
+		t.broken = true
+		t.fail(fmt.Errorf("index table %s: %w", t.slotsPath, err))
+	}
+}
+
+// diskKeyHash is keyHash64 moved past the hashes marking free slots.
+func diskKeyHash(key string) uint64 {
+	h := keyHash64(key)
+	if h <= diskSlotDeleted {
+		h += diskSlotDeleted + 1
+	}
+	return h
+}
+
+func encodeDiskSlot(buf []byte, s diskSlot) {
+	binary.LittleEndian.PutUint64(buf[0:], s.hash)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(s.keyOff))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(s.location.offset))
+	binary.LittleEndian.PutUint64(buf[24:], s.location.seq)
+	binary.LittleEndian.PutUint32(buf[32:], uint32(s.location.segmentID))
+	binary.LittleEndian.PutUint32(buf[36:], s.location.size)
+}
+
+func decodeDiskSlot(buf []byte) diskSlot {
+	return diskSlot{
+		hash:   binary.LittleEndian.Uint64(buf[0:]),
+		keyOff: int64(binary.LittleEndian.Uint64(buf[8:])),
+		location: indexEntry{
+			offset:    int64(binary.LittleEndian.Uint64(buf[16:])),
+			seq:       binary.LittleEndian.Uint64(buf[24:]),
+			segmentID: int(binary.LittleEndian.Uint32(buf[32:])),
+			size:      binary.LittleEndian.Uint32(buf[36:]),
+		},
+	}
+}
+
+// find probes for key. It returns the slot holding it if found, and
+// otherwise the first free slot it passed, which is where the key goes.
+func (t *diskTable) find(key string, hash uint64) (slot diskSlot, index int64, found bool, err error) {
+	mask := t.slotCount - 1
+	i := int64(hash) & mask
+	free := int64(-1)
+	buf := make([]byte, diskProbeWindow*diskSlotSize)
+	for probed := int64(0); probed < t.slotCount; {
+		// Windows do not wrap around the end of the file
+		n := min(diskProbeWindow, t.slotCount-i)
+		window := buf[:n*diskSlotSize]
+		if _, err := t.slots.ReadAt(window, i*diskSlotSize); err != nil {
+			return diskSlot{}, 0, false, err
+		}
+		for j := int64(0); j < n; j++ {
+			s := decodeDiskSlot(window[j*diskSlotSize:])
+			switch s.hash {
+			case diskSlotEmpty:
+				if free < 0 {
+					free = i + j
+				}
+				return diskSlot{}, free, false, nil
+			case diskSlotDeleted:
+				if free < 0 {
+					free = i + j
+				}
+			case hash:
+				match, err := t.keyAt(s.keyOff, key)
+				if err != nil {
+					return diskSlot{}, 0, false, err
+				}
+				if match {
+					return s, i + j, true, nil
+				}
+			}
+		}
+		probed += n
+		i = (i + n) & mask
+	}
+	return diskSlot{}, free, false, nil
+}
+
+// keyAt reports whether the key stored at off in the keys file is key.
+func (t *diskTable) keyAt(off int64, key string) (bool, error) {
+	buf := make([]byte, 4+len(key))
+	n, err := t.keys.ReadAt(buf, off)
+	if n < 4 {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return false, err
+	}
+	if int(binary.LittleEndian.Uint32(buf)) != len(key) {
+		return false, nil
+	}
+	if n < len(buf) {
+		return false, io.ErrUnexpectedEOF
+	}
+	return string(buf[4:]) == key, nil
+}
+
+// readKey reads the key stored at off in the keys file.
+func (t *diskTable) readKey(off int64) (string, error) {
+	var header [4]byte
+	if _, err := t.keys.ReadAt(header[:], off); err != nil {
+		return "", err
+	}
+	key := make([]byte, binary.LittleEndian.Uint32(header[:]))
+	if _, err := t.keys.ReadAt(key, off+4); err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+func (t *diskTable) appendKey(key string) (int64, error) {
+	buf := make([]byte, 4+len(key))
+	binary.LittleEndian.PutUint32(buf, uint32(len(key)))
+	copy(buf[4:], key)
+	if err := t.writeAt(t.keys, buf, t.keysSize); err != nil {
+		return 0, err
+	}
+	off := t.keysSize
+	t.keysSize += int64(len(buf))
+	return off, nil
+}
+
+func (t *diskTable) writeSlot(index int64, s diskSlot) error {
+	var buf [diskSlotSize]byte
+	encodeDiskSlot(buf[:], s)
+	return t.writeAt(t.slots, buf[:], index*diskSlotSize)
+}
+
+// writeAt writes at an offset. Only writers move the file offsets, and
+// they hold the shard lock exclusively.
+func (t *diskTable) writeAt(f File, data []byte, off int64) error {
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := f.Write(data)
+	return err
+}
+
+// lookup finds key through the cache or the files.
+func (t *diskTable) lookup(key string) (cachedEntry, bool, int64, error) {
+	if c, ok := t.cache.get(key); ok {
+		return c, true, 0, nil
+	}
+	hash := diskKeyHash(key)
+	s, index, found, err := t.find(key, hash)
+	if err != nil || !found {
+		return cachedEntry{}, false, index, err
+	}
+	c := cachedEntry{location: s.location, slot: index, keyOff: s.keyOff, hash: hash}
+	t.cache.put(key, c)
+	return c, true, index, nil
+}
+
+func (t *diskTable) get(key string) (indexEntry, bool) {
+	if t.broken {
+		return indexEntry{}, false
+	}
+	c, found, _, err := t.lookup(key)
+	if err != nil {
+		// Reported to the index; a concurrent reader may get here too
+		t.fail(fmt.Errorf("index table %s: %w", t.slotsPath, err))
+		return indexEntry{}, false
+	}
+	return c.location, found
+}
+
+func (t *diskTable) set(key string, location indexEntry) {
+	if t.broken {
+		return
+	}
+	c, found, free, err := t.lookup(key)
+	if err != nil {
+		t.setBroken(err)
+		return
+	}
+	if !found {
+		if free < 0 {
+			t.setBroken(fmt.Errorf("no free slot"))
+			return
+		}
+		keyOff, err := t.appendKey(key)
+		if err != nil {
+			t.setBroken(err)
+			return
+		}
+		// A free slot is either never used or deleted
+		var previous [diskSlotSize]byte
+		if _, err := t.slots.ReadAt(previous[:], free*diskSlotSize); err != nil {
+			t.setBroken(err)
+			return
+		}
+		if decodeDiskSlot(previous[:]).hash == diskSlotDeleted {
+			t.tombstones--
+		}
+		t.count++
+		c = cachedEntry{slot: free, keyOff: keyOff, hash: diskKeyHash(key)}
+	}
+
+	c.location = location
+	if err := t.writeSlot(c.slot, diskSlot{hash: c.hash, keyOff: c.keyOff, location: location}); err != nil {
+		t.setBroken(err)
+		return
+	}
+	t.cache.put(key, c)
+
+	if (t.count+t.tombstones)*100 > t.slotCount*diskMaxLoad {
+		if err := t.grow(); err != nil {
+			t.setBroken(err)
+		}
+	}
+}
+
+func (t *diskTable) delete(key string) {
+	if t.broken {
+		return
+	}
+	c, found, _, err := t.lookup(key)
+	if err != nil {
+		t.setBroken(err)
+		return
+	}
+	if !found {
+		return
+	}
+	if err := t.writeSlot(c.slot, diskSlot{hash: diskSlotDeleted}); err != nil {
+		t.setBroken(err)
+		return
+	}
+	t.cache.remove(key)
+	t.count--
+	t.tombstones++
+	t.garbage += int64(4 + len(key))
+
+	// Deletes alone never fill the table, so they reclaim the keys here
+	if t.garbage*2 > t.keysSize {
+		if err := t.grow(); err != nil {
+			t.setBroken(err)
+		}
+	}
+}
+
+func (t *diskTable) len() int {
+	return int(t.count)
+}
+
+// forEach reads the slots in order and the key of every entry.
+func (t *diskTable) forEach(fn func(key string, location indexEntry)) {
+	if t.broken {
+		return
+	}
+	err := t.scanSlots(func(s diskSlot) error {
+		key, err := t.readKey(s.keyOff)
+		if err != nil {
+			return err
+		}
+		fn(key, s.location)
+		return nil
+	})
+	if err != nil {
+		t.fail(fmt.Errorf("index table %s: %w", t.slotsPath, err))
+	}
+}
+
+// scanSlots calls fn for every taken slot.
+func (t *diskTable) scanSlots(fn func(s diskSlot) error) error {
+	buf := make([]byte, 4096*diskSlotSize)
+	for start := int64(0); start < t.slotCount; start += 4096 {
+		n := min(4096, t.slotCount-start)
+		chunk := buf[:n*diskSlotSize]
+		if _, err := t.slots.ReadAt(chunk, start*diskSlotSize); err != nil {
+			return err
+		}
+		for j := int64(0); j < n; j++ {
+			s := decodeDiskSlot(chunk[j*diskSlotSize:])
+			if s.hash == diskSlotEmpty || s.hash == diskSlotDeleted {
+				continue
+			}
+			if err := fn(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *diskTable) memoryBytes() int64 {
+	return t.cache.memoryBytes()
+}
+
+// grow rewrites the slots into a table large enough to be at most half
+// full, dropping the deleted ones. The new table is built in memory and
+// replaces the file with a rename. Once more than half of the keys file
+// is deleted keys, it is rewritten with the live keys the same way, as
+// compactTable does with its arena.
+func (t *diskTable) grow() error {
+	slotCount := int64(diskInitialSlots)
+	for t.count*2 > slotCount {
+		slotCount *= 2
+	}
+
+	var keys *keysRewrite
+	if t.garbage*2 > t.keysSize {
+		var err error
+		if keys, err = t.newKeysRewrite(); err != nil {
+			return err
+		}
+		defer keys.abort()
+	}
+
+	table := make([]byte, slotCount*diskSlotSize)
+	mask := slotCount - 1
+	err := t.scanSlots(func(s diskSlot) error {
+		if keys != nil {
+			key, err := t.readKey(s.keyOff)
+			if err != nil {
+				return err
+			}
+			if s.keyOff, err = keys.append(key); err != nil {
+				return err
+			}
+		}
+		i := int64(s.hash) & mask
+		for binary.LittleEndian.Uint64(table[i*diskSlotSize:]) != diskSlotEmpty {
+			i = (i + 1) & mask
+		}
+		encodeDiskSlot(table[i*diskSlotSize:], s)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if keys != nil {
+		if err := keys.close(); err != nil {
+			return err
+		}
+	}
+
+	tempPath := t.slotsPath + ".tmp"
+	temp, err := t.fs.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(table)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	// Both new files are complete before either replaces an old one
+	if err == nil && keys != nil {
+		err = keys.install()
+	}
+	if err == nil {
+		err = t.slots.Close()
+	}
+	if err == nil {
+		err = t.fs.Rename(tempPath, t.slotsPath)
+	}
+	if err != nil {
+		t.fs.Remove(tempPath)
+		return err
+	}
+	if t.slots, err = t.fs.OpenFile(t.slotsPath, os.O_RDWR, 0600); err != nil {
+		return err
+	}
+
+	t.slotCount = slotCount
+	t.tombstones = 0
+	t.cache.clear() // slots have moved
+	return nil
+}
+
+// keysRewrite writes the live keys of a table to a new keys file.
+type keysRewrite struct {
+	t        *diskTable
+	tempPath string
+	file     File
+	w        *bufio.Writer
+	size     int64
+}
+
+func (t *diskTable) newKeysRewrite() (*keysRewrite, error) {
+	tempPath := t.keysPath + ".tmp"
+	file, err := t.fs.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &keysRewrite{t: t, tempPath: tempPath, file: file, w: bufio.NewWriter(file)}, nil
+}
+
+// append writes key and returns its offset in the new file.
+func (r *keysRewrite) append(key string) (int64, error) {
+	var header [4]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(len(key)))
+	if _, err := r.w.Write(header[:]); err != nil {
+		return 0, err
+	}
+	if _, err := r.w.WriteString(key); err != nil {
+		return 0, err
+	}
+	off := r.size
+	r.size += int64(4 + len(key))
+	return off, nil
+}
+
+// close completes the new file.
+func (r *keysRewrite) close() error {
+	err := r.w.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file = nil
+	return err
+}
+
+// install replaces the keys file of the table with the new one.
+func (r *keysRewrite) install() error {
+	t := r.t
+	err := t.keys.Close()
+	if err == nil {
+		err = t.fs.Rename(r.tempPath, t.keysPath)
+	}
+	if err != nil {
+		return err
+	}
+	if t.keys, err = t.fs.OpenFile(t.keysPath, os.O_RDWR, 0600); err != nil {
+		return err
+	}
+	t.keysSize = r.size
+	t.garbage = 0
+	return nil
+}
+
+// abort removes the new file unless it replaced the old one.
+func (r *keysRewrite) abort() {
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.t.fs.Remove(r.tempPath)
+}
+
+// cachedEntry is an index entry cached together with where it is stored.
+type cachedEntry struct {
+	location indexEntry
+	slot     int64
+	keyOff   int64
+	hash     uint64
+}
+
+// entryCache is a least recently used cache of index entries. Readers use
+// it under the shard's read lock, so it has a lock of its own.
+type entryCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List // of *cacheItem, most recently used first
+	bytes    int64
+}
+
+type cacheItem struct {
+	key   string
+	entry cachedEntry
+}
+
+// cacheItemOverhead estimates the memory a cached entry takes besides the
+// bytes of its key.
+const cacheItemOverhead = int64(unsafe.Sizeof(cacheItem{})) + int64(unsafe.Sizeof(list.Element{})) + 8 + 16
+
+func newEntryCache(capacity int) *entryCache {
+	return &entryCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *entryCache) get(key string) (cachedEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return cachedEntry{}, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheItem).entry, true
+}
+
+func (c *entryCache) put(key string, entry cachedEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheItem).entry = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheItem{key: key, entry: entry})
+	c.bytes += int64(len(key)) + cacheItemOverhead
+	for len(c.entries) > c.capacity {
+		oldest := c.order.Remove(c.order.Back()).(*cacheItem)
+		delete(c.entries, oldest.key)
+		c.bytes -= int64(len(oldest.key)) + cacheItemOverhead
+	}
+}
+
+func (c *entryCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		c.bytes -= int64(len(key)) + cacheItemOverhead
+	}
+}
+
+func (c *entryCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.bytes = 0
+}
+
+func (c *entryCache) memoryBytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// diskIndexMeta records the state of the index files and the segments they
+// describe on a clean close.
+type diskIndexMeta struct {
+	LastSeq       uint64                  `json:"last_seq"`
+	LastTimestamp int64                   `json:"last_timestamp"`
+	ActiveSegment int                     `json:"active_segment"`
+	ActiveSize    int64                   `json:"active_size"`
+	Segments      map[int]int64           `json:"segments"` // sealed segment sizes by ID
+	Ranges        map[int]seqRange        `json:"ranges"`   // sealed segment ranges by ID
+	ActiveRange   seqRange                `json:"active_range"`
+	Drops         map[string][]dropMarker `json:"drops"`      // bucket drop history by key prefix
+	LiveBytes     *int64                  `json:"live_bytes"` // of the records the index points at
+	Tables        []diskTableState        `json:"tables"`
+}
+
+// openDiskIndex replaces the index with one kept in files under the index
+// directory. It reports whether the files were left by a clean close and
+// still match the segments; otherwise they are created empty, for the
+// caller to fill from the segments. The record of the clean close is
+// removed, so that the index is rebuilt after a crash from now on.
+func (db *Db) openDiskIndex() (bool, error) {
+	dir := filepath.Join(db.dir, indexDirName)
+	if err := db.fs.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+	metaPath := filepath.Join(dir, indexMetaName)
+
+	meta, err := db.readDiskIndexMeta(metaPath)
+	if err != nil {
+		return false, err
+	}
+	idx, err := db.openDiskTables(dir, meta)
+	if err != nil && meta != nil {
+		// Files not as recorded, start over
+		meta = nil
+		idx, err = db.openDiskTables(dir, nil)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := db.fs.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+		idx.close()
+		return false, err
+	}
+
+	db.index = idx
+	if meta == nil {
+		return false, nil
+	}
+	idx.liveBytes.Store(*meta.LiveBytes)
+	db.segmentMu.Lock()
+	db.activeSegmentID = meta.ActiveSegment
+	db.activeSeqs = meta.ActiveRange
+	for i := range db.segments {
+		db.segments[i].seqs = meta.Ranges[db.segments[i].id]
+	}
+	db.segmentMu.Unlock()
+	for prefix, markers := range meta.Drops {
+		db.addDrops(prefix, markers...)
+	}
+	db.lastSeq.Store(meta.LastSeq)
+	db.lastTimestamp = meta.LastTimestamp
+	return true, nil
+}
+
+func (db *Db) openDiskTables(dir string, meta *diskIndexMeta) (*shardedIndex, error) {
+	cacheSize := max(1, db.indexCacheSize/indexShardCount)
+	idx := &shardedIndex{shards: make([]indexShard, indexShardCount)}
+	for i := range idx.shards {
+		var state *diskTableState
+		if meta != nil {
+			state = &meta.Tables[i]
+		}
+		table, err := openDiskTable(db.fs, filepath.Join(dir, fmt.Sprintf("shard-%02d", i)), state, cacheSize, idx.fail)
+		if err != nil {
+			idx.close()
+			return nil, err
+		}
+		idx.shards[i].entries = table
+	}
+	return idx, nil
+}
+
+// readDiskIndexMeta reads the record of the last clean close. It returns
+// nil if there is none or it does not describe the current segments.
+func (db *Db) readDiskIndexMeta(metaPath string) (*diskIndexMeta, error) {
+	file, err := openFile(db.fs, metaPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var meta diskIndexMeta
+	if err := json.NewDecoder(file).Decode(&meta); err != nil || len(meta.Tables) != indexShardCount || meta.LiveBytes == nil {
+		return nil, nil
+	}
+
+	// The segments must be exactly as they were left
+	db.segmentMu.RLock()
+	sealed, activeSize, err := db.segmentSizes()
+	maxSealedID := -1
+	for _, seg := range db.segments {
+		maxSealedID = max(maxSealedID, seg.id)
+	}
+	db.segmentMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if activeSize != meta.ActiveSize || meta.ActiveSegment <= maxSealedID || len(sealed) != len(meta.Segments) {
+		return nil, nil
+	}
+	for id, size := range sealed {
+		if recorded, ok := meta.Segments[id]; !ok || recorded != size {
+			return nil, nil
+		}
+		if _, ok := meta.Ranges[id]; !ok {
+			return nil, nil
+		}
+	}
+	return &meta, nil
+}
+
+// segmentSizes returns the sizes of the sealed segments by ID and of the
+// active segment. The caller must hold segmentMu.
+func (db *Db) segmentSizes() (map[int]int64, int64, error) {
+	sealed := make(map[int]int64, len(db.segments))
+	for _, seg := range db.segments {
+		if seg.remote {
+			sealed[seg.id] = seg.size
+			continue
+		}
+		info, err := db.fs.Stat(seg.filePath)
+		if err != nil {
+			return nil, 0, err
+		}
+		sealed[seg.id] = info.Size()
+	}
+
+	info, err := db.fs.Stat(filepath.Join(db.dir, outFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return sealed, 0, nil
+		}
+		return nil, 0, err
+	}
+	return sealed, info.Size(), nil
+}
+
+// saveDiskIndex flushes the index files and records the clean close. It
+// runs once the writer and merges have stopped.
+func (db *Db) saveDiskIndex() error {
+	if err := db.index.err(); err != nil {
+		return err
+	}
+	liveBytes := db.index.liveBytes.Load()
+	meta := diskIndexMeta{
+		LastSeq:       db.lastSeq.Load(),
+		LastTimestamp: db.lastTimestamp,
+		ActiveSegment: db.activeSegmentID,
+		LiveBytes:     &liveBytes,
+	}
+	for i := range db.index.shards {
+		table := db.index.shards[i].entries.(*diskTable)
+		if err := table.sync(); err != nil {
+			return err
+		}
+		meta.Tables = append(meta.Tables, table.state())
+	}
+	var err error
+	db.segmentMu.RLock()
+	meta.Segments, meta.ActiveSize, err = db.segmentSizes()
+	meta.Ranges = make(map[int]seqRange, len(db.segments))
+	for _, seg := range db.segments {
+		meta.Ranges[seg.id] = seg.seqs
+	}
+	meta.ActiveRange = db.activeSeqs
+	db.segmentMu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	db.dropsMu.RLock()
+	meta.Drops = db.drops
+	data, err := json.Marshal(meta)
+	db.dropsMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	metaPath := filepath.Join(db.dir, indexDirName, indexMetaName)
+	tempPath := metaPath + ".tmp"
+	temp, err := db.fs.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = db.fs.Rename(tempPath, metaPath)
+	}
+	if err != nil {
+		db.fs.Remove(tempPath)
+	}
+	return err
+}
@@ -0,0 +1,255 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskTable(t *testing.T) {
+	fsys := NewMemFS()
+	if err := fsys.MkdirAll("/index", 0755); err != nil {
+		t.Fatal(err)
+	}
+	var failure error
+	fail := func(err error) { failure = err }
+	table, err := openDiskTable(fsys, "/index/shard", nil, 16, fail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough keys to grow the table several times, with a cache far too
+	// small to hold them
+	expected := make(map[string]indexEntry)
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		location := indexEntry{segmentID: i % 7, offset: int64(i) * 100, seq: uint64(i + 1), size: uint32(i % 300)}
+		table.set(key, location)
+		expected[key] = location
+	}
+	for i := 0; i < 5000; i += 2 {
+		key := fmt.Sprintf("key%d", i)
+		location := indexEntry{segmentID: 9, offset: int64(i), seq: uint64(10000 + i)}
+		table.set(key, location)
+		expected[key] = location
+	}
+	for i := 0; i < 5000; i += 3 {
+		key := fmt.Sprintf("key%d", i)
+		table.delete(key)
+		delete(expected, key)
+	}
+
+	check := func(table *diskTable) {
+		t.Helper()
+		if table.len() != len(expected) {
+			t.Errorf("Expected %d entries, got %d", len(expected), table.len())
+		}
+		for key, location := range expected {
+			if got, ok := table.get(key); !ok || got != location {
+				t.Fatalf("get(%q) = %+v, %v, expected %+v", key, got, ok, location)
+			}
+		}
+		if _, ok := table.get("key3"); ok {
+			t.Error("A deleted key was found")
+		}
+		seen := 0
+		table.forEach(func(key string, location indexEntry) {
+			seen++
+			if expected[key] != location {
+				t.Errorf("forEach: %q at %+v, expected %+v", key, location, expected[key])
+			}
+		})
+		if seen != len(expected) {
+			t.Errorf("forEach saw %d entries, expected %d", seen, len(expected))
+		}
+		if failure != nil {
+			t.Fatal(failure)
+		}
+	}
+	check(table)
+	if table.slotCount <= diskInitialSlots {
+		t.Errorf("The table did not grow: %d slots", table.slotCount)
+	}
+	if table.memoryBytes() <= 0 || table.memoryBytes() > table.diskBytes() {
+		t.Errorf("Unexpected cache size %d for %d bytes on disk", table.memoryBytes(), table.diskBytes())
+	}
+
+	// The files are reopened as they were left
+	if err := table.sync(); err != nil {
+		t.Fatal(err)
+	}
+	state := table.state()
+	table.Close()
+	table, err = openDiskTable(fsys, "/index/shard", &state, 16, fail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(table)
+	table.Close()
+
+	state.KeysSize++
+	if _, err := openDiskTable(fsys, "/index/shard", &state, 16, fail); err == nil {
+		t.Error("Expected files not matching the state to be refused")
+	}
+}
+
+func TestDiskTable_ReclaimsDeletedKeys(t *testing.T) {
+	fsys := NewMemFS()
+	if err := fsys.MkdirAll("/index", 0755); err != nil {
+		t.Fatal(err)
+	}
+	var failure error
+	table, err := openDiskTable(fsys, "/index/shard", nil, 16, func(err error) { failure = err })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := func(i int) string { return fmt.Sprintf("a-rather-long-key-%04d", i) }
+	for i := 0; i < 2000; i++ {
+		table.set(key(i), indexEntry{offset: int64(i), seq: uint64(i + 1)})
+	}
+	full := table.keysSize
+
+	// Deleting most keys shrinks the keys file to the ones left
+	for i := 0; i < 1800; i++ {
+		table.delete(key(i))
+	}
+	if failure != nil {
+		t.Fatal(failure)
+	}
+	live := int64(200 * (4 + len(key(0))))
+	if table.keysSize > 2*live || table.garbage*2 > table.keysSize {
+		t.Errorf("Keys file holds %d bytes, %d garbage, for %d live bytes (was %d)", table.keysSize, table.garbage, live, full)
+	}
+	if info, err := fsys.Stat("/index/shard.keys"); err != nil || info.Size() != table.keysSize {
+		t.Errorf("Keys file is %v, expected %d bytes (%v)", info, table.keysSize, err)
+	}
+
+	check := func(table *diskTable) {
+		t.Helper()
+		for i := 0; i < 2000; i++ {
+			location, ok := table.get(key(i))
+			if ok != (i >= 1800) || (ok && location.offset != int64(i)) {
+				t.Fatalf("get(%q) = %+v, %v", key(i), location, ok)
+			}
+		}
+		if failure != nil {
+			t.Fatal(failure)
+		}
+	}
+	check(table)
+
+	if err := table.sync(); err != nil {
+		t.Fatal(err)
+	}
+	state := table.state()
+	table.Close()
+	table, err = openDiskTable(fsys, "/index/shard", &state, 16, func(err error) { failure = err })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	check(table)
+}
+
+func TestDiskIndex_Reopen(t *testing.T) {
+	fsys := NewMemFS()
+	opts := Options{FS: fsys, MaxSegmentSize: 512, IndexOnDisk: true, IndexCacheSize: 64}
+	db, err := OpenWithOptions("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaPath := filepath.Join("/db", indexDirName, indexMetaName)
+
+	acked := make(map[string]string)
+	bucket, _ := db.Bucket("tmp")
+	for i := 0; i < 400; i++ {
+		key, value := fmt.Sprintf("key%d", i%200), fmt.Sprintf("value%d", i)
+		if _, err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		acked[key] = value
+		if _, err := bucket.Put(fmt.Sprintf("b%d", i%20), "temporary"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DropBucket("tmp"); err != nil {
+		t.Fatal(err)
+	}
+	checkAcknowledged(t, db, acked)
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 200 || stats.IndexDiskBytes <= 0 {
+		t.Errorf("Unexpected index statistics: %d keys, %d bytes on disk", stats.Keys, stats.IndexDiskBytes)
+	}
+
+	// A clean close is recorded, and the record removed again once open
+	db.Close()
+	if _, err := fsys.Stat(metaPath); err != nil {
+		t.Fatalf("No record of the clean close: %v", err)
+	}
+	db, err = OpenWithOptions("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat(metaPath); !os.IsNotExist(err) {
+		t.Errorf("The record of the clean close was kept while open: %v", err)
+	}
+	checkAcknowledged(t, db, acked)
+	if buckets := db.Buckets(); len(buckets) != 0 {
+		t.Errorf("A dropped bucket came back: %v", buckets)
+	}
+	if _, err := db.Put("after", "reopen"); err != nil {
+		t.Fatal(err)
+	}
+	acked["after"] = "reopen"
+	db.Close()
+
+	// Segments written without the disk index make it rebuild
+	db, err = OpenWithOptions("/db", Options{FS: fsys, MaxSegmentSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Put("memory", "index"); err != nil {
+		t.Fatal(err)
+	}
+	acked["memory"] = "index"
+	db.Close()
+
+	db, err = OpenWithOptions("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkAcknowledged(t, db, acked)
+	if keys := db.Keys(); len(keys) != len(acked) {
+		t.Errorf("Expected %d keys, got %d", len(acked), len(keys))
+	}
+}
+
+func BenchmarkSegmentedDb_GetDiskIndex(b *testing.B) {
+	for _, onDisk := range []bool{false, true} {
+		b.Run(fmt.Sprintf("disk=%v", onDisk), func(b *testing.B) {
+			db, err := OpenWithOptions(b.TempDir(), Options{IndexOnDisk: onDisk, IndexCacheSize: 1000})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			for i := 0; i < 20000; i++ {
+				if _, err := db.Put(fmt.Sprintf("bench_key_%d", i), "bench_value"); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get(fmt.Sprintf("bench_key_%d", (i*7919)%20000)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
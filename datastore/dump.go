@@ -0,0 +1,274 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Load sends records to the writer in batches of this many records, or
+// fewer once a batch reaches loadBatchBytes.
+const (
+	loadBatchSize  = 1000
+	loadBatchBytes = 1024 * 1024
+)
+
+// ErrInvalidDump is returned by Load, wrapped with the line number and the
+// reason, for a line that is not a valid record.
+var ErrInvalidDump = fmt.Errorf("invalid dump record")
+
+// DumpRecord is a single line of a JSON Lines dump produced by Dump and
+// consumed by Load.
+type DumpRecord struct {
+	Bucket string      `json:"bucket,omitempty"`
+	Key    string      `json:"key"`
+	Type   string      `json:"type"`
+	Value  interface{} `json:"value"`
+}
+
+// Keys returns the keys of the default key space in sorted order. Keys of
+// buckets are listed by Bucket.Keys.
+func (db *Db) Keys() []string {
+	return db.index.keys(validKey)
+}
+
+// storedKeys returns all keys of the index including those of buckets, sorted.
+func (db *Db) storedKeys() []string {
+	return db.index.keys(func(string) bool { return true })
+}
+
+// Dump writes the latest value of every key, buckets included, as JSON
+// Lines sorted by key and returns the number of records written. The dump
+// reflects a single snapshot of the database; concurrent writes are not
+// included.
+func (db *Db) Dump(w io.Writer) (int, error) {
+	if db.closed.Load() {
+		return 0, ErrClosed
+	}
+	snapshot := db.Snapshot()
+	defer snapshot.Close()
+
+	// Keys written since the snapshot was taken, and the keys of buckets
+	// dropped since, are looked up together in one pass over the segments
+	// rather than one pass each. Drops are recorded before their keys leave
+	// the index, so none is missed.
+	keys := db.storedKeys()
+	changed := make(map[string]bool)
+	for _, key := range keys {
+		if location, ok := db.index.get(key); ok && location.seq > snapshot.seq {
+			changed[key] = true
+		}
+	}
+	dropped := db.droppedAfter(snapshot.seq, math.MaxInt64)
+	var older map[string]*entry
+	if len(changed) > 0 || len(dropped) > 0 {
+		want := func(key string) bool {
+			if changed[key] {
+				return true
+			}
+			name, _, ok := splitBucketKey(key)
+			return ok && dropped[name+bucketSeparator]
+		}
+		var err error
+		db.segmentMu.RLock()
+		older, err = db.scanVersions(want, db.viewAt(snapshot.seq, math.MaxInt64))
+		db.segmentMu.RUnlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	listed := len(keys)
+	for key := range older {
+		if changed[key] {
+			continue
+		}
+		changed[key] = true
+		if i := sort.SearchStrings(keys[:listed], key); i == listed || keys[i] != key {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	encoder := json.NewEncoder(w)
+	written := 0
+	for _, storedKey := range keys {
+		var v Version
+		if changed[storedKey] {
+			record, ok := older[storedKey]
+			if !ok {
+				continue // created after the snapshot
+			}
+			v = newVersion(record)
+		} else {
+			var err error
+			v, err = snapshot.version(storedKey)
+			if err == ErrNotFound {
+				continue // created after the snapshot
+			}
+			if err != nil {
+				return written, err
+			}
+		}
+
+		bucket, key, _ := splitBucketKey(storedKey)
+		record := DumpRecord{
+			Bucket: bucket,
+			Key:    key,
+			Type:   TypeName(v.Type),
+			Value:  v.Value,
+		}
+		if err := encoder.Encode(record); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, nil
+}
+
+// Load reads JSON Lines in the format written by Dump and stores every
+// record, returning the number of records stored. Records are handed to the
+// writer goroutine in large batches rather than one round trip each, so
+// loading is much faster than calling Put in a loop. Each batch is written
+// atomically; on error the batches before it stay written.
+func (db *Db) Load(r io.Reader) (int, error) {
+	return db.LoadContext(context.Background(), r)
+}
+
+func (db *Db) LoadContext(ctx context.Context, r io.Reader) (int, error) {
+	check := func(e *entry) error {
+		_, key, _ := splitBucketKey(e.key)
+		if err := db.checkWrite(key, e); err != nil {
+			return err
+		}
+		// The bucket name counts towards the limit too
+		if len(e.key) > db.maxKeySize {
+			return ErrKeyTooLarge
+		}
+		return nil
+	}
+	write := func(batch []entry) error {
+		_, err := db.putBatch(ctx, batch)
+		return err
+	}
+	return loadRecords(r, check, write)
+}
+
+// loadRecords decodes the JSON Lines of a dump, validates every record with
+// check and passes them to write in batches.
+func loadRecords(r io.Reader, check func(e *entry) error, write func(batch []entry) error) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	loaded := 0
+	var batch []entry
+	batchBytes := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := write(batch); err != nil {
+			return err
+		}
+		loaded += len(batch)
+		batch, batchBytes = nil, 0
+		return nil
+	}
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		e, err := decodeDumpRecord(data)
+		if err == nil {
+			err = check(&e)
+		}
+		if err != nil {
+			return loaded, fmt.Errorf("line %d: %w: %w", line, ErrInvalidDump, err)
+		}
+		batch = append(batch, e)
+		batchBytes += len(data)
+
+		if len(batch) >= loadBatchSize || batchBytes >= loadBatchBytes {
+			if err := flush(); err != nil {
+				return loaded, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return loaded, fmt.Errorf("line %d: %w: %w", line+1, ErrInvalidDump, err)
+		}
+		return loaded, err
+	}
+
+	return loaded, flush()
+}
+
+func decodeDumpRecord(data []byte) (entry, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Keep int64 values exact instead of going through float64
+	decoder.UseNumber()
+
+	var record DumpRecord
+	if err := decoder.Decode(&record); err != nil {
+		return entry{}, err
+	}
+
+	key := record.Key
+	if !validKey(key) {
+		return entry{}, fmt.Errorf("key %q: %w", key, ErrInvalidKey)
+	}
+	if record.Bucket != "" {
+		prefix, err := bucketPrefix(record.Bucket)
+		if err != nil {
+			return entry{}, fmt.Errorf("bucket %q: %w", record.Bucket, err)
+		}
+		if !validBucketKey(key) {
+			return entry{}, fmt.Errorf("bucket %q: %w", record.Bucket, ErrInvalidKey)
+		}
+		key = prefix + key
+	}
+
+	switch record.Type {
+	case "string":
+		value, ok := record.Value.(string)
+		if !ok {
+			return entry{}, fmt.Errorf("key %q: string value expected", record.Key)
+		}
+		return entry{key: key, valueType: TypeString, stringValue: value}, nil
+	case "int64":
+		number, ok := record.Value.(json.Number)
+		if !ok {
+			return entry{}, fmt.Errorf("key %q: int64 value expected", record.Key)
+		}
+		value, err := number.Int64()
+		if err != nil {
+			return entry{}, fmt.Errorf("key %q: %w", record.Key, err)
+		}
+		return entry{key: key, valueType: TypeInt64, int64Value: value}, nil
+	}
+	return entry{}, fmt.Errorf("key %q: %w %q", record.Key, ErrUnknownValueType, record.Type)
+}
+
+// putBatch writes records with a single writer request and returns the
+// sequence number of the last one.
+func (db *Db) putBatch(ctx context.Context, entries []entry) (uint64, error) {
+	req := putRequest{
+		kind:   requestCommit,
+		writes: entries,
+		result: make(chan putResult, 1),
+	}
+
+	res := db.send(ctx, req)
+	return res.seq, res.err
+}
@@ -0,0 +1,136 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDump_RoundTrip(t *testing.T) {
+	src, err := OpenWithMaxSegmentSize(t.TempDir(), 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	const numKeys = 2500
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("dump_key_%04d", i)
+		if i%3 == 0 {
+			_, err = src.PutInt64(key, int64(1)<<62+int64(i))
+		} else {
+			_, err = src.Put(key, fmt.Sprintf("value \"%d\"\n", i))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	n, err := src.Dump(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != numKeys {
+		t.Errorf("Dumped %d records, expected %d", n, numKeys)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != numKeys {
+		t.Errorf("Dump has %d lines, expected %d", lines, numKeys)
+	}
+
+	dst, err := OpenWithMaxSegmentSize(t.TempDir(), 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	n, err = dst.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != numKeys {
+		t.Errorf("Loaded %d records, expected %d", n, numKeys)
+	}
+
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("dump_key_%04d", i)
+		if i%3 == 0 {
+			value, err := dst.GetInt64(key)
+			if err != nil {
+				t.Fatalf("Failed to get %s: %v", key, err)
+			}
+			if value != int64(1)<<62+int64(i) {
+				t.Errorf("Key %s: got %d", key, value)
+			}
+		} else {
+			value, err := dst.Get(key)
+			if err != nil {
+				t.Fatalf("Failed to get %s: %v", key, err)
+			}
+			if value != fmt.Sprintf("value \"%d\"\n", i) {
+				t.Errorf("Key %s: got %q", key, value)
+			}
+		}
+	}
+}
+
+func TestLoad_RejectsInvalidRecords(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	input := `{"key":"a","type":"string","value":"ok"}
+{"key":"b","type":"float","value":1.5}
+`
+	n, err := db.Load(strings.NewReader(input))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected an error for line 2, got %v", err)
+	}
+	if n != 0 {
+		t.Errorf("Expected nothing to be loaded before the bad line's batch, got %d", n)
+	}
+}
+
+func TestDump_Buckets(t *testing.T) {
+	src, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	bucket, _ := src.Bucket("team")
+	if _, err := src.Put("shared", "default"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Put("shared", "team"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := src.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"bucket":"team"`) {
+		t.Errorf("Dump does not name the bucket: %s", buf.String())
+	}
+
+	dst, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if n, err := dst.Load(&buf); err != nil || n != 2 {
+		t.Fatalf("Load: %d records, %v", n, err)
+	}
+	if value, _ := dst.Get("shared"); value != "default" {
+		t.Errorf("Default bucket: got %q", value)
+	}
+	loaded, _ := dst.Bucket("team")
+	if value, _ := loaded.Get("shared"); value != "team" {
+		t.Errorf("team bucket: got %q", value)
+	}
+}
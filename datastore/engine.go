@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Storage engine names accepted by OpenEngine.
+const (
+	EngineHash = "hash"
+	EngineLSM  = "lsm"
+)
+
+var ErrUnknownEngine = fmt.Errorf("unknown storage engine")
+
+// Engine is the key-value interface shared by the storage engines. Db, the
+// log-structured hash table, keeps every key in memory and additionally
+// offers versions, transactions, buckets and secondary indexes. LSM keeps
+// keys in sorted tables on disk and only holds recent writes in memory.
+//
+// The Context variants give up with ctx.Err() once ctx is done, while
+// waiting for the writer or a lock as well as while reading.
+type Engine interface {
+	Get(key string) (string, error)
+	GetInt64(key string) (int64, error)
+	Put(key, value string) (uint64, error)
+	PutInt64(key string, value int64) (uint64, error)
+	GetContext(ctx context.Context, key string) (string, error)
+	GetInt64Context(ctx context.Context, key string) (int64, error)
+	PutContext(ctx context.Context, key, value string) (uint64, error)
+	PutInt64Context(ctx context.Context, key string, value int64) (uint64, error)
+	Dump(w io.Writer) (int, error)
+	Load(r io.Reader) (int, error)
+	LoadContext(ctx context.Context, r io.Reader) (int, error)
+	Stats() (Stats, error)
+	Counters() (Counters, error)
+	Close() error
+}
+
+var (
+	_ Engine = (*Db)(nil)
+	_ Engine = (*LSM)(nil)
+)
+
+// OpenEngine opens the database in dir with the named storage engine.
+func OpenEngine(name, dir string, opts Options) (Engine, error) {
+	var db Engine
+	var err error
+	switch name {
+	case EngineHash, "":
+		db, err = OpenWithOptions(dir, opts)
+	case EngineLSM:
+		db, err = OpenLSM(dir, opts)
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownEngine, name)
+	}
+	if err != nil {
+		// Keep the result a nil interface
+		return nil, err
+	}
+	return db, nil
+}
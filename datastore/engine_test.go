@@ -0,0 +1,259 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var engineNames = []string{EngineHash, EngineLSM}
+
+// forEachEngine runs a test against every storage engine.
+func forEachEngine(t *testing.T, test func(t *testing.T, name string)) {
+	for _, name := range engineNames {
+		t.Run(name, func(t *testing.T) {
+			test(t, name)
+		})
+	}
+}
+
+func openTestEngine(t *testing.T, name, dir string, opts Options) Engine {
+	t.Helper()
+	db, err := OpenEngine(name, dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestEngine_BasicOperations(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, name string) {
+		db := openTestEngine(t, name, t.TempDir(), Options{MaxValueSize: 64})
+		defer db.Close()
+
+		if _, err := db.Put("key1", "value1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Put("key1", "value1_updated"); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := db.Get("key1"); err != nil || value != "value1_updated" {
+			t.Errorf("Get(key1) = %q, %v", value, err)
+		}
+
+		if _, err := db.PutInt64("counter", -42); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := db.GetInt64("counter"); err != nil || value != -42 {
+			t.Errorf("GetInt64(counter) = %d, %v", value, err)
+		}
+
+		if _, err := db.Get("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		if _, err := db.Get("counter"); err != ErrTypeMismatch {
+			t.Errorf("Expected ErrTypeMismatch, got %v", err)
+		}
+		if _, err := db.GetInt64("key1"); err != ErrTypeMismatch {
+			t.Errorf("Expected ErrTypeMismatch, got %v", err)
+		}
+
+		if _, err := db.Put("", "value"); err != ErrEmptyKey {
+			t.Errorf("Expected ErrEmptyKey, got %v", err)
+		}
+		if _, err := db.Put("a\x00b", "value"); err != ErrInvalidKey {
+			t.Errorf("Expected ErrInvalidKey, got %v", err)
+		}
+		if _, err := db.Put("key", strings.Repeat("v", 65)); err != ErrValueTooLarge {
+			t.Errorf("Expected ErrValueTooLarge, got %v", err)
+		}
+	})
+}
+
+func TestEngine_PersistenceAcrossRestarts(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, name string) {
+		dir := t.TempDir()
+		opts := Options{MaxSegmentSize: 1024}
+		db := openTestEngine(t, name, dir, opts)
+
+		// Several rounds of updates spread the versions of every key over
+		// many segments or tables
+		expected := make(map[string]string)
+		for round := 0; round < 3; round++ {
+			for i := 0; i < 300; i++ {
+				key := fmt.Sprintf("key_%03d", (i*7)%300)
+				value := fmt.Sprintf("value_%d_%d", round, i)
+				if _, err := db.Put(key, value); err != nil {
+					t.Fatal(err)
+				}
+				expected[key] = value
+			}
+		}
+
+		check := func(db Engine) {
+			t.Helper()
+			for key, value := range expected {
+				if got, err := db.Get(key); err != nil || got != value {
+					t.Fatalf("Get(%s) = %q, %v; expected %q", key, got, err, value)
+				}
+			}
+		}
+		check(db)
+
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db = openTestEngine(t, name, dir, opts)
+		defer db.Close()
+		check(db)
+	})
+}
+
+func TestEngine_SequenceNumbers(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, name string) {
+		dir := t.TempDir()
+		db := openTestEngine(t, name, dir, Options{})
+
+		var last uint64
+		for i := 0; i < 5; i++ {
+			seq, err := db.Put("key", fmt.Sprint(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seq <= last {
+				t.Fatalf("Sequence number %d does not follow %d", seq, last)
+			}
+			last = seq
+		}
+
+		db.Close()
+		db = openTestEngine(t, name, dir, Options{})
+		defer db.Close()
+		if seq, err := db.PutInt64("other", 1); err != nil || seq != last+1 {
+			t.Errorf("After reopen: seq = %d, %v; expected %d", seq, err, last+1)
+		}
+	})
+}
+
+func TestEngine_CanceledContext(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, name string) {
+		db := openTestEngine(t, name, t.TempDir(), Options{})
+		defer db.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if _, err := db.PutContext(ctx, "key", "value"); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+
+		if _, err := db.PutInt64Context(ctx, "counter", 1); !errors.Is(err, context.Canceled) {
+			t.Errorf("PutInt64Context: expected context.Canceled, got %v", err)
+		}
+		if _, err := db.GetContext(ctx, "key"); !errors.Is(err, context.Canceled) {
+			t.Errorf("GetContext: expected context.Canceled, got %v", err)
+		}
+		if _, err := db.LoadContext(ctx, strings.NewReader(`{"key":"loaded","type":"string","value":"v"}`)); !errors.Is(err, context.Canceled) {
+			t.Errorf("LoadContext: expected context.Canceled, got %v", err)
+		}
+		if _, err := db.GetInt64("counter"); err != ErrNotFound {
+			t.Errorf("A canceled write was stored: %v", err)
+		}
+		if _, err := db.Get("loaded"); err != ErrNotFound {
+			t.Errorf("A canceled load was stored: %v", err)
+		}
+	})
+}
+
+func TestEngine_Close(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, name string) {
+		db := openTestEngine(t, name, t.TempDir(), Options{})
+		db.Put("key", "value")
+
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Errorf("Second Close: %v", err)
+		}
+		if _, err := db.Put("key", "other"); err != ErrClosed {
+			t.Errorf("Put after Close: expected ErrClosed, got %v", err)
+		}
+		if _, err := db.Get("key"); err != ErrClosed {
+			t.Errorf("Get after Close: expected ErrClosed, got %v", err)
+		}
+	})
+}
+
+func TestEngine_ConcurrentAccess(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, name string) {
+		db := openTestEngine(t, name, t.TempDir(), Options{MaxSegmentSize: 2048})
+		defer db.Close()
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					key := fmt.Sprintf("w%d_%d", w, i)
+					if _, err := db.PutInt64(key, int64(i)); err != nil {
+						errs <- err
+						return
+					}
+					if value, err := db.GetInt64(key); err != nil || value != int64(i) {
+						errs <- fmt.Errorf("GetInt64(%s) = %d, %v", key, value, err)
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+	})
+}
+
+func TestEngine_DumpLoadAcrossEngines(t *testing.T) {
+	for _, from := range engineNames {
+		for _, to := range engineNames {
+			t.Run(from+"_to_"+to, func(t *testing.T) {
+				source := openTestEngine(t, from, t.TempDir(), Options{MaxSegmentSize: 512})
+				defer source.Close()
+				for i := 0; i < 100; i++ {
+					if _, err := source.Put(fmt.Sprintf("s%02d", i), fmt.Sprintf("value %d", i)); err != nil {
+						t.Fatal(err)
+					}
+					if _, err := source.PutInt64(fmt.Sprintf("n%02d", i), int64(i)); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				var dump bytes.Buffer
+				if n, err := source.Dump(&dump); err != nil || n != 200 {
+					t.Fatalf("Dump = %d, %v", n, err)
+				}
+
+				target := openTestEngine(t, to, t.TempDir(), Options{})
+				defer target.Close()
+				if n, err := target.Load(bytes.NewReader(dump.Bytes())); err != nil || n != 200 {
+					t.Fatalf("Load = %d, %v", n, err)
+				}
+
+				var again bytes.Buffer
+				if _, err := target.Dump(&again); err != nil {
+					t.Fatal(err)
+				}
+				if again.String() != dump.String() {
+					t.Error("Dump of the loaded database differs from the original")
+				}
+			})
+		}
+	}
+}
@@ -6,19 +6,29 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 )
 
+var ErrUnknownValueType = fmt.Errorf("unknown value type")
+
 type entry struct {
 	key         string
 	valueType   uint8
 	stringValue string
 	int64Value  int64
+	seq         uint64
+	timestamp   int64
 }
 
-// New format:
-// 0           4    8     kl+8  kl+9     kl+10 ... <-- offset
-// (full size) (kl) (key) (type) (value_data)       <-- content
-// 4           4    ....  1      depends on type    <-- length
+// Record format (format version 1):
+// 0           4     12          20   24     25    kl+25 ...  <-- offset
+// (full size) (seq) (timestamp) (kl) (type) (key) (value_data) <-- content
+// 4           8     8           4    1      kl    depends on type <-- length
+//
+// The timestamp is in Unix nanoseconds. String values are stored as a 4-byte
+// length followed by the bytes, int64 values as 8 bytes. Bucket drop markers
+// have no value; their key is the bucket's key prefix.
+const entryHeaderSize = 4 + 8 + 8 + 4 + 1
 
 func (e *entry) Encode() []byte {
 	kl := len(e.key)
@@ -33,64 +43,63 @@ func (e *entry) Encode() []byte {
 	case TypeInt64:
 		valueData = make([]byte, 8)
 		binary.LittleEndian.PutUint64(valueData, uint64(e.int64Value))
+	case typeDropBucket:
+		// Drop markers carry no value
 	default:
-		// For backward compatibility, treat unknown types as strings
-		valueData = make([]byte, 4+len(e.stringValue))
-		binary.LittleEndian.PutUint32(valueData, uint32(len(e.stringValue)))
-		copy(valueData[4:], e.stringValue)
-		e.valueType = TypeString
+		// The writer only creates records of known types
+		panic(fmt.Sprintf("datastore: cannot encode value type %d", e.valueType))
 	}
 
-	// Total size: header(4) + key_len(4) + key + type(1) + value_data
-	size := 4 + 4 + kl + 1 + len(valueData)
+	size := entryHeaderSize + kl + len(valueData)
 	result := make([]byte, size)
 
 	// Write header
 	binary.LittleEndian.PutUint32(result, uint32(size))
-	binary.LittleEndian.PutUint32(result[4:], uint32(kl))
-
-	// Write key
-	copy(result[8:], e.key)
+	binary.LittleEndian.PutUint64(result[4:], e.seq)
+	binary.LittleEndian.PutUint64(result[12:], uint64(e.timestamp))
+	binary.LittleEndian.PutUint32(result[20:], uint32(kl))
+	result[24] = e.valueType
 
-	// Write type
-	result[8+kl] = e.valueType
-
-	// Write value data
-	copy(result[8+kl+1:], valueData)
+	// Write key and value data
+	copy(result[entryHeaderSize:], e.key)
+	copy(result[entryHeaderSize+kl:], valueData)
 
 	return result
 }
 
-func (e *entry) Decode(input []byte) error {
-	if len(input) < 9 { // minimum: size(4) + key_len(4) + type(1)
-		return fmt.Errorf("input too short")
+// encodedSize returns the length of the record as encoded by Encode.
+func (e *entry) encodedSize() int {
+	size := entryHeaderSize + len(e.key)
+	switch e.valueType {
+	case TypeString:
+		size += 4 + len(e.stringValue)
+	case TypeInt64:
+		size += 8
 	}
+	return size
+}
 
-	// Read key length and key
-	keyLen := binary.LittleEndian.Uint32(input[4:8])
-	if len(input) < int(8+keyLen+1) {
-		return fmt.Errorf("input too short for key")
+func (e *entry) Decode(input []byte) error {
+	if len(input) < entryHeaderSize {
+		return fmt.Errorf("input too short")
 	}
 
-	e.key = string(input[8 : 8+keyLen])
-
-	// Read type
-	typeOffset := 8 + keyLen
-	if typeOffset >= uint32(len(input)) {
-		// Backward compatibility: if no type byte, assume string
-		e.valueType = TypeString
-		e.stringValue = string(input[8+keyLen:])
-		return nil
+	size := binary.LittleEndian.Uint32(input)
+	if int64(size) != int64(len(input)) {
+		return fmt.Errorf("entry size %d does not match input length %d", size, len(input))
 	}
 
-	e.valueType = input[typeOffset]
-	valueDataStart := typeOffset + 1
+	e.seq = binary.LittleEndian.Uint64(input[4:])
+	e.timestamp = int64(binary.LittleEndian.Uint64(input[12:]))
+	keyLen := int64(binary.LittleEndian.Uint32(input[20:]))
+	e.valueType = input[24]
 
-	if int(valueDataStart) >= len(input) {
-		return fmt.Errorf("no value data")
+	// Read key
+	if int64(len(input)) < entryHeaderSize+keyLen {
+		return fmt.Errorf("input too short for key")
 	}
-
-	valueData := input[valueDataStart:]
+	e.key = string(input[entryHeaderSize : entryHeaderSize+keyLen])
+	valueData := input[entryHeaderSize+keyLen:]
 
 	// Decode value based on type
 	switch e.valueType {
@@ -99,65 +108,77 @@ func (e *entry) Decode(input []byte) error {
 			return fmt.Errorf("invalid string value data")
 		}
 		strLen := binary.LittleEndian.Uint32(valueData[:4])
-		if len(valueData) < int(4+strLen) {
-			return fmt.Errorf("string value data too short")
+		if int64(len(valueData)) != 4+int64(strLen) {
+			return fmt.Errorf("string value length %d does not match entry size", strLen)
 		}
-		e.stringValue = string(valueData[4 : 4+strLen])
+		e.stringValue = string(valueData[4:])
 
 	case TypeInt64:
-		if len(valueData) < 8 {
+		if len(valueData) != 8 {
 			return fmt.Errorf("invalid int64 value data")
 		}
-		e.int64Value = int64(binary.LittleEndian.Uint64(valueData[:8]))
+		e.int64Value = int64(binary.LittleEndian.Uint64(valueData))
 
-	default:
-		// Backward compatibility: treat unknown types as strings
-		// Try to decode as old format (length + string)
-		if len(valueData) >= 4 {
-			strLen := binary.LittleEndian.Uint32(valueData[:4])
-			if len(valueData) >= int(4+strLen) {
-				e.stringValue = string(valueData[4 : 4+strLen])
-				e.valueType = TypeString
-			} else {
-				// Fallback: treat entire value data as string
-				e.stringValue = string(valueData)
-				e.valueType = TypeString
-			}
-		} else {
-			e.stringValue = string(valueData)
-			e.valueType = TypeString
+	case typeDropBucket:
+		if len(valueData) != 0 {
+			return fmt.Errorf("invalid bucket drop marker")
 		}
+
+	default:
+		return fmt.Errorf("%w %d for key %q", ErrUnknownValueType, e.valueType, e.key)
 	}
 
 	return nil
 }
 
 func (e *entry) DecodeFromReader(in *bufio.Reader) (int, error) {
+	return e.decodeFromReader(in, math.MaxUint32)
+}
+
+// decodeFromReader reads a record of at most maxSize bytes, as when only
+// that much of a file is left.
+func (e *entry) decodeFromReader(in *bufio.Reader, maxSize int64) (int, error) {
+	buf, err := readRecord(in, entryHeaderSize, maxSize)
+	if err != nil {
+		return len(buf), err
+	}
+
+	err = e.Decode(buf)
+	return len(buf), err
+}
+
+// readRecord reads one size-prefixed record. On a short read it returns the
+// bytes read so far with io.ErrUnexpectedEOF; at a clean end of input it
+// returns io.EOF. A size over maxSize is refused before anything is
+// allocated for it, also with io.ErrUnexpectedEOF as the record runs past
+// the end of the input.
+func readRecord(in *bufio.Reader, minSize int, maxSize int64) ([]byte, error) {
 	// Read size header
 	sizeBuf, err := in.Peek(4)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
-			return 0, err
+			if len(sizeBuf) > 0 {
+				return sizeBuf, fmt.Errorf("DecodeFromReader, cannot read size: %w", io.ErrUnexpectedEOF)
+			}
+			return nil, err
 		}
-		return 0, fmt.Errorf("DecodeFromReader, cannot read size: %w", err)
+		return nil, fmt.Errorf("DecodeFromReader, cannot read size: %w", err)
 	}
 
 	totalSize := int(binary.LittleEndian.Uint32(sizeBuf))
-	if totalSize < 9 { // minimum size
-		return 0, fmt.Errorf("invalid entry size: %d", totalSize)
+	if totalSize < minSize {
+		return nil, fmt.Errorf("invalid entry size: %d", totalSize)
+	}
+	if int64(totalSize) > maxSize {
+		return nil, fmt.Errorf("invalid entry size: %d, only %d bytes left: %w", totalSize, maxSize, io.ErrUnexpectedEOF)
 	}
 
-	// Read entire entry
+	// Read entire entry; a record cut short at the end of the file reports
+	// io.ErrUnexpectedEOF
 	buf := make([]byte, totalSize)
-	n, err := in.Read(buf)
+	n, err := io.ReadFull(in, buf)
 	if err != nil {
-		return n, fmt.Errorf("DecodeFromReader, cannot read entry: %w", err)
+		return buf[:n], fmt.Errorf("DecodeFromReader, cannot read entry: %w", err)
 	}
-
-	if n != totalSize {
-		return n, fmt.Errorf("DecodeFromReader, incomplete read: expected %d, got %d", totalSize, n)
-	}
-
-	err = e.Decode(buf)
-	return n, err
+	return buf, nil
 }
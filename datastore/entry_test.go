@@ -3,6 +3,9 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
 	"testing"
 )
 
@@ -54,3 +57,50 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("DecodeFromReader() read %d bytes, expected %d", n, len(originalBytes))
 	}
 }
+
+func TestEntry_Seq(t *testing.T) {
+	a := entry{
+		key:        "key",
+		valueType:  TypeInt64,
+		int64Value: 42,
+		seq:        7,
+		timestamp:  1700000000000000000,
+	}
+	var b entry
+	if err := b.Decode(a.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if b.seq != 7 || b.timestamp != a.timestamp || b.int64Value != 42 {
+		t.Errorf("Encode/Decode mismatch: %+v", b)
+	}
+}
+
+func TestEntry_DecodeRejectsInvalid(t *testing.T) {
+	a := entry{
+		key:         "key",
+		valueType:   TypeString,
+		stringValue: "value",
+	}
+
+	// Unknown value types are reported instead of being read as strings
+	data := a.Encode()
+	data[24] = 99
+	var b entry
+	if err := b.Decode(data); !errors.Is(err, ErrUnknownValueType) {
+		t.Errorf("Expected ErrUnknownValueType, got %v", err)
+	}
+
+	// Records whose size does not match their content are rejected
+	data = a.Encode()
+	binary.LittleEndian.PutUint32(data, uint32(len(data)+1))
+	if err := b.Decode(data); err == nil {
+		t.Error("Expected an error for a mismatched size")
+	}
+
+	// A record cut short reports io.ErrUnexpectedEOF
+	data = a.Encode()
+	_, err := b.DecodeFromReader(bufio.NewReader(bytes.NewReader(data[:len(data)-2])))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
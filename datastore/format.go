@@ -0,0 +1,121 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Every segment file starts with a header identifying the on-disk format:
+// 0       4         <-- offset
+// (magic) (version) <-- content
+// 4       4         <-- length
+const (
+	segmentMagic      = "KVDB"
+	formatVersion     = 1
+	segmentHeaderSize = 8
+)
+
+var (
+	ErrLegacyFormat       = fmt.Errorf("segment uses the legacy headerless format, migrate it with dbmigrate")
+	ErrUnsupportedVersion = fmt.Errorf("segment uses an unsupported format version")
+)
+
+func encodeSegmentHeader() []byte {
+	header := make([]byte, segmentHeaderSize)
+	copy(header, segmentMagic)
+	binary.LittleEndian.PutUint32(header[4:], formatVersion)
+	return header
+}
+
+// readSegmentVersion reads the format version from a segment header. Files
+// written before headers existed report version 0; empty files report io.EOF.
+func readSegmentVersion(in *bufio.Reader) (uint32, error) {
+	header, err := in.Peek(segmentHeaderSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	if len(header) == 0 {
+		return 0, io.EOF
+	}
+	if len(header) < segmentHeaderSize || string(header[:4]) != segmentMagic {
+		return 0, nil
+	}
+
+	_, err = in.Discard(segmentHeaderSize)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(header[4:]), nil
+}
+
+// checkSegmentHeader consumes the header of a segment file and fails unless
+// it uses the current format. Empty files are accepted.
+func checkSegmentHeader(filePath string, in *bufio.Reader) error {
+	version, err := readSegmentVersion(in)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+
+	switch {
+	case version == 0:
+		return fmt.Errorf("%s: %w", filePath, ErrLegacyFormat)
+	case version != formatVersion:
+		return fmt.Errorf("%s: %w %d (supported: %d)", filePath, ErrUnsupportedVersion, version, formatVersion)
+	}
+	return nil
+}
+
+// openSegmentReader opens a segment file for sequential reading past its
+// header.
+func openSegmentReader(fsys FS, filePath string) (File, *bufio.Reader, error) {
+	file, err := openFile(fsys, filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	if err := checkSegmentHeader(filePath, reader); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, reader, nil
+}
+
+// openSegmentForAppend opens a segment file for appending records, creating
+// it with a header if needed, and returns its size.
+func openSegmentForAppend(fsys FS, filePath string) (File, int64, error) {
+	f, err := fsys.OpenFile(filePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Get current size
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	// A new segment starts with the format header. A partly written
+	// header is removed so that the next attempt starts over.
+	size := stat.Size()
+	if size == 0 {
+		n, err := f.Write(encodeSegmentHeader())
+		if err != nil {
+			if n > 0 {
+				f.Truncate(0)
+			}
+			f.Close()
+			return nil, 0, err
+		}
+		size = int64(n)
+	}
+	return f, size, nil
+}
@@ -0,0 +1,382 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memFS is an FS that keeps all files in memory. Open files keep referring to
+// their data after a rename or removal, as on Unix.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]bool
+	locks map[string]*memLockState
+}
+
+// NewMemFS returns an empty in-memory FS, mainly useful to run databases in
+// tests without touching the disk.
+func NewMemFS() FS {
+	return &memFS{
+		files: make(map[string]*memData),
+		dirs:  map[string]bool{string(filepath.Separator): true, ".": true},
+		locks: make(map[string]*memLockState),
+	}
+}
+
+type memData struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+type memLockState struct {
+	shared    int
+	exclusive bool
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.dirs[name] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	data, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		if !m.dirs[filepath.Dir(name)] {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		data = &memData{modTime: time.Now()}
+		m.files[name] = data
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		data.mu.Lock()
+		data.data = nil
+		data.mu.Unlock()
+	}
+
+	return &memFile{
+		name:     name,
+		data:     data,
+		readable: flag&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY,
+		writable: flag&(os.O_WRONLY|os.O_RDWR) != 0,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if !m.dirs[filepath.Dir(newpath)] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = data
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if m.dirs[name] {
+		prefix := name + string(filepath.Separator)
+		for other := range m.files {
+			if strings.HasPrefix(other, prefix) {
+				return &fs.PathError{Op: "remove", Path: name, Err: fmt.Errorf("directory not empty")}
+			}
+		}
+		delete(m.dirs, name)
+		return nil
+	}
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.dirs[name] {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var entries []fs.DirEntry
+	for path, data := range m.files {
+		if filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(data.info(filepath.Base(path))))
+		}
+	}
+	for path := range m.dirs {
+		if path != name && filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(memDirInfo(filepath.Base(path))))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for dir := path; !m.dirs[dir]; dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: fs.ErrExist}
+		}
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if data, ok := m.files[name]; ok {
+		return data.info(filepath.Base(name)), nil
+	}
+	if m.dirs[name] {
+		return memDirInfo(filepath.Base(name)), nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *memFS) Lock(name string, exclusive bool) (io.Closer, error) {
+	f, err := m.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := m.locks[name]
+	if state == nil {
+		state = &memLockState{}
+		m.locks[name] = state
+	}
+	if state.exclusive || (exclusive && state.shared > 0) {
+		return nil, fmt.Errorf("%s: %w", name, ErrLocked)
+	}
+	if exclusive {
+		state.exclusive = true
+	} else {
+		state.shared++
+	}
+	return &memLock{fs: m, state: state, exclusive: exclusive}, nil
+}
+
+type memLock struct {
+	fs        *memFS
+	state     *memLockState
+	exclusive bool
+	once      sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.mu.Lock()
+		defer l.fs.mu.Unlock()
+		if l.exclusive {
+			l.state.exclusive = false
+		} else {
+			l.state.shared--
+		}
+	})
+	return nil
+}
+
+func (d *memData) info(name string) fs.FileInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return memFileInfo{name: name, size: int64(len(d.data)), modTime: d.modTime}
+}
+
+// memFile is an open file of a memFS.
+type memFile struct {
+	name     string
+	data     *memData
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) check(op string, allowed bool) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	if !allowed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", f.readable); err != nil {
+		return 0, err
+	}
+
+	f.data.mu.RLock()
+	defer f.data.mu.RUnlock()
+
+	if off >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if err := f.check("write", f.writable); err != nil {
+		return 0, err
+	}
+
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+
+	if f.append {
+		f.offset = int64(len(f.data.data))
+	}
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.data.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.data.data)
+		f.data.data = grown
+	}
+	copy(f.data.data[f.offset:], p)
+	f.offset = end
+	f.data.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check("seek", true); err != nil {
+		return 0, err
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.data.mu.RLock()
+		offset += int64(len(f.data.data))
+		f.data.mu.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	if err := f.check("stat", true); err != nil {
+		return nil, err
+	}
+	return f.data.info(filepath.Base(f.name)), nil
+}
+
+func (f *memFile) Sync() error {
+	return f.check("sync", true)
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", f.writable); err != nil {
+		return err
+	}
+
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+
+	if size < int64(len(f.data.data)) {
+		f.data.data = f.data.data[:size]
+	} else {
+		grown := make([]byte, size)
+		copy(grown, f.data.data)
+		f.data.data = grown
+	}
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() fs.FileMode  { return 0600 }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+type memDirInfo string
+
+func (d memDirInfo) Name() string       { return string(d) }
+func (d memDirInfo) Size() int64        { return 0 }
+func (d memDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0755 }
+func (d memDirInfo) ModTime() time.Time { return time.Time{} }
+func (d memDirInfo) IsDir() bool        { return true }
+func (d memDirInfo) Sys() interface{}   { return nil }
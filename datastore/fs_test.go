@@ -0,0 +1,394 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var errInjected = fmt.Errorf("injected fault")
+
+// faultFS wraps an FS and fails operations on demand. Writes beyond the
+// byte budget are cut short as on a full disk.
+type faultFS struct {
+	FS
+
+	mu          sync.Mutex
+	writeBudget int64 // negative for unlimited
+	failRename  func(oldpath, newpath string) bool
+	failSync    bool
+}
+
+func newFaultFS(fsys FS) *faultFS {
+	return &faultFS{FS: fsys, writeBudget: -1}
+}
+
+func (f *faultFS) setWriteBudget(n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writeBudget = n
+}
+
+func (f *faultFS) setFailRename(fail func(oldpath, newpath string) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failRename = fail
+}
+
+func (f *faultFS) setFailSync(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failSync = fail
+}
+
+func (f *faultFS) reset() {
+	f.setWriteBudget(-1)
+	f.setFailRename(nil)
+	f.setFailSync(false)
+}
+
+func (f *faultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *faultFS) Rename(oldpath, newpath string) error {
+	f.mu.Lock()
+	fail := f.failRename != nil && f.failRename(oldpath, newpath)
+	f.mu.Unlock()
+	if fail {
+		return fmt.Errorf("rename %s: %w", oldpath, errInjected)
+	}
+	return f.FS.Rename(oldpath, newpath)
+}
+
+// allow reserves up to n bytes of the write budget and returns how many
+// may be written.
+func (f *faultFS) allow(n int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.writeBudget < 0 {
+		return n
+	}
+	if int64(n) > f.writeBudget {
+		n = int(f.writeBudget)
+	}
+	f.writeBudget -= int64(n)
+	return n
+}
+
+type faultFile struct {
+	File
+	fs *faultFS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	allowed := f.fs.allow(len(p))
+	n, err := f.File.Write(p[:allowed])
+	if err == nil && allowed < len(p) {
+		err = fmt.Errorf("write: no space left on device: %w", errInjected)
+	}
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	fail := f.fs.failSync
+	f.fs.mu.Unlock()
+	if fail {
+		return fmt.Errorf("sync: %w", errInjected)
+	}
+	return f.File.Sync()
+}
+
+// checkAcknowledged verifies that every acknowledged value can be read.
+func checkAcknowledged(t *testing.T, db *Db, acked map[string]string) {
+	t.Helper()
+	for key, expected := range acked {
+		value, err := db.Get(key)
+		if err != nil {
+			t.Errorf("Get(%q): %v", key, err)
+		} else if value != expected {
+			t.Errorf("Get(%q) = %q, expected %q", key, value, expected)
+		}
+	}
+}
+
+// reopen closes db and opens its directory again on the FS underneath the
+// fault injection.
+func reopen(t *testing.T, db *Db, fsys FS, opts Options) *Db {
+	t.Helper()
+	db.Close()
+	opts.FS = fsys
+	db, err := OpenWithOptions(db.dir, opts)
+	if err != nil {
+		t.Fatalf("Reopen: %v", err)
+	}
+	return db
+}
+
+func mergeNow(db *Db) error {
+	req := putRequest{kind: requestMerge, result: make(chan putResult)}
+	db.putChan <- req
+	return (<-req.result).err
+}
+
+func TestFS_Memory(t *testing.T) {
+	fsys := NewMemFS()
+	db, err := OpenWithOptions("/db", Options{FS: fsys, MaxSegmentSize: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := db.Put(fmt.Sprintf("key%d", i%5), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := OpenWithOptions("/db", Options{FS: fsys}); !errors.Is(err, ErrLocked) {
+		t.Errorf("Second Open: expected ErrLocked, got %v", err)
+	}
+
+	db = reopen(t, db, fsys, Options{MaxSegmentSize: 128})
+	defer db.Close()
+	checkAcknowledged(t, db, map[string]string{
+		"key0": "value15", "key1": "value16", "key2": "value17", "key3": "value18", "key4": "value19",
+	})
+
+	entries, err := fsys.ReadDir("/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < 3 {
+		t.Errorf("Expected several segment files, got %d entries", len(entries))
+	}
+}
+
+func TestFS_DiskFullDuringWrites(t *testing.T) {
+	// Run out of space at every point of a few records, including inside
+	// segment headers written by rotation
+	for budget := int64(0); budget < 200; budget += 7 {
+		t.Run(fmt.Sprintf("budget=%d", budget), func(t *testing.T) {
+			mem := NewMemFS()
+			fsys := newFaultFS(mem)
+			opts := Options{MaxSegmentSize: 96}
+			db, err := OpenWithOptions("/db", Options{FS: fsys, MaxSegmentSize: opts.MaxSegmentSize})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			acked := make(map[string]string)
+			fsys.setWriteBudget(budget)
+			failed := false
+			for i := 0; i < 10; i++ {
+				key, value := fmt.Sprintf("key%d", i%4), fmt.Sprintf("value%d", i)
+				if _, err := db.Put(key, value); err == nil {
+					acked[key] = value
+				} else {
+					failed = true
+				}
+			}
+			if !failed {
+				t.Fatal("Expected writes to fail on a full disk")
+			}
+			checkAcknowledged(t, db, acked)
+
+			// Writes succeed again once space is freed
+			fsys.reset()
+			for i := 0; i < 10; i++ {
+				key, value := fmt.Sprintf("more%d", i%3), fmt.Sprintf("value%d", i)
+				if _, err := db.Put(key, value); err != nil {
+					t.Fatalf("Put after freeing space: %v", err)
+				}
+				acked[key] = value
+			}
+			checkAcknowledged(t, db, acked)
+
+			db = reopen(t, db, mem, opts)
+			defer db.Close()
+			checkAcknowledged(t, db, acked)
+		})
+	}
+}
+
+func TestFS_RenameFailureDuringRotation(t *testing.T) {
+	mem := NewMemFS()
+	fsys := newFaultFS(mem)
+	opts := Options{MaxSegmentSize: 96}
+	db, err := OpenWithOptions("/db", Options{FS: fsys, MaxSegmentSize: opts.MaxSegmentSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys.setFailRename(func(oldpath, newpath string) bool {
+		return filepath.Base(oldpath) == outFileName
+	})
+	acked := make(map[string]string)
+	failures := 0
+	for i := 0; i < 20; i++ {
+		key, value := fmt.Sprintf("key%d", i%6), fmt.Sprintf("value%d", i)
+		if _, err := db.Put(key, value); err != nil {
+			if !errors.Is(err, errInjected) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			failures++
+			continue
+		}
+		acked[key] = value
+	}
+	if failures == 0 {
+		t.Fatal("Expected rotation to fail")
+	}
+	checkAcknowledged(t, db, acked)
+
+	fsys.reset()
+	for i := 0; i < 20; i++ {
+		key, value := fmt.Sprintf("key%d", i%6), fmt.Sprintf("later%d", i)
+		if _, err := db.Put(key, value); err != nil {
+			t.Fatalf("Put after rename recovered: %v", err)
+		}
+		acked[key] = value
+	}
+	checkAcknowledged(t, db, acked)
+
+	db = reopen(t, db, mem, opts)
+	defer db.Close()
+	checkAcknowledged(t, db, acked)
+}
+
+func TestFS_MergeFailures(t *testing.T) {
+	faults := []struct {
+		name   string
+		inject func(fsys *faultFS)
+	}{
+		{"rename", func(fsys *faultFS) {
+			fsys.setFailRename(func(oldpath, newpath string) bool {
+				return strings.HasPrefix(filepath.Base(oldpath), "temp-merge")
+			})
+		}},
+		{"disk full", func(fsys *faultFS) { fsys.setWriteBudget(100) }},
+		{"sync", func(fsys *faultFS) { fsys.setFailSync(true) }},
+	}
+	for _, fault := range faults {
+		t.Run(fault.name, func(t *testing.T) {
+			mem := NewMemFS()
+			fsys := newFaultFS(mem)
+			opts := Options{MaxSegmentSize: 128}
+			db, err := OpenWithOptions("/db", Options{FS: fsys, MaxSegmentSize: opts.MaxSegmentSize})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			acked := make(map[string]string)
+			for i := 0; i < 40; i++ {
+				key, value := fmt.Sprintf("key%d", i%5), fmt.Sprintf("value%d", i)
+				if _, err := db.Put(key, value); err != nil {
+					t.Fatal(err)
+				}
+				acked[key] = value
+			}
+
+			fault.inject(fsys)
+			if err := mergeNow(db); !errors.Is(err, errInjected) {
+				t.Fatalf("Expected the merge to fail, got %v", err)
+			}
+			checkAcknowledged(t, db, acked)
+			if _, err := mem.Stat(filepath.Join("/db", "temp-merge")); err == nil {
+				t.Error("Failed merge left its temporary file behind")
+			}
+
+			fsys.reset()
+			if err := mergeNow(db); err != nil {
+				t.Fatalf("Merge after recovery: %v", err)
+			}
+			checkAcknowledged(t, db, acked)
+
+			db = reopen(t, db, mem, opts)
+			defer db.Close()
+			checkAcknowledged(t, db, acked)
+		})
+	}
+}
+
+func TestFS_RandomFaults(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	mem := NewMemFS()
+	fsys := newFaultFS(mem)
+	opts := Options{MaxSegmentSize: 160}
+	db, err := OpenWithOptions("/db", Options{FS: fsys, MaxSegmentSize: opts.MaxSegmentSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acked := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		fsys.reset()
+		switch rnd.Intn(10) {
+		case 0:
+			fsys.setWriteBudget(int64(rnd.Intn(64)))
+		case 1:
+			fsys.setFailRename(func(oldpath, newpath string) bool { return true })
+		case 2:
+			fsys.setFailSync(true)
+		}
+
+		if rnd.Intn(50) == 0 {
+			mergeNow(db)
+			continue
+		}
+		key, value := fmt.Sprintf("key%d", rnd.Intn(20)), fmt.Sprintf("value%d", i)
+		if _, err := db.Put(key, value); err == nil {
+			acked[key] = value
+		}
+	}
+	fsys.reset()
+	checkAcknowledged(t, db, acked)
+
+	db = reopen(t, db, mem, opts)
+	defer db.Close()
+	checkAcknowledged(t, db, acked)
+}
+
+func TestFS_TornActiveSegment(t *testing.T) {
+	fsys := NewMemFS()
+	opts := Options{FS: fsys}
+	db, err := OpenWithOptions("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// A crash in the middle of a write leaves part of a record behind
+	f, err := fsys.OpenFile(filepath.Join("/db", outFileName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := entry{key: "torn", valueType: TypeString, stringValue: "lost"}
+	f.Write(record.Encode()[:10])
+	f.Close()
+
+	db, err = OpenWithOptions("/db", opts)
+	if err != nil {
+		t.Fatalf("Open after torn write: %v", err)
+	}
+	if _, err := db.Put("after", "crash"); err != nil {
+		t.Fatal(err)
+	}
+	db = reopen(t, db, fsys, Options{})
+	defer db.Close()
+	checkAcknowledged(t, db, map[string]string{"key": "value", "after": "crash"})
+	if _, err := db.Get("torn"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for the torn record, got %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package datastore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// SegmentReport describes the records found in one segment file.
+type SegmentReport struct {
+	Name      string
+	Size      int64
+	Version   uint32 // 0 for the legacy headerless format
+	Records   int
+	Bytes     int64 // bytes taken by readable records
+	DeadBytes int64 // bytes of records superseded by newer versions
+	Types     map[uint8]int
+
+	// Offset of the first unreadable record, -1 if the whole file is valid
+	CorruptOffset int64
+	Err           error
+
+	// Bytes of a record cut short at the end of the active segment, which
+	// is still being written or was never acknowledged
+	Pending int64
+}
+
+// CheckReport is the result of checking a data directory with Check.
+type CheckReport struct {
+	Segments   []SegmentReport
+	Stray      []string // files that are not segments, e.g. leftovers of an interrupted merge
+	Keys       int      // distinct keys
+	Records    int
+	Duplicates int // records superseded by a newer version of their key
+	Dropped    int // records of keys removed by dropping their bucket
+	DeadBytes  int64
+	Types      map[uint8]int // value types of the latest version of every key
+}
+
+// Corrupted reports whether any segment contains unreadable data.
+func (r *CheckReport) Corrupted() bool {
+	for _, seg := range r.Segments {
+		if seg.CorruptOffset >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Check validates every record of the data directory dir without opening it
+// as a database. It can run while the database is open, so a record cut
+// short at the end of the active segment counts as pending rather than
+// corrupt. Corruption is reported per segment rather than returned as an
+// error; reading stops at the first bad record of a segment.
+func Check(dir string) (*CheckReport, error) {
+	lock, err := lockForRead(osFS{}, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+
+	names, stray, err := dataFileNames(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type latestRecord struct {
+		segment   int
+		size      int64
+		seq       uint64
+		valueType uint8
+	}
+	latest := make(map[string]latestRecord)
+
+	// Latest drop marker of every bucket, by key prefix
+	drops := make(map[string]latestRecord)
+	markers := 0
+
+	report := &CheckReport{
+		Stray: stray,
+		Types: make(map[uint8]int),
+	}
+	for i, name := range names {
+		seg := SegmentReport{
+			Name:  name,
+			Types: make(map[uint8]int),
+		}
+		active := name == outFileName
+		err := readDataFile(filepath.Join(dir, name), active, &seg, func(offset, size int64, e *entry) {
+			seg.Records++
+			seg.Bytes += size
+			seg.Types[e.valueType]++
+
+			if e.valueType == typeDropBucket {
+				markers++
+				if current, ok := drops[e.key]; !ok || e.seq >= current.seq {
+					drops[e.key] = latestRecord{segment: i, size: size, seq: e.seq, valueType: e.valueType}
+				}
+				return
+			}
+
+			// Same rule as the index: the highest sequence number wins
+			if current, ok := latest[e.key]; !ok || e.seq >= current.seq {
+				latest[e.key] = latestRecord{segment: i, size: size, seq: e.seq, valueType: e.valueType}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		report.Segments = append(report.Segments, seg)
+		report.Records += seg.Records
+	}
+
+	// Keys written before their bucket was dropped are gone, as when the
+	// index is rebuilt
+	for key, record := range latest {
+		name, _, ok := splitBucketKey(key)
+		if !ok {
+			continue
+		}
+		if drop, ok := drops[name+bucketSeparator]; ok && record.seq < drop.seq {
+			delete(latest, key)
+			report.Dropped++
+		}
+	}
+
+	// Everything but the latest version of each key and the latest drop
+	// marker of each bucket is dead
+	liveBytes := make([]int64, len(report.Segments))
+	for _, record := range drops {
+		liveBytes[record.segment] += record.size
+	}
+	for _, record := range latest {
+		liveBytes[record.segment] += record.size
+		report.Types[record.valueType]++
+	}
+	for i := range report.Segments {
+		seg := &report.Segments[i]
+		seg.DeadBytes = seg.Bytes - liveBytes[i]
+		report.DeadBytes += seg.DeadBytes
+	}
+	report.Keys = len(latest)
+	report.Duplicates = report.Records - report.Keys - report.Dropped - markers
+
+	return report, nil
+}
+
+// Salvage copies every readable record of the data directory dir into a new
+// data directory dst, which must not exist yet, and returns the number of
+// records copied. All versions are kept in their original order, so the
+// result opens with the same contents minus the unreadable records.
+func Salvage(dir, dst string) (int, error) {
+	lock, err := lockForRead(osFS{}, dir)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.release()
+
+	names, _, err := dataFileNames(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := os.Stat(dst); err == nil {
+		return 0, fmt.Errorf("salvage destination %s already exists", dst)
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return 0, err
+	}
+
+	out, err := os.OpenFile(filepath.Join(dst, segmentFilePrefix+"0"), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	writer := bufio.NewWriter(out)
+	writer.Write(encodeSegmentHeader())
+
+	salvaged := 0
+	for _, name := range names {
+		var seg SegmentReport
+		err := readDataFile(filepath.Join(dir, name), name == outFileName, &seg, func(offset, size int64, e *entry) {
+			writer.Write(e.Encode())
+			salvaged++
+		})
+		if err != nil {
+			return salvaged, err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return salvaged, err
+	}
+	return salvaged, out.Sync()
+}
+
+// dataFileNames lists the segment files of dir in the order they are indexed,
+// along with any other files found there.
+func dataFileNames(dir string) (segments []string, stray []string, err error) {
+	segments, err = segmentFileNames(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	known := make(map[string]bool)
+	for _, name := range segments {
+		known[name] = true
+	}
+	for _, entry := range entries {
+		if !known[entry.Name()] && !isLockFile(entry.Name()) && entry.Name() != indexDirName {
+			stray = append(stray, entry.Name())
+		}
+	}
+	return segments, stray, nil
+}
+
+// readDataFile calls fn for every readable record of a segment file in either
+// format, filling in the file-level fields of seg. A bad record ends the scan
+// and is recorded in seg, unless it is cut short at the end of the active
+// segment; only I/O errors are returned.
+func readDataFile(filePath string, active bool, seg *SegmentReport, fn func(offset, size int64, e *entry)) error {
+	seg.CorruptOffset = -1
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	seg.Size = stat.Size()
+
+	reader := bufio.NewReader(file)
+	version, err := readSegmentVersion(reader)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+	seg.Version = version
+
+	offset := int64(0)
+	if version != 0 {
+		offset = segmentHeaderSize
+	}
+	if version > formatVersion {
+		seg.CorruptOffset = 0
+		seg.Err = fmt.Errorf("%w %d", ErrUnsupportedVersion, version)
+		return nil
+	}
+
+	for {
+		var record entry
+		var n int
+		if version == 0 {
+			var buf []byte
+			buf, err = readRecord(reader, 9, seg.Size-offset)
+			n = len(buf)
+			if err == nil {
+				err = record.decodeLegacy(buf)
+			}
+		} else {
+			n, err = record.decodeFromReader(reader, seg.Size-offset)
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if active && errors.Is(err, io.ErrUnexpectedEOF) {
+				seg.Pending = seg.Size - offset
+				return nil
+			}
+			seg.CorruptOffset = offset
+			seg.Err = err
+			return nil
+		}
+
+		fn(offset, int64(n), &record)
+		offset += int64(n)
+	}
+}
@@ -0,0 +1,219 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCheck_ReportsCorruption(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithMaxSegmentSize(tmp, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := db.Put(fmt.Sprintf("fsck_key_%d", i%5), fmt.Sprintf("value_%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.PutInt64("fsck_counter", 3); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	report, err := Check(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Corrupted() {
+		t.Fatalf("Unexpected corruption: %+v", report.Segments)
+	}
+	if report.Keys != 6 || report.Records != 11 || report.Duplicates != 5 {
+		t.Errorf("Unexpected counts: keys=%d records=%d duplicates=%d", report.Keys, report.Records, report.Duplicates)
+	}
+	if report.Types[TypeString] != 5 || report.Types[TypeInt64] != 1 {
+		t.Errorf("Unexpected type distribution: %v", report.Types)
+	}
+	if report.DeadBytes <= 0 {
+		t.Errorf("Expected dead bytes from overwritten keys, got %d", report.DeadBytes)
+	}
+
+	// Damage the value type of the last record
+	path := filepath.Join(tmp, outFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := entry{key: "fsck_counter", valueType: TypeInt64}
+	lastOffset := int64(len(data) - len(last.Encode()))
+	data[lastOffset+24] = 77
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(tmp); err == nil {
+		t.Fatal("Expected Open to fail on a corrupted segment")
+	}
+
+	report, err = Check(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := report.Segments[len(report.Segments)-1]
+	if seg.CorruptOffset != lastOffset {
+		t.Errorf("Expected corruption at offset %d, got %d (%v)", lastOffset, seg.CorruptOffset, seg.Err)
+	}
+
+	// Everything before the damaged record can be salvaged
+	dst := filepath.Join(t.TempDir(), "salvaged")
+	n, err := Salvage(tmp, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Errorf("Expected 10 salvaged records, got %d", n)
+	}
+
+	salvaged, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer salvaged.Close()
+	for i := 5; i < 10; i++ {
+		key := fmt.Sprintf("fsck_key_%d", i%5)
+		value, err := salvaged.Get(key)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", key, err)
+		}
+		if value != fmt.Sprintf("value_%d", i) {
+			t.Errorf("Key %s: got %q", key, value)
+		}
+	}
+	if _, err := salvaged.GetInt64("fsck_counter"); err != ErrNotFound {
+		t.Errorf("Expected the damaged record to be dropped, got %v", err)
+	}
+}
+
+func TestCheck_DamagedRecordSize(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// Make the second record of a sealed segment claim almost 4GB
+	path := filepath.Join(tmp, segmentFilePrefix+"1")
+	if err := os.Rename(filepath.Join(tmp, outFileName), path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := int64(segmentHeaderSize) + int64(binary.LittleEndian.Uint32(data[segmentHeaderSize:]))
+	binary.LittleEndian.PutUint32(data[second:], 0xFFFFFFF0)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	report, err := Check(tmp)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("Checking allocated %d bytes", allocated)
+	}
+	seg := report.Segments[len(report.Segments)-1]
+	if seg.CorruptOffset != second || report.Records != 1 {
+		t.Errorf("Expected corruption at offset %d after 1 record, got %d after %d (%v)", second, seg.CorruptOffset, report.Records, seg.Err)
+	}
+}
+
+func TestCheck_PendingRecord(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// Append the first half of a record, as a write in flight leaves it
+	path := filepath.Join(tmp, outFileName)
+	record := (&entry{key: "key3", valueType: TypeString, stringValue: "value"}).Encode()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(record[:len(record)/2]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	report, err := Check(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Corrupted() {
+		t.Fatalf("Unexpected corruption: %+v", report.Segments)
+	}
+	seg := report.Segments[len(report.Segments)-1]
+	if seg.Pending != int64(len(record)/2) || report.Records != 3 {
+		t.Errorf("Expected %d pending bytes after 3 records, got %d after %d", len(record)/2, seg.Pending, report.Records)
+	}
+}
+
+func TestCheck_DroppedBucket(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := db.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := users.Put(fmt.Sprintf("user%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Put("plain", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropBucket("users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Put("user0", "again"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	report, err := Check(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Keys != 2 || report.Dropped != 2 || report.Records != 6 || report.Duplicates != 1 {
+		t.Errorf("Unexpected counts: keys=%d dropped=%d records=%d duplicates=%d", report.Keys, report.Dropped, report.Records, report.Duplicates)
+	}
+	if report.Types[TypeString] != 2 {
+		t.Errorf("Unexpected type distribution: %v", report.Types)
+	}
+}
@@ -0,0 +1,299 @@
+package datastore
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// indexShardCount is the number of shards of the in-memory index. Keys are
+// spread over the shards by hash and every shard has its own lock, so
+// readers and the writer only contend when they touch the same shard.
+const indexShardCount = 64
+
+// indexTable holds the entries of one index shard and is guarded by the
+// shard's lock: get, len and forEach run under the read lock, the others
+// under the write lock.
+type indexTable interface {
+	get(key string) (indexEntry, bool)
+	set(key string, location indexEntry)
+	delete(key string)
+	len() int
+	forEach(fn func(key string, location indexEntry))
+
+	// memoryBytes estimates the memory the table holds.
+	memoryBytes() int64
+}
+
+func (m hashIndex) get(key string) (indexEntry, bool) {
+	location, ok := m[key]
+	return location, ok
+}
+
+func (m hashIndex) set(key string, location indexEntry) {
+	m[key] = location
+}
+
+func (m hashIndex) delete(key string) {
+	delete(m, key)
+}
+
+func (m hashIndex) len() int {
+	return len(m)
+}
+
+func (m hashIndex) forEach(fn func(key string, location indexEntry)) {
+	for key, location := range m {
+		fn(key, location)
+	}
+}
+
+func (m hashIndex) memoryBytes() int64 {
+	var n int64
+	for key := range m {
+		n += int64(len(key)) + indexEntryOverhead
+	}
+	return n
+}
+
+type indexShard struct {
+	mu      sync.RWMutex
+	entries indexTable
+}
+
+// shardedIndex maps every key to the location of its latest record.
+type shardedIndex struct {
+	shards []indexShard
+
+	// Kept in step with the tables for cheap metrics: the bytes of the
+	// records the index points at and of the keys, which only count towards
+	// the memory of hash tables
+	liveBytes atomic.Int64
+	keyBytes  atomic.Int64
+
+	// Set once a table failed to read or write its files. The index may
+	// be missing changes from then on, so it must not be used.
+	failure atomic.Pointer[error]
+}
+
+func newShardedIndex(shardCount int) *shardedIndex {
+	idx := &shardedIndex{shards: make([]indexShard, shardCount)}
+	for i := range idx.shards {
+		idx.shards[i].entries = make(hashIndex)
+	}
+	return idx
+}
+
+// fail records the first error of a table.
+func (idx *shardedIndex) fail(err error) {
+	idx.failure.CompareAndSwap(nil, &err)
+}
+
+// err returns the error that made the index unusable, if any. Lookups do
+// not return errors themselves, so their callers check it.
+func (idx *shardedIndex) err() error {
+	if err := idx.failure.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// close releases the files of the tables kept on disk.
+func (idx *shardedIndex) close() error {
+	var firstErr error
+	for i := range idx.shards {
+		if closer, ok := idx.shards[i].entries.(io.Closer); ok {
+			if err := closer.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// shardOf returns the shard holding key, using the 32-bit FNV-1a hash.
+func (idx *shardedIndex) shardOf(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(idx.shards)))
+}
+
+// keyHash64 is the 64-bit FNV-1a hash of key, for placing keys within a
+// shard. It is unrelated to the shard hash, which all keys of a shard
+// share modulo the shard count.
+func keyHash64(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (idx *shardedIndex) get(key string) (indexEntry, bool) {
+	shard := &idx.shards[idx.shardOf(key)]
+	shard.mu.RLock()
+	location, ok := shard.entries.get(key)
+	shard.mu.RUnlock()
+	return location, ok
+}
+
+func (idx *shardedIndex) set(key string, location indexEntry) {
+	shard := &idx.shards[idx.shardOf(key)]
+	shard.mu.Lock()
+	idx.setIn(shard, key, location)
+	shard.mu.Unlock()
+}
+
+// setIn points key at location in its locked shard.
+func (idx *shardedIndex) setIn(shard *indexShard, key string, location indexEntry) {
+	if previous, ok := shard.entries.get(key); ok {
+		idx.liveBytes.Add(int64(location.size) - int64(previous.size))
+	} else {
+		idx.liveBytes.Add(int64(location.size))
+		idx.keyBytes.Add(int64(len(key)))
+	}
+	shard.entries.set(key, location)
+}
+
+// deleteIn removes key from its locked shard.
+func (idx *shardedIndex) deleteIn(shard *indexShard, key string) {
+	if previous, ok := shard.entries.get(key); ok {
+		idx.liveBytes.Add(-int64(previous.size))
+		idx.keyBytes.Add(-int64(len(key)))
+		shard.entries.delete(key)
+	}
+}
+
+// counts returns the number of keys, the live bytes and the memory and disk
+// bytes of the index without walking the keys.
+func (idx *shardedIndex) counts() (keys int, liveBytes, memoryBytes, diskBytes int64) {
+	hashed := false
+	for i := range idx.shards {
+		shard := &idx.shards[i]
+		shard.mu.RLock()
+		keys += shard.entries.len()
+		switch table := shard.entries.(type) {
+		case hashIndex:
+			// Estimated from keyBytes below instead of walking the map
+			hashed = true
+		case *diskTable:
+			memoryBytes += table.memoryBytes()
+			diskBytes += table.diskBytes()
+		default:
+			memoryBytes += table.memoryBytes()
+		}
+		shard.mu.RUnlock()
+	}
+	if hashed {
+		memoryBytes += idx.keyBytes.Load() + int64(keys)*indexEntryOverhead
+	}
+	return keys, idx.liveBytes.Load(), memoryBytes, diskBytes
+}
+
+// keys returns the keys accepted by filter, sorted. The shards are read one
+// after another, so keys written meanwhile may or may not be included.
+func (idx *shardedIndex) keys(filter func(key string) bool) []string {
+	var keys []string
+	for i := range idx.shards {
+		shard := &idx.shards[i]
+		shard.mu.RLock()
+		shard.entries.forEach(func(key string, _ indexEntry) {
+			if filter(key) {
+				keys = append(keys, key)
+			}
+		})
+		shard.mu.RUnlock()
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// repoint moves keys to the locations a merge wrote their latest records
+// to, shard by shard. Keys whose current record is outside the merged
+// segments have been written since and keep their entries.
+func (idx *shardedIndex) repoint(locations hashIndex, mergedIDs map[int]bool) {
+	byShard := make([][]string, len(idx.shards))
+	for key := range locations {
+		i := idx.shardOf(key)
+		byShard[i] = append(byShard[i], key)
+	}
+
+	for i, keys := range byShard {
+		if len(keys) == 0 {
+			continue
+		}
+		shard := &idx.shards[i]
+		shard.mu.Lock()
+		for _, key := range keys {
+			if current, ok := shard.entries.get(key); ok && mergedIDs[current.segmentID] {
+				idx.setIn(shard, key, locations[key])
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// indexBatch holds the locks of the shards a batch of changes touches, so
+// readers see either none or all of the changes.
+type indexBatch struct {
+	idx    *shardedIndex
+	locked []int
+}
+
+// lock locks the shards holding keys. Shards are always locked in
+// ascending order, so concurrent batches cannot deadlock.
+func (idx *shardedIndex) lock(keys []string) *indexBatch {
+	seen := make(map[int]bool, len(keys))
+	b := &indexBatch{idx: idx}
+	for _, key := range keys {
+		i := idx.shardOf(key)
+		if !seen[i] {
+			seen[i] = true
+			b.locked = append(b.locked, i)
+		}
+	}
+	sort.Ints(b.locked)
+	for _, i := range b.locked {
+		idx.shards[i].mu.Lock()
+	}
+	return b
+}
+
+// lockAll locks every shard, as needed to drop a bucket.
+func (idx *shardedIndex) lockAll() *indexBatch {
+	b := &indexBatch{idx: idx, locked: make([]int, len(idx.shards))}
+	for i := range idx.shards {
+		b.locked[i] = i
+		idx.shards[i].mu.Lock()
+	}
+	return b
+}
+
+// set points key at a new location. The shard of key must be locked.
+func (b *indexBatch) set(key string, location indexEntry) {
+	b.idx.setIn(&b.idx.shards[b.idx.shardOf(key)], key, location)
+}
+
+// dropBuckets removes the keys written before their bucket's latest drop
+// marker. drops maps bucket key prefixes to drop marker sequence numbers.
+// All shards must be locked.
+func (b *indexBatch) dropBuckets(drops map[string]uint64) {
+	for i := range b.idx.shards {
+		shard := &b.idx.shards[i]
+		for _, key := range droppedKeys(shard.entries, drops) {
+			b.idx.deleteIn(shard, key)
+		}
+	}
+}
+
+func (b *indexBatch) unlock() {
+	for _, i := range b.locked {
+		b.idx.shards[i].mu.Unlock()
+	}
+	b.locked = nil
+}
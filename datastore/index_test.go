@@ -0,0 +1,256 @@
+package datastore
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardedIndex_BatchesAreAtomic(t *testing.T) {
+	idx := newShardedIndex(indexShardCount)
+	keys := []string{"alpha", "beta", "gamma", "delta"}
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for seq := uint64(1); seq <= 2000; seq++ {
+			batch := idx.lock(keys)
+			for _, key := range keys {
+				batch.set(key, indexEntry{seq: seq})
+			}
+			batch.unlock()
+		}
+		stop.Store(true)
+	}()
+
+	// A reader that saw the first key of a batch must see the rest of it
+	for !stop.Load() {
+		first, _ := idx.get(keys[0])
+		last, _ := idx.get(keys[len(keys)-1])
+		if last.seq < first.seq {
+			t.Fatalf("Saw %s at %d after %s at %d", keys[len(keys)-1], last.seq, keys[0], first.seq)
+		}
+	}
+	wg.Wait()
+
+	for _, key := range keys {
+		if location, ok := idx.get(key); !ok || location.seq != 2000 {
+			t.Errorf("%s: expected seq 2000, got %d (%v)", key, location.seq, ok)
+		}
+	}
+}
+
+func TestShardedIndex_RepointAndDrop(t *testing.T) {
+	idx := newShardedIndex(8)
+	for i := 0; i < 100; i++ {
+		idx.set(fmt.Sprintf("key%d", i), indexEntry{segmentID: 0, seq: uint64(i + 1)})
+		idx.set(fmt.Sprintf("b\x00key%d", i), indexEntry{segmentID: 0, seq: uint64(i + 1)})
+	}
+	// key0 was written again after the merge started
+	idx.set("key0", indexEntry{segmentID: 2, seq: 500})
+
+	locations := make(hashIndex)
+	for i := 0; i < 100; i++ {
+		locations[fmt.Sprintf("key%d", i)] = indexEntry{segmentID: 1, offset: int64(i), seq: uint64(i + 1)}
+	}
+	idx.repoint(locations, map[int]bool{0: true})
+
+	if location, _ := idx.get("key0"); location.segmentID != 2 {
+		t.Errorf("A newer write was repointed to segment %d", location.segmentID)
+	}
+	if location, _ := idx.get("key42"); location.segmentID != 1 || location.offset != 42 {
+		t.Errorf("key42 was not repointed: %+v", location)
+	}
+
+	batch := idx.lockAll()
+	batch.dropBuckets(map[string]uint64{"b\x00": 51})
+	batch.unlock()
+	if keys := idx.keys(func(key string) bool { return !validKey(key) }); len(keys) != 50 {
+		t.Errorf("Expected the 50 bucket keys written after the drop, got %d", len(keys))
+	}
+	if keys := idx.keys(validKey); len(keys) != 100 || keys[0] != "key0" {
+		t.Errorf("Unexpected default keys: %d", len(keys))
+	}
+}
+
+// BenchmarkShardedIndex compares the sharded index to a single shard, which
+// behaves like one map behind one lock, under parallel readers and a writer
+// share of one operation in ten.
+func BenchmarkShardedIndex(b *testing.B) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("bench_key_%d", i)
+	}
+
+	for _, shards := range []int{1, indexShardCount} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			idx := newShardedIndex(shards)
+			for i, key := range keys {
+				idx.set(key, indexEntry{seq: uint64(i)})
+			}
+
+			var next atomic.Uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(next.Add(1)) * 7919
+				for pb.Next() {
+					key := keys[i%len(keys)]
+					if i%10 == 0 {
+						idx.set(key, indexEntry{seq: uint64(i)})
+					} else {
+						idx.get(key)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkSegmentedDb_ParallelGet(b *testing.B) {
+	db, err := OpenWithMaxSegmentSize(b.TempDir(), 10*1024*1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		if _, err := db.Put(fmt.Sprintf("bench_key_%d", i), fmt.Sprintf("bench_value_%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var next atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(next.Add(1)) * 7919
+		for pb.Next() {
+			if _, err := db.Get(fmt.Sprintf("bench_key_%d", i%1000)); err != nil {
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkSegmentedDb_ParallelMixed(b *testing.B) {
+	db, err := OpenWithMaxSegmentSize(b.TempDir(), 10*1024*1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		if _, err := db.Put(fmt.Sprintf("bench_key_%d", i), fmt.Sprintf("bench_value_%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var next atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(next.Add(1)) * 7919
+		for pb.Next() {
+			key := fmt.Sprintf("bench_key_%d", i%1000)
+			var err error
+			if i%10 == 0 {
+				_, err = db.Put(key, "updated")
+			} else {
+				_, err = db.Get(key)
+			}
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+}
+
+func TestRebuildIndex_ParallelMatchesSequential(t *testing.T) {
+	fsys := NewMemFS()
+	db, err := OpenWithOptions("/db", Options{FS: fsys, MaxSegmentSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, _ := db.Bucket("tmp")
+	for i := 0; i < 600; i++ {
+		if _, err := db.Put(fmt.Sprintf("key%d", i%150), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.PutInt64(fmt.Sprintf("n%d", i%40), int64(i)); err != nil {
+			t.Fatal(err)
+		}
+		if i == 300 {
+			if err := db.DropBucket("tmp"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	db.Close()
+
+	snapshot := func(workers int) (hashIndex, uint64) {
+		db, err := OpenWithOptions("/db", Options{FS: fsys, MaxSegmentSize: 512, IndexWorkers: workers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		all := make(hashIndex)
+		for i := range db.index.shards {
+			db.index.shards[i].entries.forEach(func(key string, location indexEntry) {
+				all[key] = location
+			})
+		}
+		return all, db.LastSeq()
+	}
+
+	expected, expectedSeq := snapshot(1)
+	if len(expected) != 190 {
+		t.Fatalf("Expected 190 keys, got %d", len(expected))
+	}
+	for _, workers := range []int{2, 8} {
+		index, seq := snapshot(workers)
+		if seq != expectedSeq {
+			t.Errorf("%d workers: last sequence number %d, expected %d", workers, seq, expectedSeq)
+		}
+		if len(index) != len(expected) {
+			t.Errorf("%d workers: %d keys, expected %d", workers, len(index), len(expected))
+		}
+		for key, location := range expected {
+			if index[key] != location {
+				t.Errorf("%d workers: %q at %+v, expected %+v", workers, key, index[key], location)
+			}
+		}
+	}
+}
+
+func BenchmarkSegmentedDb_Open(b *testing.B) {
+	dir := b.TempDir()
+	db, err := OpenWithMaxSegmentSize(dir, 64*1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 50000; i++ {
+		if _, err := db.Put(fmt.Sprintf("bench_key_%d", i), fmt.Sprintf("bench_value_%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	db.Close()
+
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				db, err := OpenWithOptions(dir, Options{MaxSegmentSize: 64 * 1024, IndexWorkers: workers})
+				if err != nil {
+					b.Fatal(err)
+				}
+				db.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package datastore
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	defaultMaxKeySize   = 4 * 1024
+	defaultMaxValueSize = 1024 * 1024 // 1MB, or the segment size if smaller
+)
+
+var (
+	ErrEmptyKey      = fmt.Errorf("key must not be empty")
+	ErrKeyTooLarge   = fmt.Errorf("key exceeds the maximum key size")
+	ErrValueTooLarge = fmt.Errorf("value exceeds the maximum value size")
+)
+
+// applyLimitDefaults fills in and validates the size limits of opts. It runs
+// after the segment size default has been applied.
+func applyLimitDefaults(opts *Options) error {
+	if opts.MaxKeySize <= 0 {
+		opts.MaxKeySize = defaultMaxKeySize
+	}
+	if opts.MaxValueSize <= 0 {
+		opts.MaxValueSize = defaultMaxValueSize
+		if int64(opts.MaxValueSize) > opts.MaxSegmentSize {
+			opts.MaxValueSize = int(opts.MaxSegmentSize)
+		}
+	}
+
+	if int64(opts.MaxValueSize) > opts.MaxSegmentSize {
+		return fmt.Errorf("MaxValueSize %d exceeds MaxSegmentSize %d", opts.MaxValueSize, opts.MaxSegmentSize)
+	}
+	// Record sizes are stored as 32-bit lengths
+	if int64(entryHeaderSize)+int64(opts.MaxKeySize)+4+int64(opts.MaxValueSize) > math.MaxUint32 {
+		return fmt.Errorf("MaxKeySize %d and MaxValueSize %d exceed the maximum record size", opts.MaxKeySize, opts.MaxValueSize)
+	}
+	return nil
+}
+
+// checkWrite validates a record about to be written under key, which is the
+// key as given by the caller, without any bucket prefix.
+func (db *Db) checkWrite(key string, e *entry) error {
+	return checkLimits(key, e, db.maxKeySize, db.maxValueSize)
+}
+
+// checkLimits validates a record against the key and value size limits of
+// an engine.
+func checkLimits(key string, e *entry, maxKeySize, maxValueSize int) error {
+	switch {
+	case key == "":
+		return ErrEmptyKey
+	case len(key) > maxKeySize:
+		return ErrKeyTooLarge
+	case !validKey(key):
+		return ErrInvalidKey
+	case e.valueType == TypeString && len(e.stringValue) > maxValueSize:
+		return ErrValueTooLarge
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package datastore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLimits_Put(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{
+		MaxSegmentSize: 4096,
+		MaxKeySize:     16,
+		MaxValueSize:   64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	bucket, _ := db.Bucket("b")
+	tests := []struct {
+		name     string
+		put      func() (uint64, error)
+		expected error
+	}{
+		{"key at limit", func() (uint64, error) { return db.Put(strings.Repeat("k", 16), "v") }, nil},
+		{"value at limit", func() (uint64, error) { return db.Put("k", strings.Repeat("v", 64)) }, nil},
+		{"empty key", func() (uint64, error) { return db.PutInt64("", 1) }, ErrEmptyKey},
+		{"key too large", func() (uint64, error) { return db.PutInt64(strings.Repeat("k", 17), 1) }, ErrKeyTooLarge},
+		{"value too large", func() (uint64, error) { return db.Put("k", strings.Repeat("v", 65)) }, ErrValueTooLarge},
+		{"bucket value too large", func() (uint64, error) { return bucket.Put("k", strings.Repeat("v", 65)) }, ErrValueTooLarge},
+		{"bucket key at limit", func() (uint64, error) { return bucket.Put(strings.Repeat("k", 14), "v") }, nil},
+		{"bucket key too large", func() (uint64, error) { return bucket.Put(strings.Repeat("k", 15), "v") }, ErrKeyTooLarge},
+	}
+	for _, tt := range tests {
+		if _, err := tt.put(); err != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, err)
+		}
+	}
+
+	// Oversized values are not written at all
+	if value, _ := db.Get("k"); value != strings.Repeat("v", 64) {
+		t.Errorf("Rejected write changed the value to %d bytes", len(value))
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		tx.Put("k", strings.Repeat("v", 65))
+		return nil
+	})
+	if err != ErrValueTooLarge {
+		t.Errorf("Transaction: expected ErrValueTooLarge, got %v", err)
+	}
+
+	_, err = db.Load(strings.NewReader(`{"key":"` + strings.Repeat("k", 17) + `","type":"string","value":"v"}`))
+	if !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Load: expected ErrKeyTooLarge, got %v", err)
+	}
+	_, err = db.Load(strings.NewReader(`{"bucket":"b","key":"` + strings.Repeat("k", 15) + `","type":"string","value":"v"}`))
+	if !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Load into a bucket: expected ErrKeyTooLarge, got %v", err)
+	}
+
+	// A name leaving no room for a key is refused up front
+	if _, err := db.Bucket(strings.Repeat("b", 15)); err != ErrInvalidBucket {
+		t.Errorf("Expected ErrInvalidBucket for a name filling the key size, got %v", err)
+	}
+	if _, err := db.Bucket(strings.Repeat("b", 14)); err != nil {
+		t.Errorf("Expected a name leaving room for a 1-byte key, got %v", err)
+	}
+}
+
+func TestLimits_Options(t *testing.T) {
+	_, err := OpenWithOptions(t.TempDir(), Options{MaxSegmentSize: 1024, MaxValueSize: 2048})
+	if err == nil {
+		t.Error("Expected an error for MaxValueSize above MaxSegmentSize")
+	}
+
+	// The default value limit never exceeds the segment size
+	db, err := OpenWithMaxSegmentSize(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Put("k", strings.Repeat("v", 101)); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+}
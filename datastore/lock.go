@@ -0,0 +1,104 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// A database directory is guarded by two advisory lock files. The writer
+// holds LOCK.write exclusively and LOCK shared; read-only opens and inspection
+// tools hold LOCK shared, so they can run next to the writer. Tools that
+// rewrite files, like Migrate, hold LOCK exclusively. Readers only open an
+// existing LOCK and never create files, so read-only mounts work.
+const (
+	lockFileName      = "LOCK"
+	writeLockFileName = "LOCK.write"
+
+	// legacyReadLockFileName was held by readers of older versions.
+	legacyReadLockFileName = "LOCK.read"
+)
+
+var ErrLocked = fmt.Errorf("database directory is locked by another process")
+
+// dirLock holds the lock files of a database directory until released.
+type dirLock struct {
+	files []io.Closer
+}
+
+// lockForWrite locks dir for a database opened for writing.
+func lockForWrite(fsys FS, dir string) (*dirLock, error) {
+	return lockDir(fsys, dir,
+		lockSpec{name: writeLockFileName, exclusive: true, create: true},
+		lockSpec{name: lockFileName, create: true})
+}
+
+// lockForRead locks dir for reading next to a possible writer. A directory
+// without LOCK has never been opened for writing, so there is nothing to lock.
+func lockForRead(fsys FS, dir string) (*dirLock, error) {
+	return lockDir(fsys, dir, lockSpec{name: lockFileName})
+}
+
+// lockForMaintenance locks dir against writers and readers alike.
+func lockForMaintenance(fsys FS, dir string) (*dirLock, error) {
+	return lockDir(fsys, dir, lockSpec{name: lockFileName, exclusive: true, create: true})
+}
+
+type lockSpec struct {
+	name      string
+	exclusive bool
+	// create makes the lock file if it is missing; otherwise a missing file
+	// is skipped.
+	create bool
+}
+
+func lockDir(fsys FS, dir string, specs ...lockSpec) (*dirLock, error) {
+	lock := &dirLock{}
+	for _, spec := range specs {
+		path := filepath.Join(dir, spec.name)
+		if spec.create {
+			if err := createLockFile(fsys, path); err != nil {
+				lock.release()
+				return nil, err
+			}
+		}
+		f, err := fsys.Lock(path, spec.exclusive)
+		if !spec.create && errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			lock.release()
+			return nil, err
+		}
+		lock.files = append(lock.files, f)
+	}
+	return lock, nil
+}
+
+func (l *dirLock) release() error {
+	var firstErr error
+	for _, f := range l.files {
+		// Closing the file drops the lock
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	l.files = nil
+	return firstErr
+}
+
+func createLockFile(fsys FS, path string) error {
+	f, err := fsys.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// isLockFile reports whether name is one of the lock files of a directory.
+func isLockFile(name string) bool {
+	return name == lockFileName || name == writeLockFileName || name == legacyReadLockFileName
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package datastore
+
+import "os"
+
+// lockFile only opens the lock file: advisory locks are implemented on Unix
+// systems only, elsewhere the directory is not protected.
+func lockFile(path string, exclusive bool) (*os.File, error) {
+	return os.Open(path)
+}
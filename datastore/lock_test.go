@@ -0,0 +1,107 @@
+//go:build unix
+
+package datastore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLock_ExclusiveWriter(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(dir); !errors.Is(err, ErrLocked) {
+		t.Errorf("Second Open: expected ErrLocked, got %v", err)
+	}
+	if _, err := Migrate(dir); !errors.Is(err, ErrLocked) {
+		t.Errorf("Migrate: expected ErrLocked, got %v", err)
+	}
+
+	// Inspection works next to the writer
+	if _, err := Check(dir); err != nil {
+		t.Errorf("Check: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Open after Close: %v", err)
+	}
+	db.Close()
+}
+
+func TestLock_ReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenWithMaxSegmentSize(dir, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if _, err := db.PutInt64("counter", int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ro, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro2, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatalf("Second read-only open: %v", err)
+	}
+	ro2.Close()
+	if _, err := os.Stat(filepath.Join(dir, legacyReadLockFileName)); !os.IsNotExist(err) {
+		t.Errorf("Read-only open created %s", legacyReadLockFileName)
+	}
+
+	if value, err := ro.GetInt64("counter"); err != nil || value != 9 {
+		t.Errorf("Read-only GetInt64 = %d, %v", value, err)
+	}
+	if _, err := ro.Put("key", "value"); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+	err = ro.Update(func(tx *Tx) error {
+		tx.Put("key", "value")
+		return nil
+	})
+	if err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly from Update, got %v", err)
+	}
+
+	// Readers keep maintenance out
+	if _, err := Migrate(dir); !errors.Is(err, ErrLocked) {
+		t.Errorf("Migrate: expected ErrLocked, got %v", err)
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read-only opens never create anything
+	missing := filepath.Join(t.TempDir(), "missing")
+	if _, err := OpenReadOnly(missing); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("Read-only open created %s", missing)
+	}
+	empty := t.TempDir()
+	ro, err = OpenReadOnly(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro.Close()
+	if entries, err := os.ReadDir(empty); err != nil || len(entries) != 0 {
+		t.Errorf("Read-only open created %v (%v)", entries, err)
+	}
+}
@@ -0,0 +1,678 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName            = "lsm-wal"
+	tableFilePrefix        = "sst-"
+	tempTableFileName      = "temp-table"
+	tempCompactionFileName = "temp-compaction"
+
+	// maxTables is the number of tables after which they are compacted
+	// into one.
+	maxTables = 4
+)
+
+// LSM is a storage engine built as a log-structured merge tree. Writes go
+// to a write-ahead log and an in-memory memtable; once the log reaches
+// Options.MaxSegmentSize, the memtable is flushed to a sorted table on disk.
+// Only the memtable and a sparse index and bloom filter per table are kept
+// in memory, so the number of keys is not bounded by memory. Only the
+// latest version of every key is kept.
+type LSM struct {
+	fs           FS
+	dir          string
+	lock         *dirLock
+	memtableSize int64
+	maxKeySize   int
+	maxValueSize int
+
+	// compactions tracks the background compaction, which Close waits for
+	compactions sync.WaitGroup
+
+	// mu guards the fields below. Writes, flushes and the end of a
+	// compaction hold it exclusively, lookups shared.
+	mu            sync.RWMutex
+	memtable      map[string]entry
+	memtableBytes int64 // encoded size of the records in the memtable
+	wal           File
+	walOffset     int64
+	tables        []*sstable // oldest first
+	nextTableID   int
+	lastSeq       uint64
+	lastTimestamp int64
+	compacting    bool
+	compactStats  mergeStats
+
+	// Set when the log could not be repaired after a failed write; all
+	// later writes fail with it
+	writeErr error
+
+	closed bool
+}
+
+// OpenLSM opens or creates an LSM database in dir. Options.MaxVersions and
+// Options.VersionRetention do not apply.
+func OpenLSM(dir string, opts Options) (*LSM, error) {
+	if len(opts.Indexes) > 0 {
+		return nil, fmt.Errorf("secondary indexes are not supported by the LSM engine")
+	}
+	if opts.FS == nil {
+		opts.FS = osFS{}
+	}
+	if opts.MaxSegmentSize <= 0 {
+		opts.MaxSegmentSize = defaultMaxSegmentSize
+	}
+	if err := applyLimitDefaults(&opts); err != nil {
+		return nil, err
+	}
+	if err := opts.FS.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockForWrite(opts.FS, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &LSM{
+		fs:           opts.FS,
+		dir:          dir,
+		lock:         lock,
+		memtableSize: opts.MaxSegmentSize,
+		maxKeySize:   opts.MaxKeySize,
+		maxValueSize: opts.MaxValueSize,
+		memtable:     make(map[string]entry),
+	}
+	if err := l.load(); err != nil {
+		l.closeFiles()
+		lock.release()
+		return nil, err
+	}
+	return l, nil
+}
+
+// load opens the tables of the directory and replays the write-ahead log
+// into the memtable.
+func (l *LSM) load() error {
+	entries, err := l.fs.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+
+	var ids []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == tempTableFileName || name == tempCompactionFileName {
+			// Left behind by an interrupted flush or compaction
+			if err := l.fs.Remove(filepath.Join(l.dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if id, err := strconv.Atoi(strings.TrimPrefix(name, tableFilePrefix)); err == nil && strings.HasPrefix(name, tableFilePrefix) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		table, err := openTable(l.fs, l.tablePath(id), id)
+		if err != nil {
+			return err
+		}
+		l.tables = append(l.tables, table)
+		l.nextTableID = id + 1
+		if table.maxSeq > l.lastSeq {
+			l.lastSeq = table.maxSeq
+		}
+	}
+
+	if err := l.replayWAL(); err != nil {
+		return err
+	}
+	return l.openWAL()
+}
+
+// replayWAL adds the records of the write-ahead log to the memtable. A
+// record cut short at its end was never acknowledged and is cut off.
+func (l *LSM) replayWAL() error {
+	walPath := filepath.Join(l.dir, walFileName)
+	file, reader, err := openSegmentReader(l.fs, walPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	offset := int64(segmentHeaderSize)
+	for {
+		var record entry
+		n, err := record.DecodeFromReader(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return truncateFile(l.fs, walPath, offset)
+			}
+			return fmt.Errorf("corrupted log %s at offset %d: %w", walPath, offset, err)
+		}
+		offset += int64(n)
+
+		l.insert(record)
+		if record.seq > l.lastSeq {
+			l.lastSeq = record.seq
+		}
+		if record.timestamp > l.lastTimestamp {
+			l.lastTimestamp = record.timestamp
+		}
+	}
+}
+
+func (l *LSM) openWAL() error {
+	f, size, err := openSegmentForAppend(l.fs, filepath.Join(l.dir, walFileName))
+	if err != nil {
+		return err
+	}
+	l.wal = f
+	l.walOffset = size
+	return nil
+}
+
+func (l *LSM) tablePath(id int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%s%d", tableFilePrefix, id))
+}
+
+// insert adds a record to the memtable unless it holds a newer one.
+func (l *LSM) insert(e entry) {
+	current, ok := l.memtable[e.key]
+	if ok && current.seq > e.seq {
+		return
+	}
+	if ok {
+		l.memtableBytes -= int64(current.encodedSize())
+	}
+	l.memtable[e.key] = e
+	l.memtableBytes += int64(e.encodedSize())
+}
+
+func (l *LSM) Get(key string) (string, error) {
+	return l.GetContext(context.Background(), key)
+}
+
+func (l *LSM) GetContext(ctx context.Context, key string) (string, error) {
+	record, err := l.get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if record.valueType != TypeString {
+		return "", ErrTypeMismatch
+	}
+	return record.stringValue, nil
+}
+
+func (l *LSM) GetInt64(key string) (int64, error) {
+	return l.GetInt64Context(context.Background(), key)
+}
+
+func (l *LSM) GetInt64Context(ctx context.Context, key string) (int64, error) {
+	record, err := l.get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if record.valueType != TypeInt64 {
+		return 0, ErrTypeMismatch
+	}
+	return record.int64Value, nil
+}
+
+// get looks key up in the memtable and then in the tables, newest first,
+// giving up once ctx is done.
+func (l *LSM) get(ctx context.Context, key string) (*entry, error) {
+	if !validKey(key) {
+		return nil, ErrNotFound
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return nil, ErrClosed
+	}
+	if record, ok := l.memtable[key]; ok {
+		return &record, nil
+	}
+	for i := len(l.tables) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		record, err := l.tables[i].get(key)
+		if err != ErrNotFound {
+			return record, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (l *LSM) Put(key, value string) (uint64, error) {
+	return l.PutContext(context.Background(), key, value)
+}
+
+func (l *LSM) PutContext(ctx context.Context, key, value string) (uint64, error) {
+	return l.put(ctx, entry{
+		key:         key,
+		valueType:   TypeString,
+		stringValue: value,
+	})
+}
+
+func (l *LSM) PutInt64(key string, value int64) (uint64, error) {
+	return l.PutInt64Context(context.Background(), key, value)
+}
+
+func (l *LSM) PutInt64Context(ctx context.Context, key string, value int64) (uint64, error) {
+	return l.put(ctx, entry{
+		key:        key,
+		valueType:  TypeInt64,
+		int64Value: value,
+	})
+}
+
+// put writes a record unless ctx is done before mu is free. Once written,
+// the record is stored even if ctx ends meanwhile.
+func (l *LSM) put(ctx context.Context, e entry) (uint64, error) {
+	if err := checkLimits(e.key, &e, l.maxKeySize, l.maxValueSize); err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// A flush may have held mu for a while
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return l.write([]entry{e})
+}
+
+// write appends records to the log and the memtable and returns the
+// sequence number of the last one. The caller holds mu exclusively.
+func (l *LSM) write(entries []entry) (uint64, error) {
+	if l.closed {
+		return 0, ErrClosed
+	}
+	if l.writeErr != nil {
+		return 0, l.writeErr
+	}
+
+	// Reopen the log if a failed flush left none
+	if l.wal == nil {
+		if err := l.openWAL(); err != nil {
+			return 0, err
+		}
+	}
+
+	seq := l.lastSeq
+	timestamp := time.Now().UnixNano()
+	if timestamp < l.lastTimestamp {
+		timestamp = l.lastTimestamp
+	}
+
+	var data []byte
+	for i := range entries {
+		seq++
+		entries[i].seq = seq
+		entries[i].timestamp = timestamp
+		data = append(data, entries[i].Encode()...)
+	}
+
+	// A failed write must not leave part of a record in the log
+	n, err := l.wal.Write(data)
+	if err != nil {
+		if n > 0 {
+			if truncErr := l.wal.Truncate(l.walOffset); truncErr != nil {
+				l.writeErr = fmt.Errorf("log holds a partial record: %w", truncErr)
+			}
+		}
+		return 0, err
+	}
+	l.walOffset += int64(len(data))
+	l.lastSeq = seq
+	l.lastTimestamp = timestamp
+
+	for _, e := range entries {
+		l.insert(e)
+	}
+
+	// The records are safe in the log, so a failed flush does not fail the
+	// write; the next write tries again
+	if l.walOffset >= l.memtableSize {
+		l.flush()
+	}
+	return seq, nil
+}
+
+// flush writes the memtable to a new table and starts an empty log, then
+// starts a compaction if there are too many tables. The caller holds mu
+// exclusively.
+func (l *LSM) flush() error {
+	if len(l.memtable) == 0 {
+		return nil
+	}
+
+	table, err := writeTable(l.fs, l.tablePath(l.nextTableID), tempTableFileName, l.nextTableID, &sliceIterator{records: l.sortedMemtable()})
+	if err != nil {
+		return err
+	}
+	l.tables = append(l.tables, table)
+	l.nextTableID++
+	l.memtable = make(map[string]entry)
+	l.memtableBytes = 0
+
+	// Replaying a log whose records are already in a table is harmless, so
+	// the log is only dropped once the table is in place
+	l.wal.Close()
+	l.wal = nil
+	if err := l.fs.Remove(filepath.Join(l.dir, walFileName)); err != nil {
+		return err
+	}
+	if err := l.openWAL(); err != nil {
+		return err
+	}
+
+	l.startCompaction()
+	return nil
+}
+
+// startCompaction compacts the tables in the background if there are too
+// many and no compaction is running. The caller holds mu exclusively.
+func (l *LSM) startCompaction() {
+	if l.compacting || l.closed || len(l.tables) <= maxTables {
+		return
+	}
+	l.compacting = true
+	l.compactions.Add(1)
+	go l.compact(append([]*sstable(nil), l.tables...))
+}
+
+// compact merges tables into one holding the latest record of every key
+// without holding mu, so reads and writes go on meanwhile, and then swaps it
+// in for them. Tables flushed since the compaction started are newer and
+// stay in place. The result takes the ID of the newest merged table, so it
+// still shadows the older ones if they are left behind by a crash. A failed
+// compaction leaves the tables as they are for the next flush to retry.
+func (l *LSM) compact(tables []*sstable) {
+	defer l.compactions.Done()
+
+	sources := make([]recordIterator, len(tables))
+	for i, table := range tables {
+		sources[i] = table.iterator()
+	}
+	newest := tables[len(tables)-1]
+	start := time.Now()
+	table, err := writeTable(l.fs, newest.path, tempCompactionFileName, newest.id, newMergeIterator(sources...))
+	elapsed := time.Since(start)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.compacting = false
+	l.compactStats.count++
+	l.compactStats.lastDuration = elapsed
+	l.compactStats.totalTime += elapsed
+	l.compactStats.lastErr = err
+	if err != nil {
+		return
+	}
+
+	for _, old := range tables {
+		old.close()
+		if old.id != newest.id {
+			l.fs.Remove(old.path)
+		}
+	}
+	l.tables = append([]*sstable{table}, l.tables[len(tables):]...)
+
+	// Flushes may have added enough tables meanwhile
+	l.startCompaction()
+}
+
+// sortedMemtable returns the records of the memtable in key order. The
+// caller holds mu.
+func (l *LSM) sortedMemtable() []entry {
+	records := make([]entry, 0, len(l.memtable))
+	for _, record := range l.memtable {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].key < records[j].key
+	})
+	return records
+}
+
+// Dump writes the latest value of every key as JSON Lines sorted by key and
+// returns the number of records written. Writes wait until the dump is done.
+func (l *LSM) Dump(w io.Writer) (int, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	sources := make([]recordIterator, 0, len(l.tables)+1)
+	for _, table := range l.tables {
+		sources = append(sources, table.iterator())
+	}
+	sources = append(sources, &sliceIterator{records: l.sortedMemtable()})
+	it := newMergeIterator(sources...)
+
+	encoder := json.NewEncoder(w)
+	written := 0
+	for {
+		record, err := it.next()
+		if errors.Is(err, io.EOF) {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+
+		v := newVersion(record)
+		err = encoder.Encode(DumpRecord{
+			Key:   record.key,
+			Type:  TypeName(v.Type),
+			Value: v.Value,
+		})
+		if err != nil {
+			return written, err
+		}
+		written++
+	}
+}
+
+// Load reads JSON Lines in the format written by Dump and stores every
+// record, returning the number of records stored. Records of buckets are
+// rejected with ErrInvalidKey. Each batch is written atomically; on error
+// the batches before it stay written.
+func (l *LSM) Load(r io.Reader) (int, error) {
+	return l.LoadContext(context.Background(), r)
+}
+
+func (l *LSM) LoadContext(ctx context.Context, r io.Reader) (int, error) {
+	check := func(e *entry) error {
+		return checkLimits(e.key, e, l.maxKeySize, l.maxValueSize)
+	}
+	write := func(batch []entry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := l.write(batch)
+		return err
+	}
+	return loadRecords(r, check, write)
+}
+
+// LastSeq returns the sequence number of the most recently written record.
+func (l *LSM) LastSeq() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.lastSeq
+}
+
+// Stats returns statistics of the database. Every table is a segment, and
+// the write-ahead log is the active one; merges are compactions. Like Dump,
+// counting the live bytes reads every table, and writes wait until it is
+// done.
+func (l *LSM) Stats() (Stats, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return Stats{}, ErrClosed
+	}
+
+	sources := make([]recordIterator, 0, len(l.tables)+1)
+	for _, table := range l.tables {
+		sources = append(sources, table.iterator())
+	}
+	sources = append(sources, &sliceIterator{records: l.sortedMemtable()})
+	it := newMergeIterator(sources...)
+
+	stats := Stats{ActiveOffset: l.walOffset}
+	live := make([]int64, len(sources))
+	for {
+		record, err := it.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return Stats{}, err
+		}
+		stats.Keys++
+		live[it.source] += int64(record.encodedSize())
+	}
+
+	for i, table := range l.tables {
+		stats.Segments = append(stats.Segments, SegmentStats{
+			ID:        table.id,
+			Size:      table.size,
+			LiveBytes: live[i],
+			DeadBytes: table.indexOffset - tableHeaderSize - live[i],
+		})
+		stats.IndexBytes += table.memoryBytes()
+	}
+	wal := SegmentStats{
+		ID:        l.nextTableID,
+		Active:    true,
+		Size:      l.walOffset,
+		LiveBytes: live[len(l.tables)],
+	}
+	if wal.Size > segmentHeaderSize {
+		wal.DeadBytes = wal.Size - segmentHeaderSize - wal.LiveBytes
+	}
+	stats.Segments = append(stats.Segments, wal)
+
+	stats.Merges = l.compactStats.count
+	stats.LastMergeDuration = l.compactStats.lastDuration
+	stats.TotalMergeTime = l.compactStats.totalTime
+	stats.LastMergeError = l.compactStats.lastErr
+	return stats, nil
+}
+
+// Counters returns the counters of the database. Telling a key's latest
+// record from those it overwrote in older tables takes a walk, so Keys and
+// LiveBytes count a key once for every table holding it until compaction
+// merges them; only the log's overwritten records count as dead.
+func (l *LSM) Counters() (Counters, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return Counters{}, ErrClosed
+	}
+
+	counters := Counters{
+		Keys:      len(l.memtable),
+		Segments:  len(l.tables) + 1,
+		DiskBytes: l.walOffset,
+		LiveBytes: l.memtableBytes,
+	}
+	if l.walOffset > segmentHeaderSize {
+		counters.DeadBytes = l.walOffset - segmentHeaderSize - l.memtableBytes
+	}
+	for _, table := range l.tables {
+		counters.Keys += table.records
+		counters.DiskBytes += table.size
+		counters.LiveBytes += table.indexOffset - tableHeaderSize
+		counters.IndexBytes += table.memoryBytes()
+	}
+
+	counters.Merges = l.compactStats.count
+	counters.LastMergeDuration = l.compactStats.lastDuration
+	counters.TotalMergeTime = l.compactStats.totalTime
+	counters.LastMergeError = l.compactStats.lastErr
+	return counters, nil
+}
+
+// Close closes the files of the database once the operations in progress
+// are done; later ones fail with ErrClosed. The memtable is not flushed: its
+// records are replayed from the log on the next open. Calling Close again
+// does nothing.
+func (l *LSM) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.mu.Unlock()
+
+	// A running compaction needs mu to finish
+	l.compactions.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer l.lock.release()
+	return l.closeFiles()
+}
+
+func (l *LSM) closeFiles() error {
+	var firstErr error
+	if l.wal != nil {
+		firstErr = l.wal.Close()
+		l.wal = nil
+	}
+	for _, table := range l.tables {
+		if err := table.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	l.tables = nil
+	return firstErr
+}
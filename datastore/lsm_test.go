@@ -0,0 +1,284 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLSM_FlushAndCompaction(t *testing.T) {
+	fsys := NewMemFS()
+	opts := Options{FS: fsys, MaxSegmentSize: 512}
+	db, err := OpenLSM("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2000; i++ {
+		if _, err := db.PutInt64(fmt.Sprintf("key_%04d", i%500), int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Compactions run in the background
+	db.compactions.Wait()
+	db.mu.RLock()
+	tables := len(db.tables)
+	db.mu.RUnlock()
+	if tables == 0 || tables > maxTables {
+		t.Errorf("Expected between 1 and %d tables, got %d", maxTables, tables)
+	}
+
+	entries, _ := fsys.ReadDir("/db")
+	files := 0
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tableFilePrefix) {
+			files++
+		}
+	}
+	if files != tables {
+		t.Errorf("Expected %d table files, found %d", tables, files)
+	}
+
+	// Every key is found through the sparse index and absent keys between
+	// and around them are not
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key_%04d", i)
+		if value, err := db.GetInt64(key); err != nil || value != int64(1500+i) {
+			t.Fatalf("GetInt64(%s) = %d, %v", key, value, err)
+		}
+		if _, err := db.GetInt64(key + "x"); err != ErrNotFound {
+			t.Fatalf("Expected ErrNotFound for %sx, got %v", key, err)
+		}
+	}
+	for _, key := range []string{"a", "key_", "zzz"} {
+		if _, err := db.Get(key); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for %s, got %v", key, err)
+		}
+	}
+	db.Close()
+}
+
+func TestLSM_Stats(t *testing.T) {
+	db, err := OpenLSM("/db", Options{FS: NewMemFS(), MaxSegmentSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 200; i++ {
+		if _, err := db.PutInt64(fmt.Sprintf("key_%03d", i%50), int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.compactions.Wait()
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 50 {
+		t.Errorf("Expected 50 keys, got %d", stats.Keys)
+	}
+	wal := stats.Segments[len(stats.Segments)-1]
+	if !wal.Active || wal.Size != stats.ActiveOffset || len(stats.Segments) < 2 {
+		t.Errorf("Expected tables and the log as the active segment, got %+v", stats)
+	}
+	// Every key holds one live record: the header, the key and an int64
+	var live int64
+	for _, segment := range stats.Segments {
+		live += segment.LiveBytes
+		if segment.DeadBytes < 0 {
+			t.Errorf("Segment %+v has negative dead bytes", segment)
+		}
+	}
+	if expected := int64(50 * (entryHeaderSize + 7 + 8)); live != expected {
+		t.Errorf("Expected %d live bytes, got %d", expected, live)
+	}
+	if stats.IndexBytes <= 0 {
+		t.Errorf("Expected an index memory estimate, got %d", stats.IndexBytes)
+	}
+
+	// Counters do not tell overwritten records in older tables apart, so
+	// they count at least as much
+	counters, err := db.Counters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counters.Segments != len(stats.Segments) || counters.Keys < stats.Keys || counters.LiveBytes < live {
+		t.Errorf("Counters %+v do not match stats %+v", counters, stats)
+	}
+	if counters.Merges != stats.Merges || counters.IndexBytes != stats.IndexBytes {
+		t.Errorf("Counters %+v do not match stats %+v", counters, stats)
+	}
+}
+
+// blockingFS holds back the creation of a file until released.
+type blockingFS struct {
+	FS
+	name    string
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if filepath.Base(name) == f.name && flag&os.O_CREATE != 0 {
+		f.once.Do(func() { close(f.started) })
+		<-f.release
+	}
+	return f.FS.OpenFile(name, flag, perm)
+}
+
+func TestLSM_CompactionDoesNotBlockWrites(t *testing.T) {
+	fsys := &blockingFS{
+		FS:      NewMemFS(),
+		name:    tempCompactionFileName,
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	db, err := OpenLSM("/db", Options{FS: fsys, MaxSegmentSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	i := 0
+	put := func() {
+		t.Helper()
+		if _, err := db.PutInt64(fmt.Sprintf("key_%03d", i%100), int64(i)); err != nil {
+			t.Fatal(err)
+		}
+		i++
+	}
+	for {
+		put()
+		select {
+		case <-fsys.started:
+		default:
+			continue
+		}
+		break
+	}
+
+	// Writes, flushes and reads go on while the compaction is stuck
+	for n := 0; n < 500; n++ {
+		put()
+	}
+	db.mu.RLock()
+	tables := len(db.tables)
+	db.mu.RUnlock()
+	if tables <= maxTables+1 {
+		t.Errorf("Expected flushes during the compaction, got %d tables", tables)
+	}
+	if value, err := db.GetInt64(fmt.Sprintf("key_%03d", (i-1)%100)); err != nil || value != int64(i-1) {
+		t.Errorf("GetInt64 during the compaction = %d, %v", value, err)
+	}
+
+	close(fsys.release)
+	db.compactions.Wait()
+	db.mu.RLock()
+	tables = len(db.tables)
+	db.mu.RUnlock()
+	if tables > maxTables {
+		t.Errorf("Expected at most %d tables after the compaction, got %d", maxTables, tables)
+	}
+	for k := i - 100; k < i; k++ {
+		key := fmt.Sprintf("key_%03d", k%100)
+		if value, err := db.GetInt64(key); err != nil || value != int64(k) {
+			t.Fatalf("GetInt64(%s) = %d, %v", key, value, err)
+		}
+	}
+}
+
+func TestLSM_DamagedSparseIndexCount(t *testing.T) {
+	data := encodeSparseIndex([]sparseIndexEntry{{key: "a", offset: 8}})
+	binary.LittleEndian.PutUint32(data, 0xFFFFFFFF)
+	if _, err := decodeSparseIndex(data); err == nil {
+		t.Error("Expected an error for a count larger than the index")
+	}
+}
+
+func TestLSM_BloomFilter(t *testing.T) {
+	var hashes []uint64
+	for i := 0; i < 1000; i++ {
+		hashes = append(hashes, bloomHash(fmt.Sprintf("key%d", i)))
+	}
+	filter := newBloomFilter(hashes)
+
+	for i := 0; i < 1000; i++ {
+		if !filter.mayContain(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("Filter misses key%d", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.mayContain(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+	// About 1% is expected with 10 bits per key
+	if falsePositives > 300 {
+		t.Errorf("%d false positives out of 10000", falsePositives)
+	}
+}
+
+func TestLSM_Recovery(t *testing.T) {
+	fsys := NewMemFS()
+	opts := Options{FS: fsys, MaxSegmentSize: 256}
+	db, err := OpenLSM("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		if _, err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// A crash can leave a torn record in the log and a partial table
+	wal, err := fsys.OpenFile(filepath.Join("/db", walFileName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := entry{key: "torn", valueType: TypeString, stringValue: "lost"}
+	wal.Write(record.Encode()[:12])
+	wal.Close()
+	temp, err := fsys.OpenFile(filepath.Join("/db", tempTableFileName), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	temp.Write([]byte(tableMagic))
+	temp.Close()
+
+	db, err = OpenLSM("/db", opts)
+	if err != nil {
+		t.Fatalf("Open after crash: %v", err)
+	}
+	defer db.Close()
+	if _, err := fsys.Stat(filepath.Join("/db", tempTableFileName)); err == nil {
+		t.Error("Partial table was not removed")
+	}
+	if _, err := db.Get("torn"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for the torn record, got %v", err)
+	}
+	if _, err := db.Put("after", "crash"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if value, err := db.Get(key); err != nil || value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Get(%s) = %q, %v", key, value, err)
+		}
+	}
+
+	if _, err := OpenLSM("/db", opts); err == nil {
+		t.Error("Expected the open database to be locked")
+	}
+}
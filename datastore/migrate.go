@@ -0,0 +1,271 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MigratedSegment describes a segment file rewritten by Migrate.
+type MigratedSegment struct {
+	Name        string
+	FromVersion uint32
+	Records     int
+}
+
+// Migrate rewrites every segment in dir that uses an older on-disk format
+// into the current one and returns the files it changed. Each file is
+// written to a temporary file, synced and renamed over the original, so an
+// interrupted migration leaves every file readable in either format and can
+// simply be run again. Migrate fails with ErrLocked while the database is
+// open.
+func Migrate(dir string) ([]MigratedSegment, error) {
+	lock, err := lockForMaintenance(osFS{}, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+
+	names, err := segmentFileNames(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrated []MigratedSegment
+	for _, name := range names {
+		result, err := migrateSegment(filepath.Join(dir, name))
+		if err != nil {
+			return migrated, fmt.Errorf("failed to migrate %s: %w", name, err)
+		}
+		if result != nil {
+			result.Name = name
+			migrated = append(migrated, *result)
+		}
+	}
+
+	if len(migrated) > 0 {
+		if err := syncDir(dir); err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
+// segmentFileNames lists the segment files of a data directory, oldest
+// first, with the active segment last.
+func segmentFileNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type segmentName struct {
+		id   int
+		name string
+	}
+	var segments []segmentName
+	hasCurrentData := false
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, segmentFilePrefix) {
+			if id, err := strconv.Atoi(strings.TrimPrefix(name, segmentFilePrefix)); err == nil {
+				segments = append(segments, segmentName{id: id, name: name})
+			}
+		} else if name == outFileName {
+			hasCurrentData = true
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].id < segments[j].id
+	})
+
+	names := make([]string, 0, len(segments)+1)
+	for _, seg := range segments {
+		names = append(names, seg.name)
+	}
+	if hasCurrentData {
+		names = append(names, outFileName)
+	}
+	return names, nil
+}
+
+// migrateSegment rewrites one segment file in the current format. It returns
+// nil if the file is already up to date.
+func migrateSegment(filePath string) (*MigratedSegment, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	remaining := stat.Size()
+
+	reader := bufio.NewReader(file)
+	version, err := readSegmentVersion(reader)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if err == nil && version == formatVersion {
+		return nil, nil
+	}
+	if version > formatVersion {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, version)
+	}
+
+	tempPath := filePath + ".migrate"
+	temp, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tempPath) // no-op once renamed
+
+	writer := bufio.NewWriter(temp)
+	writer.Write(encodeSegmentHeader())
+
+	result := &MigratedSegment{FromVersion: version}
+	for {
+		buf, err := readRecord(reader, 9, remaining)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			temp.Close()
+			return nil, err
+		}
+
+		var record entry
+		if err := record.decodeLegacy(buf); err != nil {
+			temp.Close()
+			return nil, err
+		}
+		remaining -= int64(len(buf))
+		writer.Write(record.Encode())
+		result.Records++
+	}
+
+	// Make the new file durable before it replaces the old one
+	if err := writer.Flush(); err != nil {
+		temp.Close()
+		return nil, err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return nil, err
+	}
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// syncDir flushes directory entries so completed renames survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// decodeLegacy decodes a record of the headerless format used before format
+// versions existed. Its guesses about older layouts are kept here, where they
+// only run during migration.
+func (e *entry) decodeLegacy(input []byte) error {
+	if len(input) < 9 { // minimum: size(4) + key_len(4) + type(1)
+		return fmt.Errorf("input too short")
+	}
+
+	// Read key length and key
+	keyLen := binary.LittleEndian.Uint32(input[4:8])
+	if len(input) < int(8+keyLen+1) {
+		return fmt.Errorf("input too short for key")
+	}
+
+	e.key = string(input[8 : 8+keyLen])
+
+	// Read type
+	typeOffset := 8 + keyLen
+	if typeOffset >= uint32(len(input)) {
+		// Backward compatibility: if no type byte, assume string
+		e.valueType = TypeString
+		e.stringValue = string(input[8+keyLen:])
+		return nil
+	}
+
+	e.valueType = input[typeOffset]
+	valueDataStart := typeOffset + 1
+
+	if int(valueDataStart) >= len(input) {
+		return fmt.Errorf("no value data")
+	}
+
+	valueData := input[valueDataStart:]
+	e.seq, e.timestamp = 0, 0
+
+	// Decode value based on type
+	switch e.valueType {
+	case TypeString:
+		if len(valueData) < 4 {
+			return fmt.Errorf("invalid string value data")
+		}
+		strLen := binary.LittleEndian.Uint32(valueData[:4])
+		if len(valueData) < int(4+strLen) {
+			return fmt.Errorf("string value data too short")
+		}
+		e.stringValue = string(valueData[4 : 4+strLen])
+		e.decodeTrailer(valueData[4+strLen:])
+
+	case TypeInt64:
+		if len(valueData) < 8 {
+			return fmt.Errorf("invalid int64 value data")
+		}
+		e.int64Value = int64(binary.LittleEndian.Uint64(valueData[:8]))
+		e.decodeTrailer(valueData[8:])
+
+	default:
+		// Backward compatibility: treat unknown types as strings
+		// Try to decode as old format (length + string)
+		if len(valueData) >= 4 {
+			strLen := binary.LittleEndian.Uint32(valueData[:4])
+			if len(valueData) >= int(4+strLen) {
+				e.stringValue = string(valueData[4 : 4+strLen])
+				e.valueType = TypeString
+			} else {
+				// Fallback: treat entire value data as string
+				e.stringValue = string(valueData)
+				e.valueType = TypeString
+			}
+		} else {
+			e.stringValue = string(valueData)
+			e.valueType = TypeString
+		}
+	}
+
+	return nil
+}
+
+// decodeTrailer reads the sequence number and timestamp that follow the
+// value data. Older records end earlier and keep zero for missing fields.
+func (e *entry) decodeTrailer(rest []byte) {
+	if len(rest) >= 8 {
+		e.seq = binary.LittleEndian.Uint64(rest[:8])
+	}
+	if len(rest) >= 16 {
+		e.timestamp = int64(binary.LittleEndian.Uint64(rest[8:16]))
+	}
+}
@@ -0,0 +1,165 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encodeLegacy produces a record in the headerless format written before
+// format versions existed, optionally followed by a sequence number.
+func encodeLegacy(key, value string, seq uint64) []byte {
+	size := 4 + 4 + len(key) + 1 + 4 + len(value)
+	if seq != 0 {
+		size += 8
+	}
+	data := make([]byte, size)
+	binary.LittleEndian.PutUint32(data, uint32(size))
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(key)))
+	copy(data[8:], key)
+	data[8+len(key)] = TypeString
+	binary.LittleEndian.PutUint32(data[9+len(key):], uint32(len(value)))
+	copy(data[13+len(key):], value)
+	if seq != 0 {
+		binary.LittleEndian.PutUint64(data[13+len(key)+len(value):], seq)
+	}
+	return data
+}
+
+func TestMigrate_LegacyDirectory(t *testing.T) {
+	tmp := t.TempDir()
+
+	var segment []byte
+	segment = append(segment, encodeLegacy("old", "value", 0)...)
+	segment = append(segment, encodeLegacy("shared", "first", 0)...)
+	if err := os.WriteFile(filepath.Join(tmp, "segment-0"), segment, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var current []byte
+	current = append(current, encodeLegacy("shared", "second", 5)...)
+	current = append(current, encodeLegacy("new", "value", 6)...)
+	if err := os.WriteFile(filepath.Join(tmp, "current-data"), current, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Legacy directories are refused until migrated
+	if _, err := Open(tmp); !errors.Is(err, ErrLegacyFormat) {
+		t.Fatalf("Expected ErrLegacyFormat, got %v", err)
+	}
+
+	migrated, err := Migrate(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrated) != 2 || migrated[0].Name != "segment-0" || migrated[1].Name != "current-data" {
+		t.Fatalf("Unexpected migration result: %+v", migrated)
+	}
+	if migrated[0].Records != 2 || migrated[0].FromVersion != 0 {
+		t.Errorf("Unexpected migration of segment-0: %+v", migrated[0])
+	}
+
+	// Running again is a no-op
+	migrated, err = Migrate(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrated) != 0 {
+		t.Errorf("Expected nothing to migrate, got %+v", migrated)
+	}
+
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for key, expected := range map[string]string{"old": "value", "shared": "second", "new": "value"} {
+		value, err := db.Get(key)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", key, err)
+		}
+		if value != expected {
+			t.Errorf("Key %s: expected %q, got %q", key, expected, value)
+		}
+	}
+
+	// Sequence numbers carried by legacy records are kept
+	seq, err := db.Put("after", "migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 7 {
+		t.Errorf("Expected sequence number 7 after migration, got %d", seq)
+	}
+}
+
+func TestMigrate_MergeKeepsVersionOrder(t *testing.T) {
+	tmp := t.TempDir()
+
+	// Versions of one key without sequence numbers, spread over two
+	// segments and mixed with other keys
+	var segments [2][]byte
+	for i := 0; i < 60; i++ {
+		data := &segments[i/30]
+		*data = append(*data, encodeLegacy("counter", fmt.Sprintf("v%02d", i), 0)...)
+		*data = append(*data, encodeLegacy(fmt.Sprintf("other%d", i%7), "x", 0)...)
+	}
+	for i, data := range segments {
+		if err := os.WriteFile(filepath.Join(tmp, fmt.Sprintf("segment-%d", i)), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Migrate(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{MaxVersions: 100, MaxSegmentSize: 512}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopMergeLoop(db)
+
+	// Newer records to merge with them
+	for i := 0; i < 100; i++ {
+		if _, err := db.Put(fmt.Sprintf("new%d", i%13), "y"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(db *Db) {
+		t.Helper()
+		if value, err := db.Get("counter"); err != nil || value != "v59" {
+			t.Errorf("Get = %q, %v, expected v59", value, err)
+		}
+		history, err := db.History("counter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 60 {
+			t.Fatalf("Expected 60 versions, got %d", len(history))
+		}
+		for i, version := range history {
+			if version.Value != fmt.Sprintf("v%02d", i) {
+				t.Fatalf("Version %d is %v", i, version.Value)
+			}
+		}
+	}
+
+	if err := mergeNow(db); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	db.Close()
+
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
@@ -0,0 +1,153 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ObjectStore is a flat store of named immutable objects, such as an S3
+// bucket, that sealed segments are offloaded to. Reading a missing object
+// fails with an error satisfying os.IsNotExist.
+type ObjectStore interface {
+	// Put stores the contents of r under name, replacing any object of
+	// that name. Readers never see a partly written object.
+	Put(name string, r io.Reader) error
+
+	// Get returns the contents of an object.
+	Get(name string) (io.ReadCloser, error)
+
+	// GetRange returns n bytes of an object starting at offset off.
+	GetRange(name string, off int64, n int) ([]byte, error)
+
+	// Delete removes an object. Deleting a missing object is not an error.
+	Delete(name string) error
+
+	// List returns every object in the store.
+	List() ([]ObjectInfo, error)
+}
+
+type ObjectInfo struct {
+	Name string
+	Size int64
+}
+
+// DirObjectStore is an ObjectStore keeping objects as files in a local
+// directory, standing in for a remote store.
+type DirObjectStore struct {
+	dir string
+}
+
+var _ ObjectStore = (*DirObjectStore)(nil)
+
+// tempObjectPrefix marks objects being written.
+const tempObjectPrefix = ".tmp-"
+
+// NewDirObjectStore returns a store keeping objects in dir, creating it if
+// needed.
+func NewDirObjectStore(dir string) (*DirObjectStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirObjectStore{dir: dir}, nil
+}
+
+func (s *DirObjectStore) path(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, tempObjectPrefix) {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+func (s *DirObjectStore) Put(name string, r io.Reader) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+
+	// Write aside and rename, so that the object appears complete or not
+	// at all
+	temp, err := os.CreateTemp(s.dir, tempObjectPrefix+name+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(temp, r)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+func (s *DirObjectStore) Get(name string) (io.ReadCloser, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s *DirObjectStore) GetRange(name string, off int64, n int) ([]byte, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, n)
+	if _, err := f.ReadAt(data, off); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *DirObjectStore) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *DirObjectStore) List() ([]ObjectInfo, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []ObjectInfo
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), tempObjectPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // deleted meanwhile
+			}
+			return nil, err
+		}
+		objects = append(objects, ObjectInfo{Name: entry.Name(), Size: info.Size()})
+	}
+	return objects, nil
+}
@@ -0,0 +1,60 @@
+package datastore
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDirObjectStore(t *testing.T) {
+	store, err := NewDirObjectStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Put("segment-1", strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("segment-1", strings.NewReader("abcdefghij")); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := store.Get("segment-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "abcdefghij" {
+		t.Errorf("Get returned %q", data)
+	}
+	if data, err := store.GetRange("segment-1", 3, 4); err != nil || string(data) != "defg" {
+		t.Errorf("GetRange returned %q, %v", data, err)
+	}
+	if _, err := store.GetRange("segment-1", 8, 4); err == nil {
+		t.Error("Expected an error reading past the end")
+	}
+
+	objects, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0] != (ObjectInfo{Name: "segment-1", Size: 10}) {
+		t.Errorf("Unexpected objects %+v", objects)
+	}
+
+	if err := store.Put("../escape", strings.NewReader("")); err == nil {
+		t.Error("Expected an invalid name to be refused")
+	}
+
+	if err := store.Delete("segment-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("segment-1"); err != nil {
+		t.Errorf("Deleting a missing object failed: %v", err)
+	}
+	if _, err := store.Get("segment-1"); !os.IsNotExist(err) {
+		t.Errorf("Expected a not-exist error, got %v", err)
+	}
+}
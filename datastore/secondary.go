@@ -0,0 +1,283 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+var ErrNoSuchIndex = fmt.Errorf("secondary index does not exist")
+
+// IndexSpec declares a secondary index over a field of JSON object values.
+// Only string values holding a JSON object with a scalar (string, number or
+// boolean) at Field are indexed; other values are skipped.
+type IndexSpec struct {
+	// Name identifies the index in Lookup.
+	Name string
+
+	// Field is the path of the indexed field, with dots separating nested
+	// objects, e.g. "author" or "meta.lang".
+	Field string
+
+	// Bucket restricts the index to one bucket. Empty indexes the default
+	// key space.
+	Bucket string
+}
+
+// secondaryIndex maps field values to the keys holding them. It is guarded
+// by Db.secondaryMu and updated together with the primary index.
+type secondaryIndex struct {
+	spec   IndexSpec
+	path   []string
+	prefix string // stored key prefix of the bucket, empty for the default key space
+
+	values map[string]string              // key -> indexed value
+	keys   map[string]map[string]struct{} // indexed value -> keys
+}
+
+// secondaryUpdate is the new state of one key in one secondary index.
+type secondaryUpdate struct {
+	index   *secondaryIndex
+	key     string
+	value   string
+	indexed bool
+}
+
+func newSecondaryIndexes(specs []IndexSpec) (map[string]*secondaryIndex, error) {
+	indexes := make(map[string]*secondaryIndex)
+	for _, spec := range specs {
+		if spec.Name == "" || spec.Field == "" {
+			return nil, fmt.Errorf("secondary index needs a name and a field: %+v", spec)
+		}
+		if _, ok := indexes[spec.Name]; ok {
+			return nil, fmt.Errorf("duplicate secondary index %q", spec.Name)
+		}
+
+		ix := &secondaryIndex{
+			spec:   spec,
+			path:   strings.Split(spec.Field, "."),
+			values: make(map[string]string),
+			keys:   make(map[string]map[string]struct{}),
+		}
+		if spec.Bucket != "" {
+			prefix, err := bucketPrefix(spec.Bucket)
+			if err != nil {
+				return nil, fmt.Errorf("secondary index %q: %w", spec.Name, err)
+			}
+			ix.prefix = prefix
+		}
+		indexes[spec.Name] = ix
+	}
+	return indexes, nil
+}
+
+// Lookup returns the keys whose value has the given field value in the named
+// secondary index, sorted. Strings match their contents; numbers and
+// booleans match their JSON text, e.g. "42" or "true".
+func (db *Db) Lookup(indexName, value string) ([]string, error) {
+	db.secondaryMu.RLock()
+	defer db.secondaryMu.RUnlock()
+
+	ix, ok := db.secondary[indexName]
+	if !ok {
+		return nil, ErrNoSuchIndex
+	}
+
+	keys := make([]string, 0, len(ix.keys[value]))
+	for key := range ix.keys[value] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Indexes returns the secondary indexes of the database.
+func (db *Db) Indexes() []IndexSpec {
+	specs := make([]IndexSpec, 0, len(db.secondary))
+	for _, ix := range db.secondary {
+		specs = append(specs, ix.spec)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].Name < specs[j].Name
+	})
+	return specs
+}
+
+// rebuildSecondaryIndexes fills the secondary indexes from the latest value
+// of every key. It runs on open, after rebuildIndex. The segments are read
+// through in order, keeping the records the index points to, rather than
+// listing every key and reading each from wherever it lies.
+func (db *Db) rebuildSecondaryIndexes() error {
+	if len(db.secondary) == 0 {
+		return nil
+	}
+
+	for _, seg := range db.allSegments() {
+		if err := db.indexSecondarySegment(seg); err != nil {
+			return fmt.Errorf("failed to index segment %d (%s): %w", seg.id, seg.filePath, err)
+		}
+	}
+	return db.index.err()
+}
+
+// indexSecondarySegment adds the records of a segment the index points to,
+// which hold the latest value of their key, to the secondary indexes
+// covering the key.
+func (db *Db) indexSecondarySegment(seg segmentInfo) error {
+	file, reader, err := db.openSegment(seg)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	offset := int64(segmentHeaderSize)
+	for {
+		var record entry
+		n, err := record.DecodeFromReader(reader)
+		if err != nil {
+			// Indexing has cut off a torn record at the end
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+
+		if db.secondaryCovers(record.key) {
+			if location, ok := db.index.get(record.key); ok && location.segmentID == seg.id && location.offset == offset {
+				for _, ix := range db.secondary {
+					if ix.covers(record.key) {
+						ix.set(ix.update(&record))
+					}
+				}
+			}
+		}
+		offset += int64(n)
+	}
+}
+
+// secondaryCovers reports whether any secondary index applies to a stored
+// key.
+func (db *Db) secondaryCovers(storedKey string) bool {
+	for _, ix := range db.secondary {
+		if ix.covers(storedKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// secondaryUpdates computes the secondary index changes caused by writing
+// entries, so that values are parsed before the index lock is taken.
+func (db *Db) secondaryUpdates(entries []entry) [][]secondaryUpdate {
+	if len(db.secondary) == 0 {
+		return nil
+	}
+
+	updates := make([][]secondaryUpdate, len(entries))
+	for i := range entries {
+		if entries[i].valueType == typeDropBucket {
+			continue
+		}
+		for _, ix := range db.secondary {
+			if ix.covers(entries[i].key) {
+				updates[i] = append(updates[i], ix.update(&entries[i]))
+			}
+		}
+	}
+	return updates
+}
+
+// dropSecondaryBucket removes the keys of a dropped bucket from the secondary
+// indexes. The caller must hold secondaryMu for writing.
+func (db *Db) dropSecondaryBucket(prefix string) {
+	for _, ix := range db.secondary {
+		if ix.prefix == prefix {
+			ix.values = make(map[string]string)
+			ix.keys = make(map[string]map[string]struct{})
+		}
+	}
+}
+
+// covers reports whether the index applies to a stored key.
+func (ix *secondaryIndex) covers(storedKey string) bool {
+	if ix.prefix == "" {
+		return validKey(storedKey)
+	}
+	return strings.HasPrefix(storedKey, ix.prefix)
+}
+
+// update computes the index entry of a record.
+func (ix *secondaryIndex) update(record *entry) secondaryUpdate {
+	u := secondaryUpdate{
+		index: ix,
+		key:   record.key[len(ix.prefix):],
+	}
+	if record.valueType == TypeString {
+		u.value, u.indexed = extractField([]byte(record.stringValue), ix.path)
+	}
+	return u
+}
+
+// set applies an update. The caller must hold secondaryMu for writing.
+func (ix *secondaryIndex) set(u secondaryUpdate) {
+	if old, ok := ix.values[u.key]; ok {
+		if u.indexed && old == u.value {
+			return
+		}
+		delete(ix.keys[old], u.key)
+		if len(ix.keys[old]) == 0 {
+			delete(ix.keys, old)
+		}
+		delete(ix.values, u.key)
+	}
+	if !u.indexed {
+		return
+	}
+
+	ix.values[u.key] = u.value
+	if ix.keys[u.value] == nil {
+		ix.keys[u.value] = make(map[string]struct{})
+	}
+	ix.keys[u.value][u.key] = struct{}{}
+}
+
+// extractField returns the scalar at path in a JSON object document.
+func extractField(document []byte, path []string) (string, bool) {
+	raw := json.RawMessage(document)
+	for _, name := range path {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return "", false
+		}
+		field, ok := object[name]
+		if !ok {
+			return "", false
+		}
+		raw = field
+	}
+
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return "", false
+	}
+	switch raw[0] {
+	case '"':
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", false
+		}
+		return s, true
+	case '{', '[', 'n':
+		// Objects, arrays and null are not indexed
+		return "", false
+	}
+	return string(raw), true
+}
@@ -0,0 +1,158 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSecondaryIndex_Lookup(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		MaxSegmentSize: 256,
+		Indexes: []IndexSpec{
+			{Name: "by_author", Field: "author"},
+			{Name: "by_lang", Field: "meta.lang", Bucket: "books"},
+		},
+	}
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	books, _ := db.Bucket("books")
+	writes := []struct {
+		key, value string
+	}{
+		{"post1", `{"author": "x", "title": "first"}`},
+		{"post2", `{"author": "y"}`},
+		{"post3", `{"author": "x"}`},
+		{"post4", `not json`},
+		{"post5", `{"author": {"name": "x"}}`},
+		{"post6", `{"author": 42}`},
+	}
+	for _, w := range writes {
+		if _, err := db.Put(w.key, w.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.PutInt64("counter", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := books.Put("b1", `{"author": "x", "meta": {"lang": "uk"}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing the field moves the key to its new value
+	if _, err := db.Put("post2", `{"author": "x"}`); err != nil {
+		t.Fatal(err)
+	}
+	// Writes in transactions are indexed as well
+	err = db.Update(func(tx *Tx) error {
+		tx.Put("post3", `{"author": "z"}`)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *Db) {
+		t.Helper()
+		lookup := func(index, value string, expected ...string) {
+			t.Helper()
+			keys, err := db.Lookup(index, value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(expected) == 0 {
+				expected = []string{}
+			}
+			if !reflect.DeepEqual(keys, expected) {
+				t.Errorf("Lookup(%s, %s) = %v, expected %v", index, value, keys, expected)
+			}
+		}
+		lookup("by_author", "x", "post1", "post2")
+		lookup("by_author", "y")
+		lookup("by_author", "z", "post3")
+		lookup("by_author", "42", "post6")
+		lookup("by_lang", "uk", "b1")
+
+		if _, err := db.Lookup("missing", "x"); err != ErrNoSuchIndex {
+			t.Errorf("Expected ErrNoSuchIndex, got %v", err)
+		}
+	}
+	check(db)
+
+	// The indexes are rebuilt on open
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+
+	if err := db.DropBucket("books"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := db.Lookup("by_lang", "uk"); len(keys) != 0 {
+		t.Errorf("Dropped bucket still indexed: %v", keys)
+	}
+}
+
+func TestSecondaryIndex_RebuildWithOffloadedSegments(t *testing.T) {
+	fsys := NewMemFS()
+	store, err := NewDirObjectStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		FS:             fsys,
+		MaxSegmentSize: 256,
+		ObjectStore:    store,
+		LocalSegments:  1,
+		Indexes:        []IndexSpec{{Name: "by_author", Field: "author"}},
+	}
+	db, err := OpenWithOptions("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopMergeLoop(db)
+
+	// Every post changes author a few times, the latest one in the newest
+	// segments
+	for i := 0; i < 30; i++ {
+		value := fmt.Sprintf(`{"author": "a%d"}`, i/10)
+		if _, err := db.Put(fmt.Sprintf("post%d", i%10), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.tryOffload()
+	if objects, _ := store.List(); len(objects) == 0 {
+		t.Fatal("Expected offloaded segments")
+	}
+
+	db = reopen(t, db, fsys, opts)
+	defer db.Close()
+	for author, expected := range map[string]int{"a0": 0, "a1": 0, "a2": 10} {
+		if keys, err := db.Lookup("by_author", author); err != nil || len(keys) != expected {
+			t.Errorf("Lookup(%s) = %v, %v, expected %d keys", author, keys, err, expected)
+		}
+	}
+}
+
+func TestSecondaryIndex_InvalidSpecs(t *testing.T) {
+	invalid := [][]IndexSpec{
+		{{Name: "", Field: "author"}},
+		{{Name: "a", Field: ""}},
+		{{Name: "a", Field: "x"}, {Name: "a", Field: "y"}},
+		{{Name: "a", Field: "x", Bucket: "bad\x00bucket"}},
+	}
+	for _, specs := range invalid {
+		if _, err := OpenWithOptions(t.TempDir(), Options{Indexes: specs}); err == nil {
+			t.Errorf("Expected an error for %+v", specs)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package datastore
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var ErrSnapshotClosed = fmt.Errorf("snapshot is closed")
+
+// Snapshot is a read-only view of the database as of the moment it was taken.
+// Writes made afterwards are invisible to it. While a snapshot is open, merges
+// keep every version it can see; Close releases them.
+type Snapshot struct {
+	db  *Db
+	seq uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Snapshot returns a consistent read view of all records written so far.
+// The caller must Close it to let merges reclaim the versions it pins.
+func (db *Db) Snapshot() *Snapshot {
+	db.snapshotMu.Lock()
+	defer db.snapshotMu.Unlock()
+
+	s := &Snapshot{
+		db:  db,
+		seq: db.lastSeq.Load(),
+	}
+	db.snapshots[s] = struct{}{}
+	return s
+}
+
+// Seq returns the sequence number of the last record visible to the snapshot.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Get returns the value key had when the snapshot was taken. A key not
+// written since is read through the index like Db.Get does; an older
+// version of one written since is searched for in the segments that can
+// hold it, newest first, which reads whole segments.
+func (s *Snapshot) Get(key string) (string, error) {
+	v, err := s.get(key)
+	if err != nil {
+		return "", err
+	}
+	if v.Type != TypeString {
+		return "", ErrTypeMismatch
+	}
+	return v.Value.(string), nil
+}
+
+func (s *Snapshot) GetInt64(key string) (int64, error) {
+	v, err := s.get(key)
+	if err != nil {
+		return 0, err
+	}
+	if v.Type != TypeInt64 {
+		return 0, ErrTypeMismatch
+	}
+	return v.Value.(int64), nil
+}
+
+// Close releases the versions pinned by the snapshot. It is safe to call
+// more than once.
+func (s *Snapshot) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	s.db.snapshotMu.Lock()
+	delete(s.db.snapshots, s)
+	s.db.snapshotMu.Unlock()
+	return nil
+}
+
+// get reads a key of the default key space.
+func (s *Snapshot) get(key string) (Version, error) {
+	// Keys with NUL bytes belong to buckets
+	if !validKey(key) {
+		return Version{}, ErrNotFound
+	}
+	return s.version(key)
+}
+
+// version reads a stored key, which may belong to a bucket.
+func (s *Snapshot) version(key string) (Version, error) {
+	// Hold the read lock so Close cannot release the pin mid-read
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return Version{}, ErrSnapshotClosed
+	}
+	return s.db.GetAt(key, s.seq)
+}
+
+// pinnedSeqs returns the sequence numbers of all open snapshots in
+// ascending order.
+func (db *Db) pinnedSeqs() []uint64 {
+	db.snapshotMu.Lock()
+	defer db.snapshotMu.Unlock()
+
+	seqs := make([]uint64, 0, len(db.snapshots))
+	for s := range db.snapshots {
+		seqs = append(seqs, s.seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+	return seqs
+}
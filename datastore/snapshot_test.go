@@ -0,0 +1,108 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSnapshot_ConsistentView(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithMaxSegmentSize(tmp, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := db.Put(fmt.Sprintf("snap_key_%d", i), "before"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.PutInt64("snap_counter", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := db.Snapshot()
+	defer snapshot.Close()
+
+	// Overwrite everything several times so the old versions end up in
+	// segments that get merged
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 5; i++ {
+			value := fmt.Sprintf("after_%d_with_some_padding", round)
+			if _, err := db.Put(fmt.Sprintf("snap_key_%d", i), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.PutInt64("snap_counter", int64(round+2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Put("snap_new_key", "new"); err != nil {
+		t.Fatal(err)
+	}
+	db.tryMerge()
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("snap_key_%d", i)
+		value, err := snapshot.Get(key)
+		if err != nil {
+			t.Fatalf("Snapshot Get(%s): %v", key, err)
+		}
+		if value != "before" {
+			t.Errorf("Snapshot Get(%s) = %q, expected %q", key, value, "before")
+		}
+
+		value, err = db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "after_4_with_some_padding" {
+			t.Errorf("Get(%s) = %q, expected latest value", key, value)
+		}
+	}
+
+	counter, err := snapshot.GetInt64("snap_counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter != 1 {
+		t.Errorf("Snapshot counter = %d, expected 1", counter)
+	}
+
+	// Keys written after the snapshot are invisible
+	if _, err := snapshot.Get("snap_new_key"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for new key, got %v", err)
+	}
+
+	// Closing releases the pin so merges may drop the old versions
+	snapshot.Close()
+	if _, err := snapshot.Get("snap_key_0"); err != ErrSnapshotClosed {
+		t.Errorf("Expected ErrSnapshotClosed, got %v", err)
+	}
+	if len(db.pinnedSeqs()) != 0 {
+		t.Errorf("Expected no pinned sequence numbers after Close")
+	}
+}
+
+func TestSnapshot_BucketKeysHidden(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	users, err := db.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Put("alice", "in bucket"); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := db.Snapshot()
+	defer snapshot.Close()
+	if _, err := snapshot.Get("users" + bucketSeparator + "alice"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a stored bucket key, got %v", err)
+	}
+}
@@ -0,0 +1,496 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"unsafe"
+)
+
+// A sorted string table holds the records the LSM engine flushed from its
+// memtable, one per key in key order:
+// 0       8         idx     flt      size-24  <-- offset
+// (header)(records) (index) (filter) (footer) <-- content
+//
+// The header is the magic "KVST" and the format version; records use the
+// segment record format. The sparse index lists every sparseIndexInterval-th
+// key with the offset of its record as a count followed by (kl)(key)(offset)
+// items, so a lookup reads at most one run of records. The bloom filter lets
+// lookups skip tables that cannot hold a key. The footer holds the offsets
+// of the index and the filter and the highest sequence number in the table.
+const (
+	tableMagic          = "KVST"
+	tableHeaderSize     = 8
+	tableFooterSize     = 8 + 8 + 8
+	sparseIndexInterval = 16
+
+	// minSparseIndexEntrySize is the size of an index entry with an empty
+	// key: the key length and the offset.
+	minSparseIndexEntrySize = 4 + 8
+
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+type sparseIndexEntry struct {
+	key    string
+	offset int64
+}
+
+// sstable is an open table file with its sparse index and filter in memory.
+type sstable struct {
+	id          int
+	path        string
+	file        File
+	index       []sparseIndexEntry
+	indexOffset int64 // end of the records
+	filter      bloomFilter
+	maxSeq      uint64
+	records     int
+	size        int64 // of the file
+}
+
+func openTable(fsys FS, path string, id int) (*sstable, error) {
+	file, err := openFile(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	t := &sstable{id: id, path: path, file: file}
+	if err := t.readMeta(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("table %s: %w", path, err)
+	}
+	return t, nil
+}
+
+func (t *sstable) readMeta() error {
+	stat, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	t.size = size
+	if size < tableHeaderSize+tableFooterSize {
+		return fmt.Errorf("file too short")
+	}
+
+	header := make([]byte, tableHeaderSize)
+	if _, err := t.file.ReadAt(header, 0); err != nil {
+		return err
+	}
+	if string(header[:4]) != tableMagic {
+		return fmt.Errorf("not a table file")
+	}
+	if version := binary.LittleEndian.Uint32(header[4:]); version != formatVersion {
+		return fmt.Errorf("%w %d (supported: %d)", ErrUnsupportedVersion, version, formatVersion)
+	}
+
+	footerOffset := size - tableFooterSize
+	footer := make([]byte, tableFooterSize)
+	if _, err := t.file.ReadAt(footer, footerOffset); err != nil {
+		return err
+	}
+	t.indexOffset = int64(binary.LittleEndian.Uint64(footer))
+	filterOffset := int64(binary.LittleEndian.Uint64(footer[8:]))
+	t.maxSeq = binary.LittleEndian.Uint64(footer[16:])
+	if t.indexOffset < tableHeaderSize || filterOffset < t.indexOffset || filterOffset > footerOffset {
+		return fmt.Errorf("invalid footer")
+	}
+
+	meta := make([]byte, footerOffset-t.indexOffset)
+	if _, err := t.file.ReadAt(meta, t.indexOffset); err != nil {
+		return err
+	}
+	t.index, err = decodeSparseIndex(meta[:filterOffset-t.indexOffset])
+	if err != nil {
+		return err
+	}
+	t.filter, err = decodeBloomFilter(meta[filterOffset-t.indexOffset:])
+	if err != nil {
+		return err
+	}
+	return t.countRecords()
+}
+
+// countRecords counts the records of the table from the sparse index and
+// the last run, the only one that may be short.
+func (t *sstable) countRecords() error {
+	if len(t.index) == 0 {
+		return nil
+	}
+	last := t.index[len(t.index)-1].offset
+	if last < tableHeaderSize || last > t.indexOffset {
+		return fmt.Errorf("invalid sparse index offset %d", last)
+	}
+	run := make([]byte, t.indexOffset-last)
+	if _, err := t.file.ReadAt(run, last); err != nil {
+		return err
+	}
+
+	t.records = (len(t.index) - 1) * sparseIndexInterval
+	for len(run) > 0 {
+		if len(run) < 4 {
+			return fmt.Errorf("truncated record")
+		}
+		size := int(binary.LittleEndian.Uint32(run))
+		if size < entryHeaderSize || size > len(run) {
+			return fmt.Errorf("invalid record size %d", size)
+		}
+		run = run[size:]
+		t.records++
+	}
+	return nil
+}
+
+// get returns the record of key stored in the table.
+func (t *sstable) get(key string) (*entry, error) {
+	if !t.filter.mayContain(key) {
+		return nil, ErrNotFound
+	}
+
+	// The key can only be in the run starting at the last indexed key not
+	// after it
+	i := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].key > key
+	}) - 1
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	start, end := t.index[i].offset, t.indexOffset
+	if i+1 < len(t.index) {
+		end = t.index[i+1].offset
+	}
+
+	run := make([]byte, end-start)
+	if _, err := t.file.ReadAt(run, start); err != nil {
+		return nil, err
+	}
+	for len(run) > 0 {
+		if len(run) < 4 {
+			return nil, fmt.Errorf("table %s: truncated record", t.path)
+		}
+		size := int(binary.LittleEndian.Uint32(run))
+		if size < entryHeaderSize || size > len(run) {
+			return nil, fmt.Errorf("table %s: invalid record size %d", t.path, size)
+		}
+
+		var record entry
+		if err := record.Decode(run[:size]); err != nil {
+			return nil, fmt.Errorf("table %s: %w", t.path, err)
+		}
+		if record.key == key {
+			return &record, nil
+		}
+		if record.key > key {
+			break
+		}
+		run = run[size:]
+	}
+	return nil, ErrNotFound
+}
+
+// iterator returns the records of the table in key order.
+func (t *sstable) iterator() recordIterator {
+	section := io.NewSectionReader(t.file, tableHeaderSize, t.indexOffset-tableHeaderSize)
+	return &readerIterator{reader: bufio.NewReader(section)}
+}
+
+// memoryBytes estimates the memory held by the sparse index and the filter.
+func (t *sstable) memoryBytes() int64 {
+	size := int64(len(t.filter.bits))
+	for _, e := range t.index {
+		size += int64(len(e.key)) + int64(unsafe.Sizeof(e))
+	}
+	return size
+}
+
+func (t *sstable) close() error {
+	return t.file.Close()
+}
+
+// recordIterator yields records in key order and io.EOF after the last one.
+type recordIterator interface {
+	next() (*entry, error)
+}
+
+type readerIterator struct {
+	reader *bufio.Reader
+}
+
+func (it *readerIterator) next() (*entry, error) {
+	var record entry
+	if _, err := record.DecodeFromReader(it.reader); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+type sliceIterator struct {
+	records []entry
+}
+
+func (it *sliceIterator) next() (*entry, error) {
+	if len(it.records) == 0 {
+		return nil, io.EOF
+	}
+	record := &it.records[0]
+	it.records = it.records[1:]
+	return record, nil
+}
+
+// mergeIterator merges sorted iterators, yielding only the record with the
+// highest sequence number of every key.
+type mergeIterator struct {
+	sources []recordIterator
+	heads   []*entry
+	started bool
+
+	// Index of the source of the record returned last
+	source int
+}
+
+func newMergeIterator(sources ...recordIterator) *mergeIterator {
+	return &mergeIterator{
+		sources: sources,
+		heads:   make([]*entry, len(sources)),
+	}
+}
+
+func (it *mergeIterator) next() (*entry, error) {
+	if !it.started {
+		it.started = true
+		for i := range it.sources {
+			if err := it.advance(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var best *entry
+	for i, head := range it.heads {
+		if head == nil {
+			continue
+		}
+		if best == nil || head.key < best.key || (head.key == best.key && head.seq > best.seq) {
+			best = head
+			it.source = i
+		}
+	}
+	if best == nil {
+		return nil, io.EOF
+	}
+
+	// Skip the older versions of the key in the other sources
+	key := best.key
+	for i, head := range it.heads {
+		if head != nil && head.key == key {
+			if err := it.advance(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return best, nil
+}
+
+func (it *mergeIterator) advance(i int) error {
+	record, err := it.sources[i].next()
+	if errors.Is(err, io.EOF) {
+		it.heads[i] = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	it.heads[i] = record
+	return nil
+}
+
+// writeTable writes the records of it, which must be in key order, to a new
+// table at path. The file is written under tempName and synced
+// before it is renamed into place, so path never holds a partial table.
+func writeTable(fsys FS, path, tempName string, id int, it recordIterator) (*sstable, error) {
+	tempPath := filepath.Join(filepath.Dir(path), tempName)
+	file, err := fsys.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeTableData(file, it)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fsys.Rename(tempPath, path)
+	}
+	if err != nil {
+		fsys.Remove(tempPath)
+		return nil, err
+	}
+	return openTable(fsys, path, id)
+}
+
+func writeTableData(file File, it recordIterator) error {
+	w := bufio.NewWriter(file)
+
+	header := make([]byte, tableHeaderSize)
+	copy(header, tableMagic)
+	binary.LittleEndian.PutUint32(header[4:], formatVersion)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	offset := int64(tableHeaderSize)
+	var index []sparseIndexEntry
+	var hashes []uint64
+	var maxSeq uint64
+	for count := 0; ; count++ {
+		record, err := it.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if count%sparseIndexInterval == 0 {
+			index = append(index, sparseIndexEntry{key: record.key, offset: offset})
+		}
+		hashes = append(hashes, bloomHash(record.key))
+		if record.seq > maxSeq {
+			maxSeq = record.seq
+		}
+
+		data := record.Encode()
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		offset += int64(len(data))
+	}
+
+	indexData := encodeSparseIndex(index)
+	filterData := newBloomFilter(hashes).encode()
+	footer := make([]byte, tableFooterSize)
+	binary.LittleEndian.PutUint64(footer, uint64(offset))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(offset+int64(len(indexData))))
+	binary.LittleEndian.PutUint64(footer[16:], maxSeq)
+
+	for _, data := range [][]byte{indexData, filterData, footer} {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func encodeSparseIndex(index []sparseIndexEntry) []byte {
+	data := binary.LittleEndian.AppendUint32(nil, uint32(len(index)))
+	for _, item := range index {
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(item.key)))
+		data = append(data, item.key...)
+		data = binary.LittleEndian.AppendUint64(data, uint64(item.offset))
+	}
+	return data
+}
+
+func decodeSparseIndex(data []byte) ([]sparseIndexEntry, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("truncated sparse index")
+	}
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	// A damaged count must not allocate more entries than the data holds
+	if uint64(count) > uint64(len(data)/minSparseIndexEntrySize) {
+		return nil, fmt.Errorf("sparse index count %d exceeds its %d bytes", count, len(data))
+	}
+
+	index := make([]sparseIndexEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated sparse index")
+		}
+		kl := int(binary.LittleEndian.Uint32(data))
+		if len(data) < 4+kl+8 {
+			return nil, fmt.Errorf("truncated sparse index")
+		}
+		index = append(index, sparseIndexEntry{
+			key:    string(data[4 : 4+kl]),
+			offset: int64(binary.LittleEndian.Uint64(data[4+kl:])),
+		})
+		data = data[4+kl+8:]
+	}
+	return index, nil
+}
+
+// bloomFilter answers whether a table may contain a key. It uses double
+// hashing over a 64-bit FNV-1a hash of the key.
+type bloomFilter struct {
+	bits   []byte
+	hashes uint32
+}
+
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func newBloomFilter(keyHashes []uint64) bloomFilter {
+	nbits := len(keyHashes) * bloomBitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	f := bloomFilter{
+		bits:   make([]byte, (nbits+7)/8),
+		hashes: bloomHashes,
+	}
+	for _, h := range keyHashes {
+		f.add(h)
+	}
+	return f
+}
+
+func (f bloomFilter) add(h uint64) {
+	nbits := uint32(len(f.bits) * 8)
+	h1, h2 := uint32(h), uint32(h>>32)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % nbits
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (f bloomFilter) mayContain(key string) bool {
+	nbits := uint32(len(f.bits) * 8)
+	h := bloomHash(key)
+	h1, h2 := uint32(h), uint32(h>>32)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % nbits
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f bloomFilter) encode() []byte {
+	data := binary.LittleEndian.AppendUint32(nil, f.hashes)
+	return append(data, f.bits...)
+}
+
+func decodeBloomFilter(data []byte) (bloomFilter, error) {
+	if len(data) < 4+1 {
+		return bloomFilter{}, fmt.Errorf("truncated bloom filter")
+	}
+	return bloomFilter{
+		hashes: binary.LittleEndian.Uint32(data),
+		bits:   data[4:],
+	}, nil
+}
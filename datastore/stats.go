@@ -0,0 +1,239 @@
+package datastore
+
+import (
+	"os"
+	"time"
+	"unsafe"
+)
+
+// Stats describes the state of a database at one point in time.
+type Stats struct {
+	Keys         int            // keys in the index, buckets included
+	Segments     []SegmentStats // oldest first, the active segment last
+	ActiveOffset int64          // write offset in the active segment
+
+	Merges            int           // merges run since open
+	LastMergeDuration time.Duration // duration of the last merge
+	TotalMergeTime    time.Duration // time spent merging since open
+	LastMergeError    error         // error of the last merge, nil if it succeeded
+
+	Offloads         int   // segments offloaded to the object store since open
+	LastOffloadError error // error of the last failed offload, nil if none
+
+	QueueDepth     int   // write requests waiting for the writer goroutine
+	QueueCapacity  int   // write requests the queue holds
+	WriteStalls    int64 // writes that found the queue full since open
+	WritesRejected int64 // writes refused with ErrBusy since open
+
+	IndexBytes     int64 // estimated memory held by the index, its cache with IndexOnDisk
+	IndexDiskBytes int64 // size of the index files with IndexOnDisk
+}
+
+// SegmentStats describes one segment file. Live bytes hold the latest
+// record of some key; dead bytes hold overwritten and dropped records,
+// including older versions kept for history.
+type SegmentStats struct {
+	ID        int
+	Active    bool
+	Remote    bool // offloaded to the object store
+	Size      int64
+	LiveBytes int64
+	DeadBytes int64
+}
+
+// Counters are the statistics of a database kept up to date as it changes.
+// Unlike Stats they are cheap to read, as needed for frequent scraping.
+type Counters struct {
+	Keys        int   // keys in the index, buckets included
+	Segments    int   // segment files, the active one included
+	DiskBytes   int64 // size of the local segment files
+	RemoteBytes int64 // size of the segments offloaded to the object store
+	LiveBytes   int64 // bytes of records holding the latest value of a key
+	DeadBytes   int64 // bytes of overwritten and dropped records
+
+	// The rest are as in Stats
+	Merges            int
+	LastMergeDuration time.Duration
+	TotalMergeTime    time.Duration
+	LastMergeError    error
+
+	QueueDepth     int
+	QueueCapacity  int
+	WriteStalls    int64
+	WritesRejected int64
+
+	IndexBytes     int64
+	IndexDiskBytes int64
+}
+
+type mergeStats struct {
+	count        int
+	lastDuration time.Duration
+	totalTime    time.Duration
+	lastErr      error
+
+	offloads       int
+	lastOffloadErr error
+}
+
+// indexEntryOverhead estimates the memory an index entry takes besides the
+// bytes of its key: the string header, the entry and the map slot.
+const indexEntryOverhead = int64(unsafe.Sizeof("")) + int64(unsafe.Sizeof(indexEntry{})) + 8
+
+// runMerge merges the read-only segments and records the outcome in the
+// merge statistics. It runs on the writer goroutine.
+func (db *Db) runMerge() error {
+	start := time.Now()
+	err := db.mergeSegments()
+	elapsed := time.Since(start)
+
+	db.mergeStatsMu.Lock()
+	db.mergeStats.count++
+	db.mergeStats.lastDuration = elapsed
+	db.mergeStats.totalTime += elapsed
+	db.mergeStats.lastErr = err
+	db.mergeStatsMu.Unlock()
+	return err
+}
+
+// mergeCount returns the number of merges run so far.
+func (db *Db) mergeCount() int {
+	db.mergeStatsMu.Lock()
+	defer db.mergeStatsMu.Unlock()
+	return db.mergeStats.count
+}
+
+// Stats returns statistics of the database. Counting the live bytes of
+// every segment walks the whole index, so it is not meant to be called on
+// a hot path.
+func (db *Db) Stats() (Stats, error) {
+	merges := db.mergeCount()
+
+	// Only the segment sizes are taken under segmentMu; the index walk
+	// does not hold up rotation and merges
+	db.segmentMu.RLock()
+	segments, err := db.segmentStats()
+	db.segmentMu.RUnlock()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	stats := Stats{
+		ActiveOffset:   db.outOffset.Load(),
+		QueueDepth:     len(db.putChan),
+		QueueCapacity:  cap(db.putChan),
+		WriteStalls:    db.writeStalls.Load(),
+		WritesRejected: db.writesRejected.Load(),
+	}
+
+	live := make(map[int]int64)
+	for i := range db.index.shards {
+		shard := &db.index.shards[i]
+		shard.mu.RLock()
+		stats.Keys += shard.entries.len()
+		shard.entries.forEach(func(_ string, location indexEntry) {
+			live[location.segmentID] += int64(location.size)
+		})
+		stats.IndexBytes += shard.entries.memoryBytes()
+		if table, ok := shard.entries.(*diskTable); ok {
+			stats.IndexDiskBytes += table.diskBytes()
+		}
+		shard.mu.RUnlock()
+	}
+	if err := db.index.err(); err != nil {
+		return Stats{}, err
+	}
+
+	// A merge during the walk moved records between the segments listed
+	if db.mergeCount() != merges {
+		return db.Stats()
+	}
+	for _, segment := range segments {
+		segment.LiveBytes = live[segment.ID]
+		if segment.Size > segmentHeaderSize {
+			segment.DeadBytes = segment.Size - segmentHeaderSize - segment.LiveBytes
+		}
+		stats.Segments = append(stats.Segments, segment)
+	}
+
+	db.mergeStatsMu.Lock()
+	stats.Merges = db.mergeStats.count
+	stats.LastMergeDuration = db.mergeStats.lastDuration
+	stats.TotalMergeTime = db.mergeStats.totalTime
+	stats.LastMergeError = db.mergeStats.lastErr
+	stats.Offloads = db.mergeStats.offloads
+	stats.LastOffloadError = db.mergeStats.lastOffloadErr
+	db.mergeStatsMu.Unlock()
+
+	return stats, nil
+}
+
+// segmentStats returns the segments with their sizes. The caller holds
+// segmentMu.
+func (db *Db) segmentStats() ([]SegmentStats, error) {
+	var segments []SegmentStats
+	for _, seg := range db.allSegments() {
+		segment := SegmentStats{
+			ID:     seg.id,
+			Active: seg.id == db.activeSegmentID,
+			Remote: seg.remote,
+		}
+		if seg.remote {
+			segment.Size = seg.size
+		} else {
+			info, err := db.fs.Stat(seg.filePath)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			if err == nil {
+				segment.Size = info.Size()
+			}
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// Counters returns the counters of the database. It takes time in the
+// number of segments and index shards, not keys.
+func (db *Db) Counters() (Counters, error) {
+	counters := Counters{
+		QueueDepth:     len(db.putChan),
+		QueueCapacity:  cap(db.putChan),
+		WriteStalls:    db.writeStalls.Load(),
+		WritesRejected: db.writesRejected.Load(),
+	}
+
+	var headers int64
+	db.segmentMu.RLock()
+	for _, seg := range db.allSegments() {
+		size := seg.size
+		if seg.id == db.activeSegmentID {
+			size = db.outOffset.Load()
+		}
+		if seg.remote {
+			counters.RemoteBytes += size
+		} else {
+			counters.DiskBytes += size
+		}
+		if size >= segmentHeaderSize {
+			headers += segmentHeaderSize
+		}
+		counters.Segments++
+	}
+	counters.Keys, counters.LiveBytes, counters.IndexBytes, counters.IndexDiskBytes = db.index.counts()
+	db.segmentMu.RUnlock()
+	if err := db.index.err(); err != nil {
+		return Counters{}, err
+	}
+	counters.DeadBytes = counters.DiskBytes + counters.RemoteBytes - headers - counters.LiveBytes
+
+	db.mergeStatsMu.Lock()
+	counters.Merges = db.mergeStats.count
+	counters.LastMergeDuration = db.mergeStats.lastDuration
+	counters.TotalMergeTime = db.mergeStats.totalTime
+	counters.LastMergeError = db.mergeStats.lastErr
+	db.mergeStatsMu.Unlock()
+
+	return counters, nil
+}
@@ -0,0 +1,213 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_Stats(t *testing.T) {
+	fsys := newFaultFS(NewMemFS())
+	db, err := OpenWithOptions("/db", Options{FS: fsys, MaxSegmentSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 60; i++ {
+		if _, err := db.Put(fmt.Sprintf("key%d", i%5), fmt.Sprintf("value%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	totals := func(stats Stats) (size, live, dead int64) {
+		for _, segment := range stats.Segments {
+			size += segment.Size
+			live += segment.LiveBytes
+			dead += segment.DeadBytes
+		}
+		return
+	}
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 5 {
+		t.Errorf("Expected 5 keys, got %d", stats.Keys)
+	}
+	active := stats.Segments[len(stats.Segments)-1]
+	if !active.Active || active.Size != stats.ActiveOffset {
+		t.Errorf("Active segment %+v does not end at offset %d", active, stats.ActiveOffset)
+	}
+	// Every key holds one live record: the header, the key and a string
+	// value with its length
+	size, live, dead := totals(stats)
+	if expected := int64(5 * (entryHeaderSize + 4 + 4 + 7)); live != expected {
+		t.Errorf("Expected %d live bytes, got %d", expected, live)
+	}
+	if size != live+dead+int64(len(stats.Segments))*segmentHeaderSize {
+		t.Errorf("Size %d does not add up to %d live and %d dead bytes", size, live, dead)
+	}
+	if stats.IndexBytes <= 0 {
+		t.Errorf("Expected an index memory estimate, got %d", stats.IndexBytes)
+	}
+
+	if err := mergeNow(db); err != nil {
+		t.Fatal(err)
+	}
+	merged, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Merges < 1 || merged.LastMergeError != nil || merged.TotalMergeTime < merged.LastMergeDuration {
+		t.Errorf("Unexpected merge statistics after a merge: %+v", merged)
+	}
+	if _, mergedLive, mergedDead := totals(merged); mergedLive != live || mergedDead >= dead {
+		t.Errorf("Merge left %d live and %d dead bytes, had %d and %d", mergedLive, mergedDead, live, dead)
+	}
+
+	// A failed merge is reported rather than swallowed
+	for i := 0; i < 30; i++ {
+		if _, err := db.Put(fmt.Sprintf("key%d", i%5), "again"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsys.setFailRename(func(oldpath, newpath string) bool {
+		return strings.HasPrefix(filepath.Base(oldpath), "temp-merge")
+	})
+	mergeNow(db)
+	failed, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(failed.LastMergeError, errInjected) || failed.Merges <= merged.Merges {
+		t.Errorf("Expected the failed merge to be recorded, got %d merges, error %v", failed.Merges, failed.LastMergeError)
+	}
+}
+
+func TestDb_StatsOutsideSegmentLock(t *testing.T) {
+	db, err := OpenWithOptions("/db", Options{FS: NewMemFS(), MaxSegmentSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 60; i++ {
+		if _, err := db.Put(fmt.Sprintf("key%d", i%5), fmt.Sprintf("value%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Hold up the index walk
+	shard := &db.index.shards[len(db.index.shards)-1]
+	shard.mu.Lock()
+	result := make(chan Stats)
+	go func() {
+		stats, err := db.Stats()
+		if err != nil {
+			t.Error(err)
+		}
+		result <- stats
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Rotation and merges can take the segment lock meanwhile
+	locked := make(chan struct{})
+	go func() {
+		db.segmentMu.Lock()
+		db.segmentMu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("Stats holds the segment lock while walking the index")
+	}
+	shard.mu.Unlock()
+
+	if stats := <-result; stats.Keys != 5 {
+		t.Errorf("Expected 5 keys, got %d", stats.Keys)
+	}
+}
+
+func TestDb_CountersMatchStats(t *testing.T) {
+	for _, indexOnDisk := range []bool{false, true} {
+		t.Run(fmt.Sprintf("IndexOnDisk=%v", indexOnDisk), func(t *testing.T) {
+			fsys := NewMemFS()
+			opts := Options{FS: fsys, MaxSegmentSize: 256, IndexOnDisk: indexOnDisk}
+			db, err := OpenWithOptions("/db", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stopMergeLoop(db)
+
+			check := func(step string) {
+				t.Helper()
+				stats, err := db.Stats()
+				if err != nil {
+					t.Fatal(err)
+				}
+				counters, err := db.Counters()
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected := Counters{
+					Keys:           stats.Keys,
+					Segments:       len(stats.Segments),
+					Merges:         stats.Merges,
+					QueueCapacity:  stats.QueueCapacity,
+					IndexBytes:     stats.IndexBytes,
+					IndexDiskBytes: stats.IndexDiskBytes,
+				}
+				for _, segment := range stats.Segments {
+					if segment.Remote {
+						expected.RemoteBytes += segment.Size
+					} else {
+						expected.DiskBytes += segment.Size
+					}
+					expected.LiveBytes += segment.LiveBytes
+					expected.DeadBytes += segment.DeadBytes
+				}
+				counters.LastMergeDuration, counters.TotalMergeTime = 0, 0
+				if counters != expected {
+					t.Errorf("%s: counters %+v, expected %+v", step, counters, expected)
+				}
+			}
+			check("empty")
+
+			tmp, _ := db.Bucket("tmp")
+			for i := 0; i < 60; i++ {
+				if _, err := db.Put(fmt.Sprintf("key%d", i%7), fmt.Sprintf("value%d", i)); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := tmp.PutInt64(fmt.Sprintf("key%d", i%3), int64(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			check("writes")
+			if err := db.DropBucket("tmp"); err != nil {
+				t.Fatal(err)
+			}
+			check("drop")
+			if err := mergeNow(db); err != nil {
+				t.Fatal(err)
+			}
+			check("merge")
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db, err = OpenWithOptions("/db", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			stopMergeLoop(db)
+			check("reopen")
+		})
+	}
+}
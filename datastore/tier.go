@@ -0,0 +1,156 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const defaultLocalSegments = 2
+
+// tryOffload moves the sealed segments older than the LocalSegments most
+// recent ones to the object store. It runs on the merge goroutine, so a
+// segment is never offloaded while a merge reads it.
+func (db *Db) tryOffload() {
+	if db.objects == nil || db.closed.Load() {
+		return
+	}
+
+	db.segmentMu.RLock()
+	var candidates []segmentInfo
+	for i := 0; i < len(db.segments)-db.localSegments; i++ {
+		if !db.segments[i].remote {
+			candidates = append(candidates, db.segments[i])
+		}
+	}
+	db.segmentMu.RUnlock()
+
+	for _, seg := range candidates {
+		if db.closed.Load() {
+			return
+		}
+		err := db.offloadSegment(seg)
+
+		db.mergeStatsMu.Lock()
+		if err == nil {
+			db.mergeStats.offloads++
+		} else {
+			db.mergeStats.lastOffloadErr = err
+		}
+		db.mergeStatsMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// offloadSegment uploads a sealed segment to the object store and removes
+// the local file once readers have been switched over.
+func (db *Db) offloadSegment(seg segmentInfo) error {
+	file, err := openFile(db.fs, seg.filePath)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil {
+		err = db.objects.Put(filepath.Base(seg.filePath), file)
+	}
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to offload segment %d: %w", seg.id, err)
+	}
+
+	// Readers look up where a segment is kept under segmentMu, so none is
+	// left reading the local file when it is removed
+	db.segmentMu.Lock()
+	for i := range db.segments {
+		if db.segments[i].id == seg.id {
+			db.segments[i].remote = true
+			db.segments[i].size = info.Size()
+		}
+	}
+	db.segmentMu.Unlock()
+
+	// A local copy left behind is preferred on open, it holds the same
+	// records
+	return db.fs.Remove(seg.filePath)
+}
+
+// remoteSegments lists the segments kept in the object store, leaving out
+// the ones with a local copy.
+func (db *Db) remoteSegments(local map[int]bool) ([]segmentInfo, error) {
+	objects, err := db.objects.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the object store: %w", err)
+	}
+
+	var segments []segmentInfo
+	for _, object := range objects {
+		if !strings.HasPrefix(object.Name, segmentFilePrefix) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(object.Name, segmentFilePrefix))
+		if err != nil || local[id] {
+			continue
+		}
+		segments = append(segments, segmentInfo{
+			id:       id,
+			filePath: filepath.Join(db.dir, object.Name),
+			readOnly: true,
+			remote:   true,
+			size:     object.Size,
+			seqs:     unboundedRange,
+		})
+	}
+	return segments, nil
+}
+
+// remoteSegment returns the segment with the given ID if it has been
+// offloaded. The caller must hold segmentMu.
+func (db *Db) remoteSegment(segmentID int) (segmentInfo, bool) {
+	for _, seg := range db.segments {
+		if seg.id == segmentID {
+			return seg, seg.remote
+		}
+	}
+	return segmentInfo{}, false
+}
+
+// readRemoteEntry reads the record an index entry points to from an
+// offloaded segment, fetching only the bytes of the record.
+func (db *Db) readRemoteEntry(seg segmentInfo, location indexEntry) (*entry, error) {
+	data, err := db.objects.GetRange(filepath.Base(seg.filePath), location.offset, int(location.size))
+	if err != nil {
+		return nil, err
+	}
+
+	var record entry
+	if _, err := record.DecodeFromReader(bufio.NewReader(bytes.NewReader(data))); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// openSegment opens a segment for sequential reading past its header,
+// wherever it is kept.
+func (db *Db) openSegment(seg segmentInfo) (io.Closer, *bufio.Reader, error) {
+	if !seg.remote {
+		return openSegmentReader(db.fs, seg.filePath)
+	}
+
+	name := filepath.Base(seg.filePath)
+	body, err := db.objects.Get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(body)
+	if err := checkSegmentHeader(name, reader); err != nil {
+		body.Close()
+		return nil, nil, err
+	}
+	return body, reader, nil
+}
@@ -0,0 +1,290 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// stopMergeLoop stops background merges and offloads, leaving them to the
+// test.
+func stopMergeLoop(db *Db) {
+	close(db.stopMerge)
+	db.mergeWG.Wait()
+	db.stopMerge = make(chan struct{})
+}
+
+// failingStore is an object store refusing uploads.
+type failingStore struct {
+	ObjectStore
+}
+
+func (failingStore) Put(name string, r io.Reader) error {
+	return fmt.Errorf("upload of %s refused", name)
+}
+
+func TestTiering_OffloadAndRead(t *testing.T) {
+	fsys := NewMemFS()
+	store, err := NewDirObjectStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{FS: fsys, MaxSegmentSize: 256, ObjectStore: store, LocalSegments: 1}
+	db, err := OpenWithOptions("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopMergeLoop(db)
+
+	acked := make(map[string]string)
+	for i := 0; i < 60; i++ {
+		key, value := fmt.Sprintf("key%d", i%20), fmt.Sprintf("value%02d", i)
+		if _, err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		acked[key] = value
+	}
+
+	db.tryOffload()
+
+	// All sealed segments but the newest are read from the store
+	checkOffloaded := func(db *Db) int {
+		t.Helper()
+		stats, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed := stats.Segments[:len(stats.Segments)-1]
+		if len(sealed) < 3 {
+			t.Fatalf("Expected several sealed segments, got %d", len(sealed))
+		}
+		for i, segment := range sealed {
+			path := db.segmentPath(segment.ID)
+			_, statErr := fsys.Stat(path)
+			if remote := i < len(sealed)-1; segment.Remote != remote || os.IsNotExist(statErr) != remote {
+				t.Errorf("Segment %d: remote %v, local file error %v", segment.ID, segment.Remote, statErr)
+			}
+			if segment.Remote && segment.Size <= segmentHeaderSize {
+				t.Errorf("Segment %d has size %d", segment.ID, segment.Size)
+			}
+		}
+		return len(sealed) - 1
+	}
+	offloaded := checkOffloaded(db)
+	if stats, _ := db.Stats(); stats.Offloads != offloaded || stats.LastOffloadError != nil {
+		t.Errorf("Expected %d offloads, got %d, %v", offloaded, stats.Offloads, stats.LastOffloadError)
+	}
+	objects, _ := store.List()
+	if len(objects) != offloaded {
+		t.Errorf("Expected %d objects, got %+v", offloaded, objects)
+	}
+	checkAcknowledged(t, db, acked)
+	if history, err := db.History("key0"); err != nil || len(history) != 3 {
+		t.Errorf("Expected 3 versions of key0, got %d, %v", len(history), err)
+	}
+
+	// Offloaded segments are found again on open
+	db = reopen(t, db, fsys, opts)
+	stopMergeLoop(db)
+	checkOffloaded(db)
+	checkAcknowledged(t, db, acked)
+
+	// So are they by read-only opens given the store
+	readOnly, err := OpenReadOnlyWithOptions("/db", Options{FS: fsys, ObjectStore: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAcknowledged(t, readOnly, acked)
+	readOnly.Close()
+
+	// A merge takes the offloaded segments in and deletes their objects,
+	// which only hold overwritten versions now
+	if err := mergeNow(db); err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range objects {
+		if _, err := store.Get(object.Name); !os.IsNotExist(err) {
+			t.Errorf("Merged object %s was left in the store: %v", object.Name, err)
+		}
+	}
+	if stats, _ := db.Stats(); len(stats.Segments) != 2 || stats.Segments[0].Remote || stats.LastMergeError != nil {
+		t.Errorf("Expected a local merged segment, got %+v, %v", stats.Segments, stats.LastMergeError)
+	}
+	checkAcknowledged(t, db, acked)
+	if history, err := db.History("key0"); err != nil || len(history) != 1 || history[0].Value != acked["key0"] {
+		t.Errorf("Expected only the latest version of key0, got %+v, %v", history, err)
+	}
+
+	db = reopen(t, db, fsys, opts)
+	checkAcknowledged(t, db, acked)
+	db.Close()
+}
+
+// blockingStore holds range reads back until released.
+type blockingStore struct {
+	ObjectStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) GetRange(name string, off int64, n int) ([]byte, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return s.ObjectStore.GetRange(name, off, n)
+}
+
+func TestTiering_RemoteReadOutsideSegmentLock(t *testing.T) {
+	dirStore, err := NewDirObjectStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &blockingStore{ObjectStore: dirStore, started: make(chan struct{}), release: make(chan struct{})}
+	db, err := OpenWithOptions("/db", Options{FS: NewMemFS(), MaxSegmentSize: 256, ObjectStore: store, LocalSegments: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stopMergeLoop(db)
+
+	for i := 0; i < 40; i++ {
+		if _, err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.tryOffload()
+
+	result := make(chan error)
+	go func() {
+		value, err := db.Get("key0")
+		if err == nil && value != "value0" {
+			err = fmt.Errorf("got %q", value)
+		}
+		result <- err
+	}()
+	<-store.started
+
+	// A merge can run during the fetch and delete the object fetched from,
+	// making the read start over from the merged segment
+	if err := mergeNow(db); err != nil {
+		t.Fatal(err)
+	}
+	if objects, _ := dirStore.List(); len(objects) != 0 {
+		t.Fatalf("Expected the merge to delete the objects, got %+v", objects)
+	}
+	close(store.release)
+	if err := <-result; err != nil {
+		t.Errorf("Get from an offloaded segment: %v", err)
+	}
+}
+
+// blockingGetStore holds the first fetch of a whole object back until
+// released.
+type blockingGetStore struct {
+	ObjectStore
+	blocked atomic.Bool
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingGetStore) Get(name string) (io.ReadCloser, error) {
+	if s.blocked.CompareAndSwap(false, true) {
+		close(s.started)
+		<-s.release
+	}
+	return s.ObjectStore.Get(name)
+}
+
+func TestTiering_HistoryOutsideSegmentLock(t *testing.T) {
+	dirStore, err := NewDirObjectStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &blockingGetStore{ObjectStore: dirStore, started: make(chan struct{}), release: make(chan struct{})}
+	db, err := OpenWithOptions("/db", Options{FS: NewMemFS(), MaxSegmentSize: 256, ObjectStore: store, LocalSegments: 1, MaxVersions: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stopMergeLoop(db)
+
+	for i := 0; i < 60; i++ {
+		if _, err := db.Put(fmt.Sprintf("key%d", i%20), fmt.Sprintf("value%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.tryOffload()
+
+	result := make(chan []Version)
+	go func() {
+		history, err := db.History("key0")
+		if err != nil {
+			t.Error(err)
+		}
+		result <- history
+	}()
+	<-store.started
+
+	// Rotation and merges can take the segment lock during the fetch. The
+	// merge deletes the object about to be fetched, so the scan starts over.
+	db.segmentMu.Lock()
+	db.segmentMu.Unlock()
+	if err := mergeNow(db); err != nil {
+		t.Fatal(err)
+	}
+	close(store.release)
+
+	history := <-result
+	if len(history) != 3 {
+		t.Fatalf("Expected 3 versions, got %+v", history)
+	}
+	for i, v := range history {
+		if expected := fmt.Sprintf("value%02d", i*20); v.Value != expected {
+			t.Errorf("Version %d: expected %s, got %+v", i, expected, v)
+		}
+	}
+}
+
+func TestTiering_FailedOffload(t *testing.T) {
+	store, err := NewDirObjectStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenWithOptions("/db", Options{
+		FS:             NewMemFS(),
+		MaxSegmentSize: 256,
+		ObjectStore:    failingStore{store},
+		LocalSegments:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stopMergeLoop(db)
+
+	acked := make(map[string]string)
+	for i := 0; i < 40; i++ {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%02d", i)
+		if _, err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		acked[key] = value
+	}
+
+	// The segment stays local and readable
+	db.tryOffload()
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Offloads != 0 || stats.LastOffloadError == nil {
+		t.Errorf("Expected a failed offload, got %d offloads, %v", stats.Offloads, stats.LastOffloadError)
+	}
+	for _, segment := range stats.Segments {
+		if segment.Remote {
+			t.Errorf("Segment %d was marked remote", segment.ID)
+		}
+	}
+	checkAcknowledged(t, db, acked)
+}
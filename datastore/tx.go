@@ -0,0 +1,198 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+)
+
+var ErrConflict = fmt.Errorf("transaction conflicts with a concurrent write")
+
+// maxTxAttempts bounds how many times Update runs a transaction that keeps
+// conflicting with concurrent writes.
+const maxTxAttempts = 10
+
+// Tx is a read-write transaction passed to Db.Update. Reads see the latest
+// committed values and the transaction's own writes; writes are buffered
+// until the transaction commits.
+type Tx struct {
+	db  *Db
+	ctx context.Context
+
+	// Sequence number of every key read, zero for keys that did not exist
+	reads map[string]uint64
+
+	// Buffered writes in order, and the position of each key's write
+	writes   []entry
+	writePos map[string]int
+
+	// Sequence number the transaction committed at
+	seq uint64
+}
+
+// Update runs fn in a transaction and commits its writes atomically. The
+// commit fails if any key read by fn was written in the meantime, in which
+// case fn is run again; after repeated conflicts Update returns ErrConflict.
+// An error returned by fn aborts the transaction and is returned as is.
+func (db *Db) Update(fn func(tx *Tx) error) error {
+	return db.UpdateContext(context.Background(), fn)
+}
+
+// UpdateContext is Update that gives up with ctx.Err() once ctx is done. The
+// transaction's reads and its commit honor ctx; fn is not run again after
+// ctx is done.
+func (db *Db) UpdateContext(ctx context.Context, fn func(tx *Tx) error) error {
+	for attempt := 0; attempt < maxTxAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		tx := &Tx{
+			db:       db,
+			ctx:      ctx,
+			reads:    make(map[string]uint64),
+			writePos: make(map[string]int),
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		err := tx.commit()
+		if err != ErrConflict {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+func (tx *Tx) Get(key string) (string, error) {
+	record, err := tx.read(key)
+	if err != nil {
+		return "", err
+	}
+	if record.valueType != TypeString {
+		return "", ErrTypeMismatch
+	}
+	return record.stringValue, nil
+}
+
+func (tx *Tx) GetInt64(key string) (int64, error) {
+	record, err := tx.read(key)
+	if err != nil {
+		return 0, err
+	}
+	if record.valueType != TypeInt64 {
+		return 0, ErrTypeMismatch
+	}
+	return record.int64Value, nil
+}
+
+func (tx *Tx) Put(key, value string) {
+	tx.write(entry{
+		key:         key,
+		valueType:   TypeString,
+		stringValue: value,
+	})
+}
+
+func (tx *Tx) PutInt64(key string, value int64) {
+	tx.write(entry{
+		key:        key,
+		valueType:  TypeInt64,
+		int64Value: value,
+	})
+}
+
+func (tx *Tx) read(key string) (*entry, error) {
+	// Keys with NUL bytes belong to buckets
+	if !validKey(key) {
+		return nil, ErrNotFound
+	}
+
+	// Read your own writes
+	if pos, ok := tx.writePos[key]; ok {
+		record := tx.writes[pos]
+		return &record, nil
+	}
+
+	record, err := tx.db.readLatest(tx.ctx, key)
+	if err != nil {
+		if err == ErrNotFound {
+			tx.observe(key, 0)
+		}
+		return nil, err
+	}
+	tx.observe(key, record.seq)
+	return record, nil
+}
+
+// observe remembers the first version of key the transaction saw. A later
+// read seeing another version means the commit is bound to conflict.
+func (tx *Tx) observe(key string, seq uint64) {
+	if _, ok := tx.reads[key]; !ok {
+		tx.reads[key] = seq
+	}
+}
+
+func (tx *Tx) write(e entry) {
+	if pos, ok := tx.writePos[e.key]; ok {
+		tx.writes[pos] = e
+		return
+	}
+	tx.writePos[e.key] = len(tx.writes)
+	tx.writes = append(tx.writes, e)
+}
+
+// Seq returns the sequence number the transaction committed at: that of
+// its last write, or the latest one it saw if it wrote nothing. It is zero
+// until Update returns.
+func (tx *Tx) Seq() uint64 {
+	return tx.seq
+}
+
+func (tx *Tx) commit() error {
+	if len(tx.reads) == 0 && len(tx.writes) == 0 {
+		tx.seq = tx.db.lastSeq.Load()
+		return nil
+	}
+	for i := range tx.writes {
+		if err := tx.db.checkWrite(tx.writes[i].key, &tx.writes[i]); err != nil {
+			return err
+		}
+	}
+
+	// Send request to writer goroutine
+	req := putRequest{
+		kind:   requestCommit,
+		reads:  tx.reads,
+		writes: tx.writes,
+		result: make(chan putResult, 1),
+	}
+
+	res := tx.db.send(tx.ctx, req)
+	if res.err == nil {
+		tx.seq = res.seq
+	}
+	return res.err
+}
+
+// handleCommit validates a transaction's reads against the index and writes
+// its records. It runs on the writer goroutine, so no other write can slip
+// in between the check and the append.
+func (db *Db) handleCommit(req putRequest) (uint64, error) {
+	for key, seq := range req.reads {
+		var current uint64
+		if indexEntry, ok := db.index.get(key); ok {
+			current = indexEntry.seq
+		}
+		if err := db.index.err(); err != nil {
+			return 0, err
+		}
+		if current != seq {
+			return 0, ErrConflict
+		}
+	}
+
+	if len(req.writes) == 0 {
+		return db.lastSeq.Load(), nil
+	}
+	return db.appendEntries(req.writes)
+}
@@ -0,0 +1,197 @@
+package datastore
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func transfer(db *Db, from, to string, amount int64) error {
+	return db.Update(func(tx *Tx) error {
+		fromBalance, err := tx.GetInt64(from)
+		if err != nil {
+			return err
+		}
+		toBalance, err := tx.GetInt64(to)
+		if err != nil {
+			return err
+		}
+		tx.PutInt64(from, fromBalance-amount)
+		tx.PutInt64(to, toBalance+amount)
+		return nil
+	})
+}
+
+func TestTx_ConcurrentTransfers(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithMaxSegmentSize(tmp, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.PutInt64("account_a", 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PutInt64("account_b", 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var conflicts sync.Map
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				from, to := "account_a", "account_b"
+				if (w+i)%2 == 0 {
+					from, to = to, from
+				}
+				err := transfer(db, from, to, int64(i%7+1))
+				if errors.Is(err, ErrConflict) {
+					conflicts.Store(w, true)
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	a, err := db.GetInt64("account_a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.GetInt64("account_b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a+b != 2000 {
+		t.Errorf("Transfers lost money: %d + %d != 2000", a, b)
+	}
+}
+
+func TestTx_RetriesOnConflict(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithMaxSegmentSize(tmp, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.PutInt64("counter", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := 0
+	err = db.Update(func(tx *Tx) error {
+		attempts++
+		value, err := tx.GetInt64("counter")
+		if err != nil {
+			return err
+		}
+
+		// A concurrent write on the first attempt invalidates the read
+		if attempts == 1 {
+			if _, err := db.PutInt64("counter", 10); err != nil {
+				return err
+			}
+		}
+
+		tx.PutInt64("counter", value+1)
+		if got, _ := tx.GetInt64("counter"); got != value+1 {
+			t.Errorf("Transaction does not see its own write: %d", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts)
+	}
+
+	value, err := db.GetInt64("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 11 {
+		t.Errorf("Expected counter 11, got %d", value)
+	}
+
+	// Reading a missing key conflicts with its creation
+	attempts = 0
+	err = db.Update(func(tx *Tx) error {
+		attempts++
+		if _, err := tx.Get("created"); err != ErrNotFound {
+			return err
+		}
+		if attempts == 1 {
+			if _, err := db.Put("created", "concurrently"); err != nil {
+				return err
+			}
+		}
+		tx.Put("created", "by transaction")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected the second attempt to see the key, got %d attempts", attempts)
+	}
+
+	// Errors from the function abort the transaction
+	abort := errors.New("abort")
+	err = db.Update(func(tx *Tx) error {
+		tx.PutInt64("counter", 0)
+		return abort
+	})
+	if err != abort {
+		t.Errorf("Expected abort error, got %v", err)
+	}
+	if value, _ := db.GetInt64("counter"); value != 11 {
+		t.Errorf("Aborted transaction changed counter to %d", value)
+	}
+}
+
+func TestTx_BucketKeysHidden(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	users, err := db.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Put("alice", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var committed *Tx
+	err = db.Update(func(tx *Tx) error {
+		committed = tx
+		if _, err := tx.Get("users" + bucketSeparator + "alice"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a bucket key, got %v", err)
+		}
+		tx.Put("bob", "2")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := db.History("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if committed.Seq() != history[0].Seq {
+		t.Errorf("Expected the transaction to commit at %d, got %d", history[0].Seq, committed.Seq())
+	}
+}
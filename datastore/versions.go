@@ -0,0 +1,390 @@
+package datastore
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Version is a single stored value of a key.
+type Version struct {
+	Seq       uint64
+	Timestamp time.Time // zero for records written before timestamps existed
+	Type      uint8
+	Value     interface{} // string or int64 depending on Type
+}
+
+func newVersion(e *entry) Version {
+	v := Version{
+		Seq:  e.seq,
+		Type: e.valueType,
+	}
+	if e.timestamp != 0 {
+		v.Timestamp = time.Unix(0, e.timestamp)
+	}
+	switch e.valueType {
+	case TypeInt64:
+		v.Value = e.int64Value
+	default:
+		v.Value = e.stringValue
+	}
+	return v
+}
+
+// GetAt returns the version of key that was current right after the record
+// with sequence number seq was written.
+func (db *Db) GetAt(key string, seq uint64) (Version, error) {
+	return db.findVersion(key, seq, math.MaxInt64)
+}
+
+// GetAtTime returns the version of key that was current at time t.
+func (db *Db) GetAtTime(key string, t time.Time) (Version, error) {
+	return db.findVersion(key, math.MaxUint64, t.UnixNano())
+}
+
+// History returns all versions of key still stored in the database, oldest
+// first. How many are kept through merges is controlled by
+// Options.MaxVersions and Options.VersionRetention.
+func (db *Db) History(key string) ([]Version, error) {
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+	lastSeq := db.lastSeq.Load()
+	merges := db.mergeCount()
+
+	// Every segment is read, so only the local ones are opened under
+	// segmentMu, which keeps a merge from removing them first. The scan
+	// and the fetches from the object store do not hold up rotation and
+	// merges.
+	db.segmentMu.RLock()
+	segments := db.allSegments()
+	files := make([]io.Closer, len(segments))
+	readers := make([]*bufio.Reader, len(segments))
+	defer func() {
+		for _, file := range files {
+			if file != nil {
+				file.Close()
+			}
+		}
+	}()
+	for i, seg := range segments {
+		if seg.remote {
+			continue
+		}
+		file, reader, err := db.openSegment(seg)
+		if err != nil && !os.IsNotExist(err) {
+			db.segmentMu.RUnlock()
+			return nil, err
+		}
+		files[i], readers[i] = file, reader
+	}
+	db.segmentMu.RUnlock()
+
+	var history []Version
+	for i, seg := range segments {
+		if seg.remote {
+			file, reader, err := db.openSegment(seg)
+			if os.IsNotExist(err) {
+				// Merged and deleted since it was listed
+				return db.History(key)
+			}
+			if err != nil {
+				return nil, err
+			}
+			files[i], readers[i] = file, reader
+		}
+		if readers[i] == nil {
+			continue
+		}
+		err := scanRecords(readers[i], func(e *entry) {
+			// Skip records the writer has not acknowledged yet
+			if e.key == key && e.seq <= lastSeq {
+				history = append(history, newVersion(e))
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A merge since the segments were listed may have replaced the
+	// offloaded ones fetched with a segment of the same name
+	if db.mergeCount() != merges {
+		return db.History(key)
+	}
+	if len(history) == 0 {
+		return nil, ErrNotFound
+	}
+	return history, nil
+}
+
+// readView is a point in the history of the database, as of which reads of
+// older versions are made: a version is visible if written by its sequence
+// number and time, and not dropped with its bucket by then.
+type readView struct {
+	db        *Db
+	seq       uint64
+	timestamp int64
+	floors    map[string]uint64 // drop floors by bucket key prefix
+}
+
+func (db *Db) viewAt(seq uint64, timestamp int64) *readView {
+	return &readView{
+		db:        db,
+		seq:       seq,
+		timestamp: timestamp,
+		floors:    make(map[string]uint64),
+	}
+}
+
+// floor returns the sequence number of the latest drop of the bucket of key
+// made as of the view, zero if there is none or key is not in a bucket.
+func (v *readView) floor(key string) uint64 {
+	name, _, ok := splitBucketKey(key)
+	if !ok {
+		return 0
+	}
+	prefix := name + bucketSeparator
+	floor, ok := v.floors[prefix]
+	if !ok {
+		floor = v.db.dropFloor(prefix, v.seq, v.timestamp)
+		v.floors[prefix] = floor
+	}
+	return floor
+}
+
+func (v *readView) visible(e *entry) bool {
+	return e.seq <= v.seq && e.timestamp <= v.timestamp && e.seq >= v.floor(e.key)
+}
+
+// mayHold reports whether a segment spanning seqs can hold records visible
+// as of the view.
+func (v *readView) mayHold(seqs seqRange) bool {
+	return seqs.MinSeq <= v.seq && seqs.MinTimestamp <= v.timestamp
+}
+
+// findVersion returns the newest version of key with a sequence number at
+// most seq and a timestamp at most timestamp.
+func (db *Db) findVersion(key string, seq uint64, timestamp int64) (Version, error) {
+	if db.closed.Load() {
+		return Version{}, ErrClosed
+	}
+	db.segmentMu.RLock()
+	defer db.segmentMu.RUnlock()
+
+	view := db.viewAt(seq, timestamp)
+	indexEntry, ok := db.index.get(key)
+	if err := db.index.err(); err != nil {
+		return Version{}, err
+	}
+
+	if ok {
+		// Most reads ask for the latest version
+		latest, err := db.readIndexedEntry(indexEntry)
+		if err != nil {
+			return Version{}, err
+		}
+		if view.visible(latest) {
+			return newVersion(latest), nil
+		}
+	} else if name, _, inBucket := splitBucketKey(key); !inBucket || !db.bucketDroppedAfter(name+bucketSeparator, seq, timestamp) {
+		// Only a bucket dropped since can have taken the key away
+		return Version{}, ErrNotFound
+	}
+
+	// Segments are read newest first, skipping those whose records are all
+	// too new or were all dropped; the scan stops once no other segment can
+	// hold a newer version than the one found
+	floor := view.floor(key)
+	var found *entry
+	segments := db.allSegments()
+	for i := len(segments) - 1; i >= 0; i-- {
+		seqs := segments[i].seqs
+		if !view.mayHold(seqs) || seqs.MaxSeq < floor || (found != nil && seqs.MaxSeq <= found.seq) {
+			continue
+		}
+		inSegment, err := db.visibleVersions(segments[i], func(k string) bool { return k == key }, view)
+		if err != nil {
+			return Version{}, err
+		}
+		if record, ok := inSegment[key]; ok && (found == nil || record.seq > found.seq) {
+			found = record
+		}
+	}
+	if found == nil {
+		return Version{}, ErrNotFound
+	}
+	return newVersion(found), nil
+}
+
+// scanVersions finds the newest record visible as of view of every key
+// accepted by want, reading each segment that can hold one once. The caller
+// must hold segmentMu.
+func (db *Db) scanVersions(want func(key string) bool, view *readView) (map[string]*entry, error) {
+	found := make(map[string]*entry)
+	segments := db.allSegments()
+	for i := len(segments) - 1; i >= 0; i-- {
+		if !view.mayHold(segments[i].seqs) {
+			continue
+		}
+		inSegment, err := db.visibleVersions(segments[i], want, view)
+		if err != nil {
+			return nil, err
+		}
+		// The newer segment wins, unless an older one holds a higher
+		// sequence number
+		for key, record := range inSegment {
+			if current, ok := found[key]; !ok || record.seq > current.seq {
+				found[key] = record
+			}
+		}
+	}
+	return found, nil
+}
+
+// visibleVersions returns the newest record visible as of view of every
+// key accepted by want in a segment. The caller must hold segmentMu.
+func (db *Db) visibleVersions(seg segmentInfo, want func(key string) bool, view *readView) (map[string]*entry, error) {
+	found := make(map[string]*entry)
+	err := db.scanSegment(seg, func(e *entry) {
+		if e.valueType == typeDropBucket || !want(e.key) || !view.visible(e) {
+			return
+		}
+		// The last record wins, by sequence number and then by file order
+		if current, ok := found[e.key]; !ok || e.seq >= current.seq {
+			record := *e
+			found[e.key] = &record
+		}
+	})
+	return found, err
+}
+
+// allSegments lists all segments including the active one, oldest first.
+// The caller must hold segmentMu.
+func (db *Db) allSegments() []segmentInfo {
+	segments := make([]segmentInfo, 0, len(db.segments)+1)
+	segments = append(segments, db.segments...)
+	return append(segments, segmentInfo{
+		id:       db.activeSegmentID,
+		filePath: filepath.Join(db.dir, outFileName),
+		seqs:     db.activeSeqs,
+	})
+}
+
+// seqRange is the span of the sequence numbers and timestamps of the records
+// of a segment, which lets reads of older versions skip segments holding
+// only newer records. Segments not indexed yet span everything.
+type seqRange struct {
+	MinSeq       uint64 `json:"min_seq"`
+	MaxSeq       uint64 `json:"max_seq"`
+	MinTimestamp int64  `json:"min_timestamp"`
+	MaxTimestamp int64  `json:"max_timestamp"`
+}
+
+var (
+	unboundedRange = seqRange{MaxSeq: math.MaxUint64, MinTimestamp: math.MinInt64, MaxTimestamp: math.MaxInt64}
+	emptyRange     = seqRange{MinSeq: math.MaxUint64, MinTimestamp: math.MaxInt64, MaxTimestamp: math.MinInt64}
+)
+
+// openRange is the range of a segment receiving records from the given
+// sequence number and timestamp on.
+func openRange(seq uint64, timestamp int64) seqRange {
+	return seqRange{MinSeq: seq, MaxSeq: math.MaxUint64, MinTimestamp: timestamp, MaxTimestamp: math.MaxInt64}
+}
+
+func (r *seqRange) add(e *entry) {
+	r.MinSeq = min(r.MinSeq, e.seq)
+	r.MaxSeq = max(r.MaxSeq, e.seq)
+	r.MinTimestamp = min(r.MinTimestamp, e.timestamp)
+	r.MaxTimestamp = max(r.MaxTimestamp, e.timestamp)
+}
+
+// scanSegment calls fn for every record in a segment. A torn record at the
+// end of the file is treated as its end: it can only be a write to the
+// active segment that is still in progress.
+func (db *Db) scanSegment(seg segmentInfo, fn func(e *entry)) error {
+	file, reader, err := db.openSegment(seg)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	return scanRecords(reader, fn)
+}
+
+// scanRecords calls fn for every record read from an opened segment, up to
+// a torn record at its end.
+func scanRecords(reader *bufio.Reader, fn func(e *entry)) error {
+	for {
+		var record entry
+		_, err := record.DecodeFromReader(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+		fn(&record)
+	}
+}
+
+// retainVersions selects the versions of a key that survive a merge. The
+// versions are ordered oldest first and drops holds the drop markers of the
+// key's bucket in ascending order. A drop counts as a version of its own,
+// one without a value: the latest version is kept unless dropped, along
+// with every version among the MaxVersions most recent ones and every
+// version visible to one of the pinned snapshot sequence numbers (sorted
+// ascending).
+func (db *Db) retainVersions(versions []mergeRecord, drops []uint64, now time.Time, pinned []uint64) []mergeRecord {
+	var cutoff int64
+	if db.versionRetention > 0 {
+		cutoff = now.Add(-db.versionRetention).UnixNano()
+	}
+
+	kept := make([]mergeRecord, 0, len(versions))
+	newer := 0 // versions and drops after the current one
+	for i := len(versions) - 1; i >= 0; i-- {
+		version := versions[i]
+
+		// The version stays current until the next one is written or the
+		// bucket dropped, whichever comes first
+		end := uint64(math.MaxUint64)
+		if i+1 < len(versions) {
+			end = versions[i+1].seq
+		}
+		d := sort.Search(len(drops), func(j int) bool {
+			return drops[j] > version.seq
+		})
+		if d < len(drops) && drops[d] < end {
+			end = drops[d]
+			newer++
+		}
+
+		keep := newer < db.maxVersions || (cutoff != 0 && version.timestamp >= cutoff)
+		if !keep {
+			// A snapshot sees this version if it was taken before the
+			// version stopped being current
+			p := sort.Search(len(pinned), func(j int) bool {
+				return pinned[j] >= version.seq
+			})
+			keep = p < len(pinned) && pinned[p] < end
+		}
+		if keep {
+			kept = append(kept, version)
+		}
+		newer++
+	}
+
+	// Oldest first again
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	return kept
+}
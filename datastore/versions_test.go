@@ -0,0 +1,192 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVersions_GetAt(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithMaxSegmentSize(tmp, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var seqs []uint64
+	var times []time.Time
+	for i := 0; i < 3; i++ {
+		seq, err := db.Put("versioned", fmt.Sprintf("value_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, seq)
+		times = append(times, time.Now())
+		time.Sleep(time.Millisecond)
+	}
+	seq, err := db.PutInt64("versioned", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqs = append(seqs, seq)
+
+	for i := 0; i < 3; i++ {
+		version, err := db.GetAt("versioned", seqs[i])
+		if err != nil {
+			t.Fatalf("GetAt(%d): %v", seqs[i], err)
+		}
+		if version.Value != fmt.Sprintf("value_%d", i) || version.Seq != seqs[i] {
+			t.Errorf("GetAt(%d) = %+v", seqs[i], version)
+		}
+
+		version, err = db.GetAtTime("versioned", times[i])
+		if err != nil {
+			t.Fatalf("GetAtTime(%v): %v", times[i], err)
+		}
+		if version.Value != fmt.Sprintf("value_%d", i) {
+			t.Errorf("GetAtTime(%v) = %+v", times[i], version)
+		}
+	}
+
+	version, err := db.GetAt("versioned", db.LastSeq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Type != TypeInt64 || version.Value != int64(100) {
+		t.Errorf("Expected latest int64 version, got %+v", version)
+	}
+
+	// Nothing existed before the first write
+	if _, err := db.GetAt("versioned", seqs[0]-1); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound before first write, got %v", err)
+	}
+
+	history, err := db.History("versioned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 4 {
+		t.Fatalf("Expected 4 versions, got %d", len(history))
+	}
+	for i, version := range history {
+		if version.Seq != seqs[i] {
+			t.Errorf("History[%d].Seq = %d, expected %d", i, version.Seq, seqs[i])
+		}
+	}
+
+	if _, err := db.History("missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestVersions_RetainedThroughMerge(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithOptions(tmp, Options{MaxSegmentSize: 200, MaxVersions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Spread many versions of a few keys over several segments
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("retained_%d", i%4)
+		if _, err := db.Put(key, fmt.Sprintf("value_%d_with_some_padding", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.tryMerge()
+
+	for k := 0; k < 4; k++ {
+		key := fmt.Sprintf("retained_%d", k)
+		history, err := db.History(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) < 2 {
+			t.Errorf("%s: expected at least 2 versions after merge, got %d", key, len(history))
+		}
+		latest := history[len(history)-1]
+		value, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latest.Value != value {
+			t.Errorf("%s: latest version %v does not match Get %q", key, latest.Value, value)
+		}
+
+		// The previous version is still readable at its sequence number
+		previous := history[len(history)-2]
+		version, err := db.GetAt(key, previous.Seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version.Value != previous.Value {
+			t.Errorf("%s: GetAt(%d) = %v, expected %v", key, previous.Seq, version.Value, previous.Value)
+		}
+	}
+}
+
+// readCountFS counts the files opened for reading.
+type readCountFS struct {
+	FS
+	reads atomic.Int64
+}
+
+func (f *readCountFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag == os.O_RDONLY {
+		f.reads.Add(1)
+	}
+	return f.FS.OpenFile(name, flag, perm)
+}
+
+func TestVersions_GetAtReadsOnlyOlderSegments(t *testing.T) {
+	fsys := &readCountFS{FS: NewMemFS()}
+	opts := Options{FS: fsys, MaxSegmentSize: 256}
+	db, err := OpenWithOptions("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopMergeLoop(db)
+
+	seq, err := db.Put("target", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := db.Put(fmt.Sprintf("filler%d", i), "some value to fill segments"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Put("target", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *Db) {
+		t.Helper()
+		fsys.reads.Store(0)
+		version, err := db.GetAt("target", seq)
+		if err != nil || version.Value != "old" {
+			t.Fatalf("GetAt(%d) = %+v, %v", seq, version, err)
+		}
+		// The latest record, then the first segment alone
+		if reads := fsys.reads.Load(); reads != 2 {
+			t.Errorf("GetAt opened %d files, expected 2", reads)
+		}
+	}
+	check(db)
+	if segments := len(db.segments); segments < 10 {
+		t.Fatalf("Expected many segments, got %d", segments)
+	}
+
+	db.Close()
+	db, err = OpenWithOptions("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stopMergeLoop(db)
+	check(db)
+}